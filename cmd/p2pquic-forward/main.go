@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/internal/logging"
+	"github.com/mevdschee/p2pquic-go/internal/peerflags"
+	"github.com/mevdschee/p2pquic-go/pkg/forward"
+	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
+)
+
+// remoteForwardRetry is the delay before a remote forward is requested again
+const remoteForwardRetry = 5 * time.Second
+
+// specList is a repeatable flag of forwarding specs
+type specList []spec
+
+// String returns the specs as given
+func (l *specList) String() string {
+	var s []string
+	for _, sp := range *l {
+		s = append(s, sp.raw)
+	}
+	return strings.Join(s, ",")
+}
+
+// Set parses and adds a spec
+func (l *specList) Set(value string) error {
+	sp, err := parseSpec(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, sp)
+	return nil
+}
+
+// spec is a forwarding of a TCP listen address through a peer to a destination
+type spec struct {
+	raw    string
+	listen string // host:port to listen on
+	peerID string
+	dest   string // host:port to connect to
+}
+
+// splitSpec splits a spec at the colons outside of brackets
+func splitSpec(value string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range value {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// unbracket removes the brackets around an IPv6 host
+func unbracket(host string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// parseSpec parses [bind:]port:peerID:host:port, where IPv6 hosts are in
+// brackets and the bind address defaults to 127.0.0.1
+func parseSpec(value string) (spec, error) {
+	parts := splitSpec(value)
+	if len(parts) == 4 {
+		parts = append([]string{"127.0.0.1"}, parts...)
+	}
+	if len(parts) != 5 || parts[2] == "" {
+		return spec{}, fmt.Errorf("invalid forward %q, expected [bind:]port:peerID:host:port", value)
+	}
+	return spec{
+		raw:    value,
+		listen: net.JoinHostPort(unbracket(parts[0]), parts[1]),
+		peerID: parts[2],
+		dest:   net.JoinHostPort(unbracket(parts[3]), parts[4]),
+	}, nil
+}
+
+// parseSOCKSSpec parses [bind:]port:exitPeerID, where the bind address
+// defaults to 127.0.0.1
+func parseSOCKSSpec(value string) (spec, error) {
+	parts := splitSpec(value)
+	if len(parts) == 2 {
+		parts = append([]string{"127.0.0.1"}, parts...)
+	}
+	if len(parts) != 3 || parts[2] == "" {
+		return spec{}, fmt.Errorf("invalid SOCKS proxy %q, expected [bind:]port:exitPeerID", value)
+	}
+	return spec{
+		raw:    value,
+		listen: net.JoinHostPort(unbracket(parts[0]), parts[1]),
+		peerID: parts[2],
+	}, nil
+}
+
+func main() {
+	var locals, remotes, proxies specList
+	flag.Var(&locals, "L", "Local forward [bind:]localport:peerID:host:port, repeatable")
+	flag.Var(&remotes, "R", "Remote forward [bind:]remoteport:peerID:host:port, repeatable")
+	flag.Func("D", "SOCKS5 proxy [bind:]port:exitPeerID that tunnels CONNECT requests through the exit peer, repeatable", func(value string) error {
+		sp, err := parseSOCKSSpec(value)
+		if err != nil {
+			return err
+		}
+		proxies = append(proxies, sp)
+		return nil
+	})
+	allow := flag.String("allow", "", "Comma-separated host:port destinations remote peers may connect to (* matches any host or port)")
+	allowCIDR := flag.String("allow-cidr", "", "Comma-separated CIDRs remote peers may connect to, checked on the resolved address")
+	denyCIDR := flag.String("deny-cidr", "", "Comma-separated CIDRs remote peers may never connect to, even when allowed otherwise")
+	allowListen := flag.String("allow-listen", "", "Comma-separated host:port addresses remote peers may have this peer listen on for remote forwards")
+	peerFlags := peerflags.RegisterFlags("This peer's ID (required)")
+	logFlags := logging.RegisterFlags()
+	flag.Parse()
+
+	logger, err := logFlags.Setup()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *peerFlags.PeerID == "" {
+		fmt.Fprintln(os.Stderr, "-id is required")
+		os.Exit(2)
+	}
+	allowed, err := forward.ParseAllowlist(*allow)
+	if err != nil {
+		logging.Fatal("Invalid -allow", "err", err)
+	}
+	allowedCIDRs, err := forward.ParseCIDRs(*allowCIDR)
+	if err != nil {
+		logging.Fatal("Invalid -allow-cidr", "err", err)
+	}
+	deniedCIDRs, err := forward.ParseCIDRs(*denyCIDR)
+	if err != nil {
+		logging.Fatal("Invalid -deny-cidr", "err", err)
+	}
+	allowedListen, err := forward.ParseAllowlist(*allowListen)
+	if err != nil {
+		logging.Fatal("Invalid -allow-listen", "err", err)
+	}
+
+	config, err := peerFlags.Config(logger)
+	if err != nil {
+		logging.Fatal("Invalid peer configuration", "err", err)
+	}
+	peer, err := peerflags.Start(config)
+	if err != nil {
+		logging.Fatal("Failed to start peer", "err", err)
+	}
+	defer peer.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Serve the tunnels of remote peers, including the tunnels back for
+	// our remote forwards, whose targets are allowed for their peer only.
+	// Other destinations must match -allow or -allow-cidr, and the address
+	// they resolve to must not match -deny-cidr.
+	remoteTarget := func(peerID, addr string) bool {
+		for _, r := range remotes {
+			if r.peerID == peerID && r.dest == addr {
+				return true
+			}
+		}
+		return false
+	}
+	listener, err := peer.StreamListener()
+	if err != nil {
+		logging.Fatal("Failed to listen for streams", "err", err)
+	}
+	server := &forward.Server{
+		Peer: peer,
+		AllowConnect: func(peerID, addr string) bool {
+			return remoteTarget(peerID, addr) || allowed.Allows(addr) || len(allowedCIDRs) > 0
+		},
+		Dial: func(ctx context.Context, peerID, addr string) (net.Conn, error) {
+			var d net.Dialer
+			switch {
+			case remoteTarget(peerID, addr):
+			case allowed.Allows(addr):
+				d.ControlContext = forward.CIDRPolicy{Deny: deniedCIDRs}.Control
+			default:
+				d.ControlContext = forward.CIDRPolicy{Allow: allowedCIDRs, Deny: deniedCIDRs}.Control
+			}
+			return d.DialContext(ctx, "tcp", addr)
+		},
+		AllowListen: func(peerID, addr string) bool {
+			return allowedListen.Allows(addr)
+		},
+		Logger: logger,
+	}
+	go server.Serve(listener)
+
+	for _, l := range locals {
+		ln, err := net.Listen("tcp", l.listen)
+		if err != nil {
+			logging.Fatal("Failed to listen", "addr", l.listen, "err", err)
+		}
+		slog.Info("Forwarding", "listen", ln.Addr().String(), "peer_id", l.peerID, "dest", l.dest)
+		go forward.Forward(peer, ln, l.peerID, l.dest, logger)
+	}
+
+	for _, r := range remotes {
+		go runRemoteForward(ctx, peer, r)
+	}
+
+	for _, d := range proxies {
+		ln, err := net.Listen("tcp", d.listen)
+		if err != nil {
+			logging.Fatal("Failed to listen", "addr", d.listen, "err", err)
+		}
+		slog.Info("SOCKS5 proxy", "listen", ln.Addr().String(), "peer_id", d.peerID)
+		go forward.ServeSOCKS(peer, ln, d.peerID, logger)
+	}
+
+	<-ctx.Done()
+	slog.Info("Shutting down")
+}
+
+// runRemoteForward keeps a remote forward requested until ctx is done
+func runRemoteForward(ctx context.Context, peer *p2pquic.Peer, r spec) {
+	for ctx.Err() == nil {
+		slog.Info("Requesting remote forward", "peer_id", r.peerID, "listen", r.listen, "dest", r.dest)
+		err := forward.RemoteForward(ctx, peer, r.peerID, r.listen, r.dest)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("Remote forward ended, retrying", "peer_id", r.peerID, "listen", r.listen, "delay", remoteForwardRetry, "err", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(remoteForwardRetry):
+		}
+	}
+}
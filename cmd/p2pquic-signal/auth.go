@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mevdschee/p2pquic-go/internal/logging"
+	"github.com/mevdschee/p2pquic-go/pkg/signaling"
+)
+
+// allowAll are the claims used when authentication is disabled
+var allowAll = &signaling.Claims{
+	Peers:      []string{"*"},
+	Lookup:     []string{"*"},
+	Namespaces: []string{"*"},
+}
+
+// credentialsOf extracts the bearer token and verified client certificate of a request
+func credentialsOf(r *http.Request) signaling.Credentials {
+	var creds signaling.Credentials
+
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		creds.BearerToken = strings.TrimSpace(token)
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		creds.PeerCertificates = r.TLS.VerifiedChains[0]
+	}
+
+	return creds
+}
+
+// authenticate returns the claims of a request, or writes a 401 or 429 response
+func (h *HTTPServer) authenticate(w http.ResponseWriter, r *http.Request) (*signaling.Claims, bool) {
+	if h.auth == nil {
+		return allowAll, true
+	}
+
+	creds := credentialsOf(r)
+	claims, err := h.auth.Authenticate(creds)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="p2pquic-signal"`)
+		h.reject(w, rejectUnauthorized, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if !h.allowCredential(w, claims, creds) {
+		return nil, false
+	}
+
+	return claims, true
+}
+
+// forbidden writes a 403 response
+func (h *HTTPServer) forbidden(w http.ResponseWriter, format string, args ...any) {
+	h.reject(w, rejectForbidden, fmt.Sprintf(format, args...), http.StatusForbidden)
+}
+
+// loadTokens reads a JSON file that maps static bearer tokens to their claims
+func loadTokens(filename string) (signaling.StaticTokens, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens signaling.StaticTokens
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid token file %s: %w", filename, err)
+	}
+
+	return tokens, nil
+}
+
+// loadClientCAs reads a PEM file with the CAs that sign client certificates
+func loadClientCAs(filename string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+
+	return pool, nil
+}
+
+// newTLSConfig creates the server TLS configuration, requesting client
+// certificates when client CAs are given
+func newTLSConfig(clientCAs *x509.CertPool) *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAs != nil {
+		cfg.ClientCAs = clientCAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg
+}
+
+// hasToken reports whether a request carries the shared bearer token
+func hasToken(r *http.Request, token string) bool {
+	return token != "" && hmac.Equal([]byte(credentialsOf(r).BearerToken), []byte(token))
+}
+
+// requireToken protects the cluster endpoints with a shared bearer token.
+// Without a token they are open, which main only allows when the API is
+// not authenticated either.
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasToken(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="p2pquic-cluster"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// printToken prints a JWT for the given JSON claims
+func printToken(claimsJSON, secret string) {
+	if secret == "" {
+		logging.Fatal("-issue-token requires -jwt-secret")
+	}
+
+	var claims signaling.Claims
+	if err := json.Unmarshal([]byte(claimsJSON), &claims); err != nil {
+		logging.Fatal("Invalid claims", "err", err)
+	}
+
+	token, err := signaling.SignJWT(&claims, []byte(secret))
+	if err != nil {
+		logging.Fatal("Failed to sign token", "err", err)
+	}
+	fmt.Println(token)
+}
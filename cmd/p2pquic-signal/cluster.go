@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
+	"github.com/mevdschee/p2pquic-go/pkg/signaling"
+)
+
+const (
+	// clusterSyncInterval is how often registrations are pulled from other instances
+	clusterSyncInterval = 10 * time.Second
+
+	// clusterRequestTimeout bounds every request between instances
+	clusterRequestTimeout = 2 * time.Second
+)
+
+// replica is a registration together with its namespace
+type replica struct {
+	Namespace string `json:"namespace,omitempty"`
+	*p2pquic.PeerInfo
+}
+
+// forwardedConnect is a connection request forwarded to the instance that
+// owns the target's registration
+type forwardedConnect struct {
+	Namespace string            `json:"namespace,omitempty"`
+	To        string            `json:"to"`
+	From      *p2pquic.PeerInfo `json:"from"`
+}
+
+// replicaSet is the payload exchanged between cluster instances
+type replicaSet struct {
+	Origin string    `json:"origin"`
+	Peers  []replica `json:"peers"`
+}
+
+// Cluster replicates registrations between signaling instances.
+// Instances are discovered from a static list of base URLs. Every instance
+// pushes its local registrations to the others as they happen and pulls their
+// local registrations periodically, so registrations that were missed while an
+// instance was down are recovered.
+type Cluster struct {
+	self    string
+	members []string
+	server  *signaling.Server
+	client  *http.Client
+	token   string
+	stop    chan struct{}
+}
+
+// NewCluster creates a cluster for the given instance URL and member URLs.
+// The member list may include self, which is ignored. A non-empty token is
+// sent as bearer token on every request to the other instances.
+func NewCluster(server *signaling.Server, self string, members []string, token string) (*Cluster, error) {
+	self = strings.TrimRight(self, "/")
+	if _, err := url.ParseRequestURI(self); err != nil {
+		return nil, fmt.Errorf("invalid cluster self URL %q: %w", self, err)
+	}
+
+	c := &Cluster{
+		self:   self,
+		server: server,
+		client: &http.Client{Timeout: clusterRequestTimeout},
+		token:  token,
+		stop:   make(chan struct{}),
+	}
+	for _, m := range members {
+		m = strings.TrimRight(strings.TrimSpace(m), "/")
+		if m == "" || m == self {
+			continue
+		}
+		if _, err := url.ParseRequestURI(m); err != nil {
+			return nil, fmt.Errorf("invalid cluster member URL %q: %w", m, err)
+		}
+		c.members = append(c.members, m)
+	}
+
+	go c.syncLoop()
+
+	return c, nil
+}
+
+// Close stops the sync goroutine
+func (c *Cluster) Close() {
+	close(c.stop)
+}
+
+// Replicate pushes a local registration to all other instances
+func (c *Cluster) Replicate(namespace string, peer *p2pquic.PeerInfo) {
+	data, err := json.Marshal(replicaSet{Origin: c.self, Peers: []replica{{Namespace: namespace, PeerInfo: peer}}})
+	if err != nil {
+		return
+	}
+
+	for _, m := range c.members {
+		go func(member string) {
+			req, err := c.newRequest(http.MethodPost, member+"/cluster/replicate", bytes.NewReader(data))
+			if err != nil {
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := c.client.Do(req)
+			if err != nil {
+				slog.Warn("Failed to replicate peer", "peer_id", peer.ID, "member", member, "err", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				slog.Warn("Failed to replicate peer", "peer_id", peer.ID, "member", member, "status", resp.Status)
+			}
+		}(m)
+	}
+}
+
+// Lookup asks the other instances for a peer that is not known locally.
+// The first registration found is stored as a replica and returned.
+func (c *Cluster) Lookup(namespace, peerID string) (*p2pquic.PeerInfo, bool) {
+	for _, m := range c.members {
+		req, err := c.newRequest(http.MethodGet, fmt.Sprintf("%s/cluster/peer?id=%s", m, url.QueryEscape(peerID)), nil)
+		if err != nil {
+			continue
+		}
+		req.Header.Set(p2pquic.NamespaceHeader, namespace)
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			continue
+		}
+
+		var peer p2pquic.PeerInfo
+		err = json.NewDecoder(resp.Body).Decode(&peer)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || err != nil {
+			continue
+		}
+
+		c.server.Namespace(namespace).RegisterReplica(m, &peer)
+		return &peer, true
+	}
+
+	return nil, false
+}
+
+// member returns the configured member URL that an origin names, so that
+// URLs sent by other instances are never requested themselves
+func (c *Cluster) member(origin string) (string, bool) {
+	origin = strings.TrimRight(origin, "/")
+	for _, m := range c.members {
+		if m == origin {
+			return m, true
+		}
+	}
+	return "", false
+}
+
+// ForwardConnect delivers a connection request to the instance that owns the
+// target's registration, where the target waits for its connection requests
+func (c *Cluster) ForwardConnect(origin, namespace, to string, from *p2pquic.PeerInfo) error {
+	member, ok := c.member(origin)
+	if !ok {
+		return fmt.Errorf("unknown cluster member %q", origin)
+	}
+
+	data, err := json.Marshal(forwardedConnect{Namespace: namespace, To: to, From: from})
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newRequest(http.MethodPost, member+"/cluster/connect", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// newRequest creates a request to another instance
+func (c *Cluster) newRequest(method, target string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// syncLoop periodically pulls the local registrations of all other instances
+func (c *Cluster) syncLoop() {
+	ticker := time.NewTicker(clusterSyncInterval)
+	defer ticker.Stop()
+
+	c.syncAll()
+	for {
+		select {
+		case <-ticker.C:
+			c.syncAll()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// syncAll pulls registrations from every member
+func (c *Cluster) syncAll() {
+	for _, m := range c.members {
+		if err := c.sync(m); err != nil {
+			slog.Warn("Failed to sync", "member", m, "err", err)
+		}
+	}
+}
+
+// sync pulls the local registrations of a single member
+func (c *Cluster) sync(member string) error {
+	req, err := c.newRequest(http.MethodGet, member+"/cluster/peers", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var set replicaSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	for _, rep := range set.Peers {
+		if rep.PeerInfo == nil || !signaling.ValidNamespace(rep.Namespace) {
+			continue
+		}
+		c.server.Namespace(rep.Namespace).RegisterReplica(member, rep.PeerInfo)
+	}
+
+	return nil
+}
+
+// handleReplicate handles registrations pushed by other instances
+func (c *Cluster) handleReplicate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var set replicaSet
+	if err := json.NewDecoder(r.Body).Decode(&set); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The origin is stored and later requested by ForwardConnect, so only
+	// the configured members are accepted
+	member, ok := c.member(set.Origin)
+	if !ok {
+		slog.Warn("Dropped replicas from unknown origin", "origin", set.Origin, "peers", len(set.Peers))
+		http.Error(w, "Unknown origin", http.StatusForbidden)
+		return
+	}
+
+	for _, rep := range set.Peers {
+		if rep.PeerInfo == nil || !signaling.ValidNamespace(rep.Namespace) {
+			http.Error(w, "Invalid replica", http.StatusBadRequest)
+			return
+		}
+		if err := c.server.Namespace(rep.Namespace).RegisterReplica(member, rep.PeerInfo); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "replicated"})
+}
+
+// handleConnect handles connection requests forwarded by other instances
+func (c *Cluster) handleConnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fwd forwardedConnect
+	if err := json.NewDecoder(r.Body).Decode(&fwd); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if fwd.From == nil || fwd.To == "" || !signaling.ValidNamespace(fwd.Namespace) {
+		http.Error(w, "Invalid connection request", http.StatusBadRequest)
+		return
+	}
+
+	// Only the owner of the registration is polled by the target, a
+	// replica here means the sender has a stale origin
+	ns := c.server.Namespace(fwd.Namespace)
+	if _, exists := ns.GetLocalPeer(fwd.To); !exists {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+	ns.DeliverConnect(fwd.To, fwd.From)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "requested"})
+}
+
+// handleLocalPeers returns the registrations owned by this instance in all namespaces
+func (c *Cluster) handleLocalPeers(w http.ResponseWriter, r *http.Request) {
+	set := replicaSet{Origin: c.self, Peers: []replica{}}
+	for _, name := range c.server.Namespaces() {
+		for _, peer := range c.server.Namespace(name).GetLocalPeers() {
+			set.Peers = append(set.Peers, replica{Namespace: name, PeerInfo: peer})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(set)
+}
+
+// handleLocalPeer looks up a peer registered on this instance, without
+// asking other instances and without answering for replicas, so the asking
+// instance can store this instance as the origin
+func (c *Cluster) handleLocalPeer(w http.ResponseWriter, r *http.Request) {
+	name := r.Header.Get(p2pquic.NamespaceHeader)
+	if !signaling.ValidNamespace(name) {
+		http.Error(w, "Invalid namespace", http.StatusBadRequest)
+		return
+	}
+
+	peer, exists := c.server.Namespace(name).GetLocalPeer(r.URL.Query().Get("id"))
+	if !exists {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peer)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
+	"github.com/mevdschee/p2pquic-go/pkg/signaling"
+)
+
+// testInstance is a signaling instance that serves the cluster endpoints
+type testInstance struct {
+	url     string
+	server  *signaling.Server
+	cluster *Cluster
+}
+
+// newTestCluster starts instances that know each other. The members of every
+// instance are listed in the order of members[i], as indexes into the instances.
+func newTestCluster(t *testing.T, members [][]int) []*testInstance {
+	t.Helper()
+
+	instances := make([]*testInstance, len(members))
+	muxes := make([]*http.ServeMux, len(members))
+	for i := range instances {
+		muxes[i] = http.NewServeMux()
+		ts := httptest.NewServer(muxes[i])
+		t.Cleanup(ts.Close)
+		server := signaling.NewServer()
+		t.Cleanup(server.Close)
+		instances[i] = &testInstance{url: ts.URL, server: server}
+	}
+
+	for i, inst := range instances {
+		var urls []string
+		for _, m := range members[i] {
+			urls = append(urls, instances[m].url)
+		}
+		cluster, err := NewCluster(inst.server, inst.url, urls, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(cluster.Close)
+		inst.cluster = cluster
+
+		muxes[i].HandleFunc("/cluster/replicate", requireToken("secret", cluster.handleReplicate))
+		muxes[i].HandleFunc("/cluster/peers", requireToken("secret", cluster.handleLocalPeers))
+		muxes[i].HandleFunc("/cluster/peer", requireToken("secret", cluster.handleLocalPeer))
+		muxes[i].HandleFunc("/cluster/connect", requireToken("secret", cluster.handleConnect))
+	}
+	return instances
+}
+
+// testPeer returns a registration with a single valid candidate
+func testPeer(id string) *p2pquic.PeerInfo {
+	return &p2pquic.PeerInfo{
+		ID:         id,
+		Candidates: []p2pquic.Candidate{{IP: "192.0.2.1", Port: 4242, Type: p2pquic.HostCandidate}},
+		Timestamp:  time.Now(),
+	}
+}
+
+func TestClusterLookupOrigin(t *testing.T) {
+	// Instance 1 asks instance 2 first, which only holds a replica
+	instances := newTestCluster(t, [][]int{{1, 2}, {2, 0}, {0, 1}})
+	owner, asker, holder := instances[0], instances[1], instances[2]
+
+	if err := owner.server.RegisterPeer(testPeer("bob")); err != nil {
+		t.Fatal(err)
+	}
+	if err := holder.server.Namespace("").RegisterReplica(owner.url, testPeer("bob")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := asker.cluster.Lookup("", "bob"); !found {
+		t.Fatal("Lookup() found = false")
+	}
+	if origin, _ := asker.server.Origin("bob"); origin != owner.url {
+		t.Fatalf("Origin() = %q, want the owner %q", origin, owner.url)
+	}
+
+	// The connection request reaches the inbox the owner's peer polls
+	origin, _ := asker.server.Origin("bob")
+	if err := asker.cluster.ForwardConnect(origin, "", "bob", testPeer("alice")); err != nil {
+		t.Fatalf("ForwardConnect() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	requests := owner.server.WaitConnectRequests(ctx, "bob")
+	if len(requests) != 1 || requests[0].ID != "alice" {
+		t.Fatalf("WaitConnectRequests() = %v, want the request of alice", requests)
+	}
+}
+
+func TestClusterReplicasNotServed(t *testing.T) {
+	instances := newTestCluster(t, [][]int{{1}, {0}})
+	owner, holder := instances[0], instances[1]
+
+	if err := holder.server.Namespace("").RegisterReplica(owner.url, testPeer("bob")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A replica is neither looked up nor given connection requests
+	if _, found := owner.cluster.Lookup("", "bob"); found {
+		t.Error("Lookup() of a replica found = true")
+	}
+	if err := owner.cluster.ForwardConnect(holder.url, "", "bob", testPeer("alice")); err == nil {
+		t.Error("ForwardConnect() to an instance with a replica error = nil")
+	}
+	if err := owner.cluster.ForwardConnect("http://192.0.2.1", "", "bob", testPeer("alice")); err == nil {
+		t.Error("ForwardConnect() to an unknown member error = nil")
+	}
+}
+
+func TestClusterReplicate(t *testing.T) {
+	instances := newTestCluster(t, [][]int{{1}, {0}})
+	owner, other := instances[0], instances[1]
+
+	peer := testPeer("bob")
+	if err := owner.server.RegisterPeer(peer); err != nil {
+		t.Fatal(err)
+	}
+	owner.cluster.Replicate("", peer)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if origin, found := other.server.Origin("bob"); found {
+			if origin != owner.url {
+				t.Fatalf("Origin() = %q, want %q", origin, owner.url)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("replica did not arrive")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, found := other.server.GetLocalPeer("bob"); found {
+		t.Error("GetLocalPeer() of a replica found = true")
+	}
+	if peers := other.server.GetLocalPeers(); len(peers) != 0 {
+		t.Errorf("GetLocalPeers() = %v, want none", peers)
+	}
+}
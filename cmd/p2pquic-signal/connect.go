@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
+	"github.com/mevdschee/p2pquic-go/pkg/signaling"
+)
+
+const (
+	// defaultConnectWait is how long a request for connection requests waits by default
+	defaultConnectWait = 30 * time.Second
+
+	// maxConnectWait bounds the wait parameter of requests for connection requests
+	maxConnectWait = 60 * time.Second
+)
+
+// connectBody is the payload of a connection request
+type connectBody struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// Key is the connect key of the connection attempt, delivered to the target only
+	Key []byte `json:"key,omitempty"`
+}
+
+// handleConnect handles requests of a peer to connect to another peer.
+// The target is notified through its pending request for connection requests
+// and starts punching toward the requesting peer.
+func (h *HTTPServer) handleConnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	ns, err := h.namespaceOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var body connectBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		h.rejectDecode(w, err)
+		return
+	}
+
+	// The caller must own the requesting peer and be allowed to find the target
+	if !claims.CanRegister(ns.Name(), body.From) || !claims.CanLookup(ns.Name(), body.To) {
+		h.forbidden(w, "Not allowed to connect %s to %s in namespace %q", body.From, body.To, ns.Name())
+		return
+	}
+
+	from, err := ns.ConnectRequest(body.From, body.Key)
+	if errors.Is(err, signaling.ErrUnknownPeer) {
+		http.Error(w, "Requesting peer not registered", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.rejectRegistration(w, err)
+		return
+	}
+
+	origin, exists := ns.Origin(body.To)
+	if !exists && h.cluster != nil {
+		if _, found := h.cluster.Lookup(ns.Name(), body.To); found {
+			origin, exists = ns.Origin(body.To)
+		}
+	}
+	if !exists {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+
+	// Deliver locally when the target registered here, otherwise forward the
+	// request to the instance that owns the registration
+	if origin == "" {
+		ns.DeliverConnect(body.To, from)
+	} else if err := h.cluster.ForwardConnect(origin, ns.Name(), body.To, from); err != nil {
+		slog.Warn("Failed to forward connection request", "peer_id", body.To, "member", origin, "err", err)
+		http.Error(w, "Failed to forward connection request", http.StatusBadGateway)
+		return
+	}
+
+	slog.Info("Connection requested", "peer_id", body.From, "to", body.To, "namespace", ns.Name())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "requested"})
+}
+
+// handleConnectRequests long-polls the connection requests of a peer. It
+// returns as soon as requests are pending, or an empty list after the wait
+// time (the "wait" query parameter in seconds).
+func (h *HTTPServer) handleConnectRequests(w http.ResponseWriter, r *http.Request) {
+	claims, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	ns, err := h.namespaceOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	peerID := r.URL.Query().Get("id")
+	if peerID == "" {
+		http.Error(w, "Missing peer ID", http.StatusBadRequest)
+		return
+	}
+
+	if !claims.CanRegister(ns.Name(), peerID) {
+		h.forbidden(w, "Not allowed to receive connection requests for peer %s in namespace %q", peerID, ns.Name())
+		return
+	}
+
+	wait := defaultConnectWait
+	if v := r.URL.Query().Get("wait"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			http.Error(w, "Invalid wait time", http.StatusBadRequest)
+			return
+		}
+		wait = min(time.Duration(seconds)*time.Second, maxConnectWait)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	go func() {
+		select {
+		case <-h.draining:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	peerList := ns.WaitConnectRequests(ctx, peerID)
+	if peerList == nil {
+		peerList = make([]*p2pquic.PeerInfo, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peerList)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mevdschee/p2pquic-go/pkg/signaling"
+)
+
+// Rejection reasons, used as metric labels
+const (
+	rejectIPRate         = "ip_rate"
+	rejectTokenRate      = "token_rate"
+	rejectBodySize       = "body_size"
+	rejectUnauthorized   = "unauthorized"
+	rejectForbidden      = "forbidden"
+	rejectInvalidPeerID  = "invalid_peer_id"
+	rejectInvalidCand    = "invalid_candidate"
+	rejectInvalidKey     = "invalid_punch_key"
+	rejectInvalidFpr     = "invalid_fingerprint"
+	rejectTooManyCands   = "too_many_candidates"
+	rejectTooManyPeers   = "too_many_peers"
+	rejectNamespaceFull  = "namespace_full"
+	rejectInvalidRequest = "invalid_request"
+)
+
+// rejectCounter counts rejected requests by reason
+type rejectCounter struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+// inc counts one rejection
+func (c *rejectCounter) inc(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[string]uint64)
+	}
+	c.counts[reason]++
+}
+
+// reasons returns the rejection reasons seen so far in sorted order with their counts
+func (c *rejectCounter) reasons() ([]string, map[string]uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := make(map[string]uint64, len(c.counts))
+	reasons := make([]string, 0, len(c.counts))
+	for reason, n := range c.counts {
+		counts[reason] = n
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	return reasons, counts
+}
+
+// limits holds the abuse protection settings of the HTTP server
+type limits struct {
+	ipLimiter    *signaling.RateLimiter // nil disables per-IP limits
+	tokenLimiter *signaling.RateLimiter // nil disables per-credential limits
+	maxBody      int64                  // zero disables the body size limit
+	trustProxy   bool                   // take the source IP from X-Forwarded-For
+}
+
+// sourceIP returns the IP address a request originates from
+func (h *HTTPServer) sourceIP(r *http.Request) string {
+	if h.limits.trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// withLimits applies the per-IP rate limit and the body size limit. Probes
+// are exempt from both, and requests between cluster instances that carry
+// the cluster token from the rate limit.
+func (h *HTTPServer) withLimits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metrics", "/healthz", "/readyz":
+			next.ServeHTTP(w, r)
+			return
+		}
+		trusted := strings.HasPrefix(r.URL.Path, "/cluster/") && h.cluster != nil && hasToken(r, h.cluster.token)
+		if !trusted && h.limits.ipLimiter != nil && !h.limits.ipLimiter.Allow(h.sourceIP(r)) {
+			h.reject(w, rejectIPRate, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		if h.limits.maxBody > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, h.limits.maxBody)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowCredential applies the per-credential rate limit
+func (h *HTTPServer) allowCredential(w http.ResponseWriter, claims *signaling.Claims, creds signaling.Credentials) bool {
+	if h.limits.tokenLimiter == nil {
+		return true
+	}
+
+	key := claims.Subject
+	if key == "" {
+		key = creds.BearerToken
+	}
+	if !h.limits.tokenLimiter.Allow(key) {
+		h.reject(w, rejectTokenRate, "Rate limit exceeded", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// reject counts a rejected request and writes the error response
+func (h *HTTPServer) reject(w http.ResponseWriter, reason, message string, code int) {
+	h.rejected.inc(reason)
+	if code == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "1")
+	}
+	http.Error(w, message, code)
+}
+
+// rejectDecode rejects a request body that could not be decoded
+func (h *HTTPServer) rejectDecode(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		h.reject(w, rejectBodySize, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	h.reject(w, rejectInvalidRequest, err.Error(), http.StatusBadRequest)
+}
+
+// rejectRegistration rejects a registration refused by the signaling server
+func (h *HTTPServer) rejectRegistration(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, signaling.ErrInvalidPeerID):
+		h.reject(w, rejectInvalidPeerID, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, signaling.ErrInvalidCandidate):
+		h.reject(w, rejectInvalidCand, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, signaling.ErrInvalidPunchKey):
+		h.reject(w, rejectInvalidKey, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, signaling.ErrInvalidFingerprint):
+		h.reject(w, rejectInvalidFpr, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, signaling.ErrTooManyCandidates):
+		h.reject(w, rejectTooManyCands, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, signaling.ErrTooManyPeers):
+		h.reject(w, rejectTooManyPeers, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, signaling.ErrNamespaceFull):
+		h.reject(w, rejectNamespaceFull, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
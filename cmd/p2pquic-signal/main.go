@@ -1,24 +1,43 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/mevdschee/p2pquic-go/internal/logging"
 	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
 	"github.com/mevdschee/p2pquic-go/pkg/signaling"
 )
 
 // HTTPServer wraps the signaling server with HTTP handlers
 type HTTPServer struct {
-	server *signaling.Server
+	server   *signaling.Server
+	cluster  *Cluster
+	auth     signaling.Authenticator // nil disables authentication
+	limits   limits
+	rejected rejectCounter
+	metrics  metrics
+
+	shuttingDown atomic.Bool
+	draining     chan struct{} // closed on shutdown to end long polls
 }
 
 // NewHTTPServer creates a new HTTP signaling server
-func NewHTTPServer() *HTTPServer {
+func NewHTTPServer(opts ...signaling.Option) *HTTPServer {
 	return &HTTPServer{
-		server: signaling.NewServer(),
+		server:   signaling.NewServer(opts...),
+		draining: make(chan struct{}),
 	}
 }
 
@@ -29,18 +48,41 @@ func (h *HTTPServer) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	claims, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	ns, err := h.namespaceOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var peer p2pquic.PeerInfo
 	if err := json.NewDecoder(r.Body).Decode(&peer); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		h.rejectDecode(w, err)
 		return
 	}
 
-	if err := h.server.Register(peer.ID, peer.Candidates); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if !claims.CanRegister(ns.Name(), peer.ID) {
+		h.forbidden(w, "Not allowed to register peer %s in namespace %q", peer.ID, ns.Name())
 		return
 	}
 
-	log.Printf("Registered peer %s with %d candidates", peer.ID, len(peer.Candidates))
+	if err := ns.RegisterPeer(&peer); err != nil {
+		h.rejectRegistration(w, err)
+		return
+	}
+
+	h.metrics.registrations.Add(1)
+	slog.Info("Registered peer", "peer_id", peer.ID, "namespace", ns.Name(), "candidates", len(peer.Candidates))
+
+	if h.cluster != nil {
+		if registered, exists := ns.GetPeer(peer.ID); exists {
+			h.cluster.Replicate(ns.Name(), registered)
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "registered"})
@@ -48,14 +90,35 @@ func (h *HTTPServer) handleRegister(w http.ResponseWriter, r *http.Request) {
 
 // handleGetPeer handles peer lookup requests
 func (h *HTTPServer) handleGetPeer(w http.ResponseWriter, r *http.Request) {
+	claims, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	ns, err := h.namespaceOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	peerID := r.URL.Query().Get("id")
 	if peerID == "" {
 		http.Error(w, "Missing peer ID", http.StatusBadRequest)
 		return
 	}
 
-	peer, exists := h.server.GetPeer(peerID)
+	if !claims.CanLookup(ns.Name(), peerID) {
+		h.forbidden(w, "Not allowed to look up peer %s in namespace %q", peerID, ns.Name())
+		return
+	}
+
+	h.metrics.lookups.Add(1)
+	peer, exists := ns.GetPeer(peerID)
+	if !exists && h.cluster != nil {
+		peer, exists = h.cluster.Lookup(ns.Name(), peerID)
+	}
 	if !exists {
+		h.metrics.lookupMisses.Add(1)
 		http.Error(w, "Peer not found", http.StatusNotFound)
 		return
 	}
@@ -64,9 +127,30 @@ func (h *HTTPServer) handleGetPeer(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(peer)
 }
 
-// handleListPeers handles requests to list all peers
+// handleListPeers handles requests to list all peers the caller may look up
 func (h *HTTPServer) handleListPeers(w http.ResponseWriter, r *http.Request) {
-	peerList := h.server.GetAllPeers()
+	claims, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	ns, err := h.namespaceOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !claims.CanUseNamespace(ns.Name()) {
+		h.forbidden(w, "Not allowed to list namespace %q", ns.Name())
+		return
+	}
+
+	peerList := make([]*p2pquic.PeerInfo, 0)
+	for _, peer := range ns.GetAllPeers() {
+		if claims.CanLookup(ns.Name(), peer.ID) {
+			peerList = append(peerList, peer)
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(peerList)
@@ -74,15 +158,184 @@ func (h *HTTPServer) handleListPeers(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	port := flag.String("port", "8080", "Port to listen on")
+	clusterSelf := flag.String("cluster-self", "", "URL under which other cluster instances reach this one (enables clustering)")
+	clusterPeers := flag.String("cluster-peers", "", "Comma-separated URLs of the other cluster instances")
+	peerTTL := flag.Duration("ttl", 30*time.Second, "Registration TTL for namespaces without their own limits")
+	maxPeers := flag.Int("max-peers", 0, "Peer limit for namespaces without their own limits (0 = unlimited)")
+	var namespaces namespaceFlag
+	flag.Var(&namespaces, "namespace", "Per-namespace limits as NAME:TTL:MAXPEERS (repeatable)")
+	tokenFile := flag.String("auth-tokens", "", "JSON file mapping static bearer tokens to their claims")
+	jwtSecret := flag.String("jwt-secret", "", "Secret for verifying HMAC-signed JWT bearer tokens")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file (enables HTTPS)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	clientCA := flag.String("client-ca", "", "CA file for verifying client certificates (enables mTLS authentication)")
+	clusterToken := flag.String("cluster-token", "", "Shared bearer token required on requests between cluster instances")
+	ipRate := flag.Float64("rate", 10, "Requests per second allowed per source IP (0 = unlimited)")
+	ipBurst := flag.Int("burst", 20, "Request burst allowed per source IP")
+	tokenRate := flag.Float64("token-rate", 5, "Requests per second allowed per credential when authentication is enabled (0 = unlimited)")
+	tokenBurst := flag.Int("token-burst", 10, "Request burst allowed per credential")
+	maxBody := flag.Int64("max-body", 64<<10, "Maximum request body size in bytes (0 = unlimited)")
+	maxCandidates := flag.Int("max-candidates", 16, "Maximum candidates per peer (0 = unlimited)")
+	maxTotalPeers := flag.Int("max-total-peers", 100000, "Maximum registered peers across all namespaces (0 = unlimited)")
+	trustProxy := flag.Bool("trust-proxy", false, "Take the source IP from X-Forwarded-For (only behind a trusted load balancer)")
+	drainTimeout := flag.Duration("drain-timeout", 15*time.Second, "Maximum time to drain in-flight requests on shutdown")
+	shutdownDelay := flag.Duration("shutdown-delay", 5*time.Second, "Time between failing /readyz and closing the listeners on shutdown")
+	stunAddr := flag.String("stun-addr", "", "UDP address for the built-in STUN endpoint, e.g. :3478 (empty = disabled)")
+	issueToken := flag.String("issue-token", "", "Print a JWT signed with -jwt-secret for the given JSON claims and exit")
+	logFlags := logging.RegisterFlags()
 	flag.Parse()
 
-	httpServer := NewHTTPServer()
+	logger, err := logFlags.Setup()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *issueToken != "" {
+		printToken(*issueToken, *jwtSecret)
+		return
+	}
+
+	opts := append([]signaling.Option{
+		signaling.WithDefaultNamespaceConfig(signaling.NamespaceConfig{TTL: *peerTTL, MaxPeers: *maxPeers}),
+		signaling.WithMaxCandidates(*maxCandidates),
+		signaling.WithMaxPeers(*maxTotalPeers),
+		signaling.WithLogger(logger),
+	}, namespaces...)
+	httpServer := NewHTTPServer(opts...)
+
+	httpServer.limits.maxBody = *maxBody
+	httpServer.limits.trustProxy = *trustProxy
+	if *ipRate > 0 {
+		httpServer.limits.ipLimiter = signaling.NewRateLimiter(*ipRate, *ipBurst)
+	}
+	if *tokenRate > 0 {
+		httpServer.limits.tokenLimiter = signaling.NewRateLimiter(*tokenRate, *tokenBurst)
+	}
+
+	var auths signaling.Authenticators
+	if *tokenFile != "" {
+		tokens, err := loadTokens(*tokenFile)
+		if err != nil {
+			logging.Fatal("Failed to load tokens", "err", err)
+		}
+		auths = append(auths, tokens)
+	}
+	if *jwtSecret != "" {
+		auths = append(auths, &signaling.JWTAuthenticator{Secret: []byte(*jwtSecret)})
+	}
+	var clientCAs *x509.CertPool
+	if *clientCA != "" {
+		if *tlsCert == "" {
+			logging.Fatal("-client-ca requires -tls-cert and -tls-key")
+		}
+		var err error
+		if clientCAs, err = loadClientCAs(*clientCA); err != nil {
+			logging.Fatal("Failed to load client CAs", "err", err)
+		}
+		auths = append(auths, &signaling.CertificateAuthenticator{})
+	}
+	if len(auths) > 0 {
+		httpServer.auth = auths
+		slog.Info("Authentication enabled", "authenticators", len(auths))
+	}
+
+	http.HandleFunc("/register", httpServer.instrument("register", httpServer.handleRegister))
+	http.HandleFunc("/peer", httpServer.instrument("peer", httpServer.handleGetPeer))
+	http.HandleFunc("/peers", httpServer.instrument("peers", httpServer.handleListPeers))
+	http.HandleFunc("/connect", httpServer.instrument("connect", httpServer.handleConnect))
+	http.HandleFunc("/connect-requests", httpServer.handleConnectRequests)
+	http.HandleFunc("/metrics", httpServer.handleMetrics)
+	http.HandleFunc("/healthz", httpServer.handleHealthz)
+	http.HandleFunc("/readyz", httpServer.handleReadyz)
+
+	if *clusterSelf != "" {
+		// The cluster endpoints expose and overwrite the registrations of
+		// all namespaces, so they must not be less protected than the API
+		if *clusterToken == "" && httpServer.auth != nil {
+			logging.Fatal("-cluster-self requires -cluster-token when authentication is enabled")
+		}
+		if *clusterToken == "" {
+			slog.Warn("Cluster endpoints are not protected, set -cluster-token")
+		}
 
-	http.HandleFunc("/register", httpServer.handleRegister)
-	http.HandleFunc("/peer", httpServer.handleGetPeer)
-	http.HandleFunc("/peers", httpServer.handleListPeers)
+		cluster, err := NewCluster(httpServer.server, *clusterSelf, strings.Split(*clusterPeers, ","), *clusterToken)
+		if err != nil {
+			logging.Fatal("Failed to start cluster", "err", err)
+		}
+		httpServer.cluster = cluster
 
-	addr := ":" + *port
-	log.Printf("Signaling server listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+		http.HandleFunc("/cluster/replicate", requireToken(*clusterToken, cluster.handleReplicate))
+		http.HandleFunc("/cluster/peers", requireToken(*clusterToken, cluster.handleLocalPeers))
+		http.HandleFunc("/cluster/peer", requireToken(*clusterToken, cluster.handleLocalPeer))
+		http.HandleFunc("/cluster/connect", requireToken(*clusterToken, cluster.handleConnect))
+
+		slog.Info("Clustering enabled", "self", *clusterSelf, "members", len(cluster.members))
+	}
+
+	var stunServer *STUNServer
+	if *stunAddr != "" {
+		var err error
+		if stunServer, err = ListenSTUN(*stunAddr, *ipRate, *ipBurst); err != nil {
+			logging.Fatal("Failed to start STUN server", "err", err)
+		}
+		slog.Info("STUN server listening", "addr", *stunAddr)
+	}
+
+	srv := &http.Server{
+		Addr:    ":" + *port,
+		Handler: httpServer.withLimits(withNamespacePrefix(http.DefaultServeMux)),
+	}
+	srv.RegisterOnShutdown(func() { close(httpServer.draining) })
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if *tlsCert != "" {
+			srv.TLSConfig = newTLSConfig(clientCAs)
+			slog.Info("Signaling server listening", "addr", srv.Addr, "tls", true)
+			serveErr <- srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+			return
+		}
+		slog.Info("Signaling server listening", "addr", srv.Addr)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		logging.Fatal("Signaling server failed", "err", err)
+	case <-ctx.Done():
+	}
+
+	// Fail readiness first and keep serving for the shutdown delay, so load
+	// balancers see it and stop routing to this instance, then drain
+	// in-flight requests. A second signal skips the delay.
+	httpServer.shuttingDown.Store(true)
+	if *shutdownDelay > 0 {
+		slog.Info("Shutting down, failing readiness", "delay", *shutdownDelay)
+		stop()
+		again, stopAgain := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-time.After(*shutdownDelay):
+		case <-again.Done():
+		}
+		stopAgain()
+	}
+	slog.Info("Draining in-flight requests", "timeout", *drainTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Failed to drain requests", "err", err)
+	}
+
+	if httpServer.cluster != nil {
+		httpServer.cluster.Close()
+	}
+	if stunServer != nil {
+		stunServer.Close()
+	}
+	httpServer.server.Close()
+	slog.Info("Shutdown complete")
 }
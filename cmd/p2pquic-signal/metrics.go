@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the request latency histogram in seconds
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// histogram is a cumulative latency histogram in the Prometheus style
+type histogram struct {
+	counts []uint64 // one per bucket, plus +Inf
+	sum    float64
+	count  uint64
+}
+
+// metrics collects the counters exported on /metrics
+type metrics struct {
+	registrations atomic.Uint64
+	lookups       atomic.Uint64
+	lookupMisses  atomic.Uint64
+
+	mu        sync.Mutex
+	latencies map[string]*histogram // by handler
+}
+
+// observe records the latency of a request to a handler
+func (m *metrics) observe(handler string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.latencies == nil {
+		m.latencies = make(map[string]*histogram)
+	}
+	h, ok := m.latencies[handler]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.latencies[handler] = h
+	}
+
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// instrument records the latency of every request to a handler
+func (h *HTTPServer) instrument(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next(w, r)
+		h.metrics.observe(name, time.Since(start))
+	}
+}
+
+// handleMetrics exports the metrics in the Prometheus text format
+func (h *HTTPServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeMetric(w, "p2pquic_signal_peers", "gauge", "Number of registered (non-expired) peers across all namespaces.", uint64(h.server.PeerCount()))
+	writeMetric(w, "p2pquic_signal_registrations_total", "counter", "Number of successful peer registrations.", h.metrics.registrations.Load())
+	writeMetric(w, "p2pquic_signal_lookups_total", "counter", "Number of peer lookups.", h.metrics.lookups.Load())
+	writeMetric(w, "p2pquic_signal_lookup_misses_total", "counter", "Number of peer lookups for unknown peers.", h.metrics.lookupMisses.Load())
+	writeMetric(w, "p2pquic_signal_connect_waiters", "gauge", "Number of peers waiting for connection requests (long polls).", uint64(h.server.Waiters()))
+	writeMetric(w, "p2pquic_signal_connect_requests_total", "counter", "Number of connection requests queued for peers.", h.server.ConnectRequests())
+	writeMetric(w, "p2pquic_signal_expirations_total", "counter", "Number of registrations removed after their TTL expired.", h.server.Expirations())
+
+	fmt.Fprintln(w, "# HELP p2pquic_signal_rejections_total Number of rejected requests by reason.")
+	fmt.Fprintln(w, "# TYPE p2pquic_signal_rejections_total counter")
+	reasons, counts := h.rejected.reasons()
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "p2pquic_signal_rejections_total{reason=%q} %d\n", reason, counts[reason])
+	}
+
+	h.metrics.writeLatencies(w)
+}
+
+// writeLatencies writes the request latency histograms
+func (m *metrics) writeLatencies(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP p2pquic_signal_request_duration_seconds Latency of API requests by handler.")
+	fmt.Fprintln(w, "# TYPE p2pquic_signal_request_duration_seconds histogram")
+
+	handlers := make([]string, 0, len(m.latencies))
+	for name := range m.latencies {
+		handlers = append(handlers, name)
+	}
+	sort.Strings(handlers)
+
+	for _, name := range handlers {
+		h := m.latencies[name]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "p2pquic_signal_request_duration_seconds_bucket{handler=%q,le=%q} %d\n", name, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "p2pquic_signal_request_duration_seconds_bucket{handler=%q,le=\"+Inf\"} %d\n", name, h.count)
+		fmt.Fprintf(w, "p2pquic_signal_request_duration_seconds_sum{handler=%q} %s\n", name, formatFloat(h.sum))
+		fmt.Fprintf(w, "p2pquic_signal_request_duration_seconds_count{handler=%q} %d\n", name, h.count)
+	}
+}
+
+// writeMetric writes a single unlabeled metric
+func writeMetric(w io.Writer, name, kind, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+// formatFloat formats a float in the shortest exact representation
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// handleHealthz reports that the process is alive
+func (h *HTTPServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether the server accepts traffic; it fails while
+// shutting down so load balancers stop sending new requests
+func (h *HTTPServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if h.shuttingDown.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
+	"github.com/mevdschee/p2pquic-go/pkg/signaling"
+)
+
+// namespacePrefix is the URL prefix that selects a namespace, as in /ns/{name}/register
+const namespacePrefix = "/ns/"
+
+// withNamespacePrefix moves a namespace from the URL path into the namespace
+// header, so /ns/{name}/peers is handled as /peers in namespace {name}
+func withNamespacePrefix(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, namespacePrefix) {
+			name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, namespacePrefix), "/")
+			r.Header.Set(p2pquic.NamespaceHeader, name)
+			r.URL.Path = "/" + rest
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// namespaceOf returns the namespace a request is scoped to
+func (h *HTTPServer) namespaceOf(r *http.Request) (*signaling.Namespace, error) {
+	name := r.Header.Get(p2pquic.NamespaceHeader)
+	if !signaling.ValidNamespace(name) {
+		return nil, fmt.Errorf("invalid namespace %q", name)
+	}
+	return h.server.Namespace(name), nil
+}
+
+// namespaceFlag collects repeated -namespace NAME:TTL:MAXPEERS flags
+type namespaceFlag []signaling.Option
+
+func (f *namespaceFlag) String() string {
+	return ""
+}
+
+func (f *namespaceFlag) Set(value string) error {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return fmt.Errorf("expected NAME:TTL:MAXPEERS, got %q", value)
+	}
+
+	name := parts[0]
+	if !signaling.ValidNamespace(name) {
+		return fmt.Errorf("invalid namespace %q", name)
+	}
+	ttl, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid TTL for namespace %q: %w", name, err)
+	}
+	maxPeers, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid peer limit for namespace %q: %w", name, err)
+	}
+
+	*f = append(*f, signaling.WithNamespaceConfig(name, signaling.NamespaceConfig{TTL: ttl, MaxPeers: maxPeers}))
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/internal/stun"
+	"github.com/mevdschee/p2pquic-go/pkg/signaling"
+)
+
+const (
+	// maxPendingEchoes bounds the number of scheduled delayed responses
+	maxPendingEchoes = 4096
+
+	// maxPendingEchoesPerIP bounds the scheduled delayed responses to one
+	// source IP, enough for the parallel probes of a mapping measurement
+	// and their retransmissions
+	maxPendingEchoesPerIP = 32
+)
+
+// STUNServer answers STUN binding requests on UDP, so peers can discover
+// their public address without a third-party STUN server. Requests that carry
+// the echo delay attribute get a second response after the delay, which
+// MeasureMappingLifetime uses to test whether an idle NAT mapping still works.
+type STUNServer struct {
+	conn    *net.UDPConn
+	limiter *signaling.RateLimiter
+
+	mu      sync.Mutex
+	pending map[string]int // scheduled delayed responses by source IP
+	total   int
+}
+
+// ListenSTUN starts a STUN server on the given UDP address. Requests are
+// rate limited per source IP, because responses go to unverified addresses.
+func ListenSTUN(addr string, rate float64, burst int) (*STUNServer, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &STUNServer{conn: conn, pending: make(map[string]int)}
+	if rate > 0 {
+		s.limiter = signaling.NewRateLimiter(rate, burst)
+	}
+	go s.serve()
+
+	return s, nil
+}
+
+// Close stops the STUN server
+func (s *STUNServer) Close() error {
+	return s.conn.Close()
+}
+
+// serve answers requests until the socket is closed
+func (s *STUNServer) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		s.handle(buf[:n], addr)
+	}
+}
+
+// handle answers a single binding request
+func (s *STUNServer) handle(req []byte, addr *net.UDPAddr) {
+	if len(req) < stun.HeaderSize || binary.BigEndian.Uint16(req[0:]) != stun.BindingRequest ||
+		binary.BigEndian.Uint32(req[4:]) != stun.MagicCookie || addr.IP.To4() == nil {
+		return
+	}
+	if s.limiter != nil && !s.limiter.Allow(addr.IP.String()) {
+		return
+	}
+
+	txID := append([]byte(nil), req[8:stun.HeaderSize]...)
+	s.conn.WriteToUDP(bindingSuccess(txID, addr, false), addr)
+
+	delay, ok := echoDelay(req)
+	if !ok || delay > stun.MaxEchoDelay || !s.schedule(addr.IP.String()) {
+		return
+	}
+	time.AfterFunc(delay, func() {
+		defer s.done(addr.IP.String())
+		s.conn.WriteToUDP(bindingSuccess(txID, addr, true), addr)
+	})
+}
+
+// schedule reserves a delayed response to a source IP, unless the limits
+// of pending responses in total or to that IP are reached
+func (s *STUNServer) schedule(ip string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.total >= maxPendingEchoes || s.pending[ip] >= maxPendingEchoesPerIP {
+		return false
+	}
+	s.total++
+	s.pending[ip]++
+	return true
+}
+
+// done releases a delayed response that was sent
+func (s *STUNServer) done(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.total--
+	if s.pending[ip]--; s.pending[ip] == 0 {
+		delete(s.pending, ip)
+	}
+}
+
+// echoDelay returns the delay requested with the echo delay attribute
+func echoDelay(req []byte) (time.Duration, bool) {
+	value, ok := stun.Attribute(req, stun.AttrEchoDelay)
+	if !ok || len(value) != 4 {
+		return 0, false
+	}
+	return time.Duration(binary.BigEndian.Uint32(value)) * time.Millisecond, true
+}
+
+// bindingSuccess builds a binding success response with the XOR-mapped
+// address of the client, marked with the echo delay attribute if delayed
+func bindingSuccess(txID []byte, addr *net.UDPAddr, delayed bool) []byte {
+	resp := make([]byte, stun.HeaderSize, stun.HeaderSize+20)
+	binary.BigEndian.PutUint16(resp[0:], stun.BindingSuccess)
+	binary.BigEndian.PutUint32(resp[4:], stun.MagicCookie)
+	copy(resp[8:], txID)
+
+	// XOR-MAPPED-ADDRESS: reserved, family IPv4, port and address XORed with the cookie
+	resp = binary.BigEndian.AppendUint16(resp, stun.AttrXORMappedAddress)
+	resp = binary.BigEndian.AppendUint16(resp, 8)
+	resp = append(resp, 0, 0x01)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(addr.Port)^(stun.MagicCookie>>16))
+	resp = binary.BigEndian.AppendUint32(resp, binary.BigEndian.Uint32(addr.IP.To4())^stun.MagicCookie)
+
+	if delayed {
+		resp = binary.BigEndian.AppendUint16(resp, stun.AttrEchoDelay)
+		resp = binary.BigEndian.AppendUint16(resp, 4)
+		resp = binary.BigEndian.AppendUint32(resp, 0)
+	}
+
+	binary.BigEndian.PutUint16(resp[2:], uint16(len(resp)-stun.HeaderSize))
+	return resp
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/internal/stun"
+	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
+)
+
+// echoRequest builds a binding request with an echo delay attribute of value
+func echoRequest(value []byte) []byte {
+	b := make([]byte, stun.HeaderSize)
+	binary.BigEndian.PutUint16(b[0:], stun.BindingRequest)
+	binary.BigEndian.PutUint32(b[4:], stun.MagicCookie)
+	b = binary.BigEndian.AppendUint16(b, stun.AttrEchoDelay)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	b = append(b, make([]byte, (4-len(value)%4)%4)...)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-stun.HeaderSize))
+	return b
+}
+
+func TestEchoDelay(t *testing.T) {
+	tests := []struct {
+		name  string
+		value []byte
+		want  time.Duration
+		ok    bool
+	}{
+		{"milliseconds", binary.BigEndian.AppendUint32(nil, 1500), 1500 * time.Millisecond, true},
+		{"zero", binary.BigEndian.AppendUint32(nil, 0), 0, true},
+		{"short value", []byte{0, 1}, 0, false},
+		{"long value", binary.BigEndian.AppendUint64(nil, 1), 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := echoDelay(echoRequest(tt.value))
+			if got != tt.want || ok != tt.ok {
+				t.Fatalf("echoDelay() = %s, %v, want %s, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+
+	plain := echoRequest(nil)[:stun.HeaderSize]
+	binary.BigEndian.PutUint16(plain[2:], 0)
+	if _, ok := echoDelay(plain); ok {
+		t.Error("echoDelay() of a request without the attribute ok = true")
+	}
+}
+
+func TestBindingSuccess(t *testing.T) {
+	txID := []byte("0123456789ab")
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4242}
+
+	for _, delayed := range []bool{false, true} {
+		resp := bindingSuccess(txID, addr, delayed)
+		if string(resp[8:stun.HeaderSize]) != string(txID) {
+			t.Fatalf("bindingSuccess() transaction ID = %q, want %q", resp[8:stun.HeaderSize], txID)
+		}
+		value, ok := stun.Attribute(resp, stun.AttrXORMappedAddress)
+		if !ok || len(value) != 8 {
+			t.Fatalf("bindingSuccess() XOR-MAPPED-ADDRESS = %x, %v", value, ok)
+		}
+		port := int(binary.BigEndian.Uint16(value[2:]) ^ stun.MagicCookie>>16)
+		ip := binary.BigEndian.Uint32(value[4:]) ^ stun.MagicCookie
+		if port != addr.Port || ip != binary.BigEndian.Uint32(addr.IP.To4()) {
+			t.Errorf("bindingSuccess() mapped address = %x:%d, want %s", ip, port, addr)
+		}
+		if _, ok := stun.Attribute(resp, stun.AttrEchoDelay); ok != delayed {
+			t.Errorf("bindingSuccess(delayed = %v) has the echo delay attribute = %v", delayed, ok)
+		}
+	}
+}
+
+func TestSTUNEcho(t *testing.T) {
+	server, err := ListenSTUN("127.0.0.1:0", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// A mapping on loopback never expires, so every probe gets its echo
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := p2pquic.MeasureMappingLifetime(ctx, server.conn.LocalAddr().String(), 50*time.Millisecond, 150*time.Millisecond)
+	if err != nil {
+		t.Fatalf("MeasureMappingLifetime() error = %v", err)
+	}
+	if result.Alive != 150*time.Millisecond || result.Expired != 0 {
+		t.Errorf("MeasureMappingLifetime() alive = %s, expired = %s, want 150ms and none", result.Alive, result.Expired)
+	}
+	for _, probe := range result.Probes {
+		if probe.Mapped == nil || !probe.Mapped.IP.IsLoopback() {
+			t.Errorf("probe after %s mapped = %v, want a loopback address", probe.Silence, probe.Mapped)
+		}
+	}
+}
@@ -3,47 +3,57 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/mevdschee/p2pquic-go/internal/logging"
+	"github.com/mevdschee/p2pquic-go/internal/peerflags"
 	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
 	"github.com/quic-go/quic-go"
 )
 
 func main() {
-	mode := flag.String("mode", "server", "Mode: server or client")
-	peerID := flag.String("id", "", "This peer's ID (defaults to 'server' or 'client' based on mode)")
+	mode := flag.String("mode", "server", "Mode: server, client or mapping (measure the NAT mapping lifetime)")
 	remotePeerID := flag.String("remote", "server", "Remote peer ID (for client mode)")
-	signalingURL := flag.String("signaling", "http://localhost:8080", "Signaling server URL")
-	// IMPORTANT: Both client and server need a specific port for UDP hole-punching to work.
-	// The port is used for:
-	// 1. STUN discovery to find the public IP:port mapping
-	// 2. Sending UDP punch packets to create NAT mappings
-	// 3. Receiving the actual QUIC connection
-	// All three must use the SAME port, otherwise NAT mappings won't match.
-	// Different ports in examples (9000 vs 9001) are only for local testing on the same machine.
-	port := flag.Int("port", 0, "Local UDP port (0 = auto-assign)")
-	enableSTUN := flag.Bool("stun", true, "Enable STUN for public IP discovery")
+	probes := flag.String("probes", "", "Comma-separated silence intervals for mapping mode (default: 10s up to 3m)")
+	peerFlags := peerflags.RegisterFlags("This peer's ID (defaults to 'server' or 'client' based on mode)")
+	logFlags := logging.RegisterFlags()
 	flag.Parse()
 
+	logger, err := logFlags.Setup()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *mode == "mapping" {
+		runMapping(*peerFlags.STUNServer, *probes)
+		return
+	}
+
 	// Set default peer ID based on mode if not provided
-	if *peerID == "" {
-		*peerID = *mode
+	if *peerFlags.PeerID == "" {
+		*peerFlags.PeerID = *mode
 	}
 
-	log.Printf("Starting in %s mode as %s on port %d", *mode, *peerID, *port)
+	slog.Info("Starting", "mode", *mode, "peer_id", *peerFlags.PeerID, "port", *peerFlags.Port)
 
 	// Create peer
-	config := p2pquic.Config{
-		PeerID:       *peerID,
-		LocalPort:    *port,
-		SignalingURL: *signalingURL,
-		EnableSTUN:   *enableSTUN,
+	config, err := peerFlags.Config(logger)
+	if err != nil {
+		logging.Fatal("Invalid peer configuration", "err", err)
+	}
+	config.OnMappingChange = func(old, new p2pquic.Candidate) {
+		slog.Info("Public address changed", "old", fmt.Sprintf("%s:%d", old.IP, old.Port), "new", fmt.Sprintf("%s:%d", new.IP, new.Port))
 	}
 
 	peer, err := p2pquic.NewPeer(config)
 	if err != nil {
-		log.Fatalf("Failed to create peer: %v", err)
+		logging.Fatal("Failed to create peer", "err", err)
 	}
 	defer peer.Close()
 
@@ -51,35 +61,29 @@ func main() {
 	// Client mode: Bind() first (creates UDP socket only)
 	// This must be done before DiscoverCandidates() to know the actual port
 	if *mode == "server" {
-		log.Println("Starting QUIC listener...")
 		if err := peer.Listen(); err != nil {
-			log.Fatalf("Failed to start listening: %v", err)
+			logging.Fatal("Failed to start listening", "err", err)
 		}
 	} else {
-		log.Println("Binding UDP socket...")
 		if err := peer.Bind(); err != nil {
-			log.Fatalf("Failed to bind: %v", err)
+			logging.Fatal("Failed to bind", "err", err)
 		}
 	}
 
 	// Discover candidates (requires Listen/Bind to be called first)
-	log.Println("Discovering NAT candidates...")
 	candidates, err := peer.DiscoverCandidates()
 	if err != nil {
-		log.Fatalf("Failed to discover candidates: %v", err)
+		logging.Fatal("Failed to discover candidates", "err", err)
 	}
-
-	log.Printf("Total candidates: %d", len(candidates))
 	for _, c := range candidates {
-		log.Printf("  - %s:%d", c.IP, c.Port)
+		slog.Info("Discovered candidate", "candidate", fmt.Sprintf("%s:%d", c.IP, c.Port), "type", c.Type)
 	}
 
 	// Register with signaling server
-	log.Println("Registering with signaling server...")
 	if err := peer.Register(); err != nil {
-		log.Fatalf("Failed to register: %v", err)
+		logging.Fatal("Failed to register", "err", err)
 	}
-	log.Println("Registration successful")
+	slog.Info("Registered with signaling server", "url", config.SignalingURL)
 
 	if *mode == "server" {
 		runServer(peer)
@@ -88,6 +92,51 @@ func main() {
 	}
 }
 
+// runMapping measures how long the NAT keeps an idle UDP mapping and
+// recommends a keepalive period
+func runMapping(stunServer, probes string) {
+	var intervals []time.Duration
+	for _, p := range strings.Split(probes, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		d, err := time.ParseDuration(p)
+		if err != nil {
+			logging.Fatal("Invalid probe interval", "interval", p, "err", err)
+		}
+		intervals = append(intervals, d)
+	}
+	if len(intervals) == 0 {
+		intervals = p2pquic.DefaultMappingProbes
+	}
+
+	longest := slices.Max(intervals)
+	slog.Info("Measuring NAT mapping lifetime", "server", stunServer, "probes", len(intervals), "duration", longest)
+
+	result, err := p2pquic.MeasureMappingLifetime(context.Background(), stunServer, intervals...)
+	if err != nil {
+		logging.Fatal("Failed to measure mapping lifetime", "err", err)
+	}
+
+	for _, probe := range result.Probes {
+		switch {
+		case probe.Err != nil:
+			slog.Warn("Probe failed", "silence", probe.Silence, "err", probe.Err)
+		case probe.Alive:
+			slog.Info("Mapping alive", "silence", probe.Silence, "mapped", probe.Mapped.String())
+		default:
+			slog.Info("Mapping expired", "silence", probe.Silence, "mapped", probe.Mapped.String())
+		}
+	}
+
+	if result.Expired > 0 {
+		slog.Info("Mapping lifetime measured", "alive", result.Alive, "expired", result.Expired)
+	} else {
+		slog.Info("Mapping survived all probes", "alive", result.Alive)
+	}
+	slog.Info("Recommended keepalive", "keepalive", result.KeepAlivePeriod)
+}
+
 func runServer(peer *p2pquic.Peer) {
 	// Listen() was already called in main() before DiscoverCandidates()
 
@@ -95,27 +144,32 @@ func runServer(peer *p2pquic.Peer) {
 	ctx := context.Background()
 	go peer.ContinuousHolePunch(ctx)
 
-	log.Println("Waiting for incoming connections...")
+	slog.Info("Waiting for incoming connections")
 
 	for {
 		conn, err := peer.Accept(context.Background())
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
+			slog.Warn("Failed to accept connection", "err", err)
 			continue
 		}
 
-		log.Printf("Accepted connection from %s", conn.RemoteAddr())
+		pair := conn.CandidatePair()
+		slog.Info("Accepted connection",
+			"peer_id", conn.RemotePeerID(),
+			"local", fmt.Sprintf("%s %s:%d", pair.Local.Type, pair.Local.IP, pair.Local.Port),
+			"remote", fmt.Sprintf("%s %s:%d", pair.Remote.Type, pair.Remote.IP, pair.Remote.Port),
+			"duration", conn.HandshakeDuration().Round(time.Millisecond))
 
 		go handleConnection(conn)
 	}
 }
 
-func handleConnection(conn *quic.Conn) {
+func handleConnection(conn *p2pquic.Conn) {
 	defer conn.CloseWithError(0, "done")
 
 	stream, err := conn.AcceptStream(context.Background())
 	if err != nil {
-		log.Printf("Failed to accept stream: %v", err)
+		slog.Warn("Failed to accept stream", "peer_id", conn.RemotePeerID(), "err", err)
 		return
 	}
 	defer stream.Close()
@@ -123,12 +177,12 @@ func handleConnection(conn *quic.Conn) {
 	buf := make([]byte, 1024)
 	n, err := stream.Read(buf)
 	if err != nil {
-		log.Printf("Failed to read: %v", err)
+		slog.Warn("Failed to read", "peer_id", conn.RemotePeerID(), "err", err)
 		return
 	}
 
 	message := string(buf[:n])
-	log.Printf("Received from %s: %s", conn.RemoteAddr().String(), message)
+	slog.Info("Received", "peer_id", conn.RemotePeerID(), "message", message)
 
 	// Continuously exchange messages
 	for {
@@ -136,65 +190,86 @@ func handleConnection(conn *quic.Conn) {
 		response := "Hello from server!"
 		_, err := stream.Write([]byte(response))
 		if err != nil {
-			log.Printf("Failed to write: %v", err)
+			slog.Warn("Failed to write", "peer_id", conn.RemotePeerID(), "err", err)
 			return
 		}
-		log.Printf("Sent to %s: %s", conn.RemoteAddr().String(), response)
+		slog.Info("Sent", "peer_id", conn.RemotePeerID(), "message", response)
 
 		// Wait for next message
 		time.Sleep(5 * time.Second)
 
 		n, err := stream.Read(buf)
 		if err != nil {
-			log.Printf("Connection closed: %v", err)
+			slog.Info("Connection closed", "peer_id", conn.RemotePeerID(), "err", err)
 			return
 		}
-		log.Printf("Received from %s: %s", conn.RemoteAddr().String(), string(buf[:n]))
+		slog.Info("Received", "peer_id", conn.RemotePeerID(), "message", string(buf[:n]))
 	}
 }
 
 func runClient(peer *p2pquic.Peer, remotePeerID string) {
-	log.Printf("Waiting for remote peer %s to register...", remotePeerID)
+	slog.Info("Waiting for remote peer to register", "peer_id", remotePeerID)
 
 	// Wait for remote peer to be available
 	time.Sleep(2 * time.Second)
 
-	// Connect to remote peer
-	conn, err := peer.Connect(remotePeerID)
+	// Connect to remote peer, the connection is re-established when it is lost
+	conn, err := peer.Dial(context.Background(), remotePeerID,
+		p2pquic.WithBufferedStreams(),
+		p2pquic.WithStateHandler(func(state p2pquic.ConnState, err error) {
+			if err != nil {
+				slog.Info("Connection state changed", "peer_id", remotePeerID, "state", state.String(), "err", err)
+			} else {
+				slog.Info("Connection state changed", "peer_id", remotePeerID, "state", state.String())
+			}
+		}),
+	)
 	if err != nil {
-		log.Fatalf("Failed to connect to remote peer: %v", err)
+		logging.Fatal("Failed to connect to remote peer", "peer_id", remotePeerID, "err", err)
 	}
-	defer conn.CloseWithError(0, "done")
-
-	log.Println("QUIC connection established!")
-
-	// Open a stream
-	stream, err := conn.OpenStreamSync(context.Background())
-	if err != nil {
-		log.Fatalf("Failed to open stream: %v", err)
+	defer conn.Close()
+
+	stats := conn.Stats()
+	slog.Info("Connected",
+		"peer_id", remotePeerID,
+		"local", fmt.Sprintf("%s:%d (%s)", stats.CandidatePair.Local.IP, stats.CandidatePair.Local.Port, stats.CandidatePair.Local.Type),
+		"remote", fmt.Sprintf("%s:%d (%s)", stats.CandidatePair.Remote.IP, stats.CandidatePair.Remote.Port, stats.CandidatePair.Remote.Type),
+		"signaling", stats.ConnectTimes.Signaling,
+		"punching", stats.ConnectTimes.Punching,
+		"handshake", stats.ConnectTimes.Handshake)
+
+	// Exchange messages, opening a new stream after every reconnect
+	for {
+		stream, err := conn.OpenStream(context.Background())
+		if err != nil {
+			logging.Fatal("Failed to open stream", "peer_id", remotePeerID, "err", err)
+		}
+		exchangeMessages(stream)
+		stream.Close()
 	}
-	defer stream.Close()
-
-	log.Println("Starting continuous message exchange...")
+}
 
+// exchangeMessages sends a message every 5 seconds and reads the response
+// until the stream fails
+func exchangeMessages(stream *quic.Stream) {
 	buf := make([]byte, 1024)
 	for {
 		// Send message
 		message := "Hello from client!"
 		_, err := stream.Write([]byte(message))
 		if err != nil {
-			log.Printf("Failed to send: %v", err)
-			break
+			slog.Warn("Failed to send", "err", err)
+			return
 		}
-		log.Printf("Sent: %s", message)
+		slog.Info("Sent", "message", message)
 
 		// Receive response
 		n, err := stream.Read(buf)
 		if err != nil {
-			log.Printf("Connection closed: %v", err)
-			break
+			slog.Info("Connection closed", "err", err)
+			return
 		}
-		log.Printf("Received: %s", string(buf[:n]))
+		slog.Info("Received", "message", string(buf[:n]))
 
 		// Wait before next message
 		time.Sleep(5 * time.Second)
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/internal/logging"
+	"github.com/mevdschee/p2pquic-go/internal/peerflags"
+	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
+	"github.com/mevdschee/p2pquic-go/pkg/transfer"
+)
+
+const (
+	// retryDelay is the delay before a failed transfer is offered again
+	retryDelay = 5 * time.Second
+
+	// progressInterval is the time between two progress lines
+	progressInterval = time.Second
+
+	// defaultMaxSize and defaultMaxFiles are the default limits of a transfer
+	defaultMaxSize  = 64 << 30
+	defaultMaxFiles = 100000
+)
+
+func main() {
+	mode := flag.String("mode", "", "Mode: send or receive (required)")
+	remotePeerID := flag.String("remote", "", "Peer ID to send to (send mode)")
+	dir := flag.String("dir", ".", "Directory to receive into (receive mode)")
+	overwrite := flag.Bool("overwrite", false, "Replace existing files that differ from the files sent (receive mode)")
+	from := flag.String("from", "", "Comma-separated peer IDs that may send files, * allows all (receive mode, required)")
+	maxSize := flag.Int64("max-size", defaultMaxSize, "Maximum total size of a transfer in bytes, 0 is unlimited (receive mode)")
+	maxFiles := flag.Int("max-files", defaultMaxFiles, "Maximum number of files and directories of a transfer, 0 is unlimited (receive mode)")
+	streams := flag.Int("streams", transfer.DefaultStreams, "Number of parallel streams (send mode)")
+	chunkSize := flag.Int64("chunk-size", transfer.DefaultChunkSize, "Chunk size in bytes (send mode)")
+	retries := flag.Int("retries", 10, "Number of times a failed transfer is resumed, negative is unlimited (send mode)")
+	peerFlags := peerflags.RegisterFlags("This peer's ID (required)")
+	logFlags := logging.RegisterFlags()
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -mode send -id ID -remote PEER [flags] PATH...\n       %s -mode receive -id ID [flags]\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	logger, err := logFlags.Setup()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *peerFlags.PeerID == "" {
+		fmt.Fprintln(os.Stderr, "-id is required")
+		os.Exit(2)
+	}
+	switch {
+	case *mode == "send" && (*remotePeerID == "" || flag.NArg() == 0):
+		fmt.Fprintln(os.Stderr, "send mode requires -remote and at least one path")
+		os.Exit(2)
+	case *mode == "receive" && strings.TrimSpace(*from) == "":
+		fmt.Fprintln(os.Stderr, "receive mode requires -from, use -from '*' to accept files from any peer")
+		os.Exit(2)
+	case *mode != "send" && *mode != "receive":
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Hash before connecting, so the remote peer does not wait for it
+	var manifest *transfer.Manifest
+	if *mode == "send" {
+		slog.Info("Hashing files", "paths", flag.Args())
+		manifest, err = transfer.BuildManifest(flag.Args(), *chunkSize)
+		if err != nil {
+			logging.Fatal("Failed to read files", "err", err)
+		}
+		slog.Info("Hashed files", "files", len(manifest.Files), "bytes", manifest.Size())
+	}
+
+	config, err := peerFlags.Config(logger)
+	if err != nil {
+		logging.Fatal("Invalid peer configuration", "err", err)
+	}
+	peer, err := peerflags.Start(config)
+	if err != nil {
+		logging.Fatal("Failed to start peer", "err", err)
+	}
+	defer peer.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if *mode == "send" {
+		if err := send(ctx, peer, *remotePeerID, manifest, *streams, *retries, logger); err != nil {
+			peer.Close()
+			logging.Fatal("Transfer failed", "err", err)
+		}
+		return
+	}
+	receiver := &transfer.Receiver{
+		Dir:       *dir,
+		Overwrite: *overwrite,
+		MaxSize:   *maxSize,
+		MaxFiles:  *maxFiles,
+		Logger:    logger,
+	}
+	receive(ctx, peer, receiver, *from)
+}
+
+// send sends the files of a manifest, and resumes the transfer after a
+// failure until it succeeds, is rejected or runs out of retries
+func send(ctx context.Context, peer *p2pquic.Peer, remotePeerID string, manifest *transfer.Manifest, streams, retries int, logger *slog.Logger) error {
+	sender := &transfer.Sender{
+		Peer:       peer,
+		Streams:    streams,
+		OnProgress: progressLogger(),
+		Logger:     logger,
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := sender.Send(ctx, remotePeerID, manifest)
+		if err == nil || errors.Is(err, transfer.ErrRejected) || ctx.Err() != nil {
+			return err
+		}
+		if retries >= 0 && attempt >= retries {
+			return err
+		}
+		slog.Warn("Transfer interrupted, resuming", "peer_id", remotePeerID, "delay", retryDelay, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// receive receives files into the directory of the receiver until ctx is
+// done, from the peers in the comma-separated list from ("*" allows all)
+func receive(ctx context.Context, peer *p2pquic.Peer, receiver *transfer.Receiver, from string) {
+	var senders []string
+	for _, id := range strings.Split(from, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			senders = append(senders, id)
+		}
+	}
+	if slices.Contains(senders, "*") {
+		slog.Warn("Accepting files from any peer")
+	}
+
+	listener, err := peer.StreamListener()
+	if err != nil {
+		logging.Fatal("Failed to listen for streams", "err", err)
+	}
+	receiver.Allow = func(peerID string, m *transfer.Manifest) bool {
+		return slices.Contains(senders, "*") || slices.Contains(senders, peerID)
+	}
+	receiver.OnProgress = progressLogger()
+	go func() {
+		if err := receiver.Serve(listener); err != nil && ctx.Err() == nil {
+			logging.Fatal("Failed to receive", "dir", receiver.Dir, "err", err)
+		}
+	}()
+	slog.Info("Receiving files", "dir", receiver.Dir, "from", senders)
+
+	<-ctx.Done()
+	slog.Info("Shutting down")
+}
+
+// progressLogger returns an OnProgress function that logs the progress of
+// every transfer at most once per progressInterval, and when it is done
+func progressLogger() func(transfer.Progress) {
+	type state struct {
+		start  time.Time
+		logged time.Time
+	}
+	var mu sync.Mutex
+	states := make(map[string]*state)
+
+	return func(p transfer.Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := time.Now()
+		s, ok := states[p.ID]
+		if !ok {
+			s = &state{start: now}
+			states[p.ID] = s
+		}
+		if p.Done < p.Total && now.Sub(s.logged) < progressInterval {
+			return
+		}
+		if p.Done == p.Total {
+			delete(states, p.ID)
+		}
+		s.logged = now
+
+		var rate int64
+		if elapsed := now.Sub(s.start).Seconds(); elapsed > 0 {
+			rate = int64(float64(p.Done-p.Resumed) / elapsed)
+		}
+		slog.Info("Progress", "peer_id", p.PeerID, "id", p.ID, "percent", fmt.Sprintf("%.1f", p.Percent()), "bytes", p.Done, "total", p.Total, "bytes_per_sec", rate)
+	}
+}
@@ -0,0 +1,53 @@
+// Package logging configures the structured log output of the command-line tools
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Flags holds the -log-format and -log-level command-line flags
+type Flags struct {
+	format *string
+	level  *string
+}
+
+// RegisterFlags adds the -log-format and -log-level flags to the default flag set
+func RegisterFlags() *Flags {
+	return &Flags{
+		format: flag.String("log-format", "text", "Log format: text or json"),
+		level:  flag.String("log-level", "info", "Log level: debug, info, warn or error"),
+	}
+}
+
+// Setup creates the logger selected by the parsed flags, writing to stderr,
+// and makes it the default logger of the slog and log packages
+func (f *Flags) Setup() (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*f.level)); err != nil {
+		return nil, fmt.Errorf("invalid -log-level %q", *f.level)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch *f.format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return nil, fmt.Errorf("invalid -log-format %q, use text or json", *f.format)
+	}
+
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+// Fatal logs an error and exits with status 1
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,152 @@
+// Package peerflags holds the command-line flags that configure a peer,
+// shared by the command-line tools
+package peerflags
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
+)
+
+// Flags holds the peer ID, port, signaling, STUN and debugging flags
+type Flags struct {
+	PeerID         *string
+	Port           *int
+	SignalingURL   *string
+	EnableSTUN     *bool
+	STUNServer     *string
+	KeepAlive      *time.Duration
+	Namespace      *string
+	SignalingToken *string
+	SignalingCert  *string
+	SignalingKey   *string
+	SignalingCA    *string
+	QlogDir        *string
+	KeyLogFile     *string
+}
+
+// RegisterFlags adds the peer flags to the default flag set
+func RegisterFlags(idUsage string) *Flags {
+	return &Flags{
+		PeerID:       flag.String("id", "", idUsage),
+		SignalingURL: flag.String("signaling", "http://localhost:8080", "Signaling server URL"),
+		// IMPORTANT: Both sides need a specific port for UDP hole-punching to work.
+		// The port is used for:
+		// 1. STUN discovery to find the public IP:port mapping
+		// 2. Sending UDP punch packets to create NAT mappings
+		// 3. Receiving the actual QUIC connection
+		// All three must use the SAME port, otherwise NAT mappings won't match.
+		// Different ports in examples (9000 vs 9001) are only for local testing on the same machine.
+		Port:           flag.Int("port", 0, "Local UDP port (0 = auto-assign)"),
+		EnableSTUN:     flag.Bool("stun", true, "Enable STUN for public IP discovery"),
+		STUNServer:     flag.String("stun-server", p2pquic.DefaultSTUNServer, "STUN server host:port"),
+		KeepAlive:      flag.Duration("keepalive", p2pquic.DefaultKeepAlivePeriod, "NAT keepalive period with STUN (negative disables)"),
+		Namespace:      flag.String("namespace", "", "Signaling namespace to register and look up peers in"),
+		SignalingToken: flag.String("signaling-token", "", "Bearer token or JWT for the signaling server"),
+		SignalingCert:  flag.String("signaling-cert", "", "Client certificate file for mTLS with the signaling server"),
+		SignalingKey:   flag.String("signaling-key", "", "Client private key file for mTLS with the signaling server"),
+		SignalingCA:    flag.String("signaling-ca", "", "CA file for verifying the signaling server certificate"),
+		QlogDir:        flag.String("qlog-dir", "", "Directory to write a qlog trace of every connection to"),
+		KeyLogFile:     flag.String("keylog", "", "File to append TLS secrets to for decrypting captures in Wireshark (debugging only)"),
+	}
+}
+
+// Config returns the peer configuration selected by the parsed flags. The
+// key log file, if any, stays open until the process exits.
+func (f *Flags) Config(logger *slog.Logger) (p2pquic.Config, error) {
+	signalingTLS, err := loadSignalingTLS(*f.SignalingCert, *f.SignalingKey, *f.SignalingCA)
+	if err != nil {
+		return p2pquic.Config{}, fmt.Errorf("failed to load signaling TLS configuration: %w", err)
+	}
+
+	var keyLog io.Writer
+	if *f.KeyLogFile != "" {
+		file, err := os.OpenFile(*f.KeyLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return p2pquic.Config{}, fmt.Errorf("failed to open key log file: %w", err)
+		}
+		keyLog = file
+		logger.Warn("Writing TLS secrets, connections can be decrypted", "file", *f.KeyLogFile)
+	}
+
+	return p2pquic.Config{
+		PeerID:             *f.PeerID,
+		LocalPort:          *f.Port,
+		SignalingURL:       *f.SignalingURL,
+		EnableSTUN:         *f.EnableSTUN,
+		STUNServer:         *f.STUNServer,
+		KeepAlivePeriod:    *f.KeepAlive,
+		Namespace:          *f.Namespace,
+		SignalingToken:     *f.SignalingToken,
+		SignalingTLSConfig: signalingTLS,
+		Logger:             logger,
+		QlogDir:            *f.QlogDir,
+		KeyLogWriter:       keyLog,
+	}, nil
+}
+
+// Start creates a peer from the config, listens, registers its candidates
+// and punches toward peers that request a connection until the peer is closed
+func Start(config p2pquic.Config) (*p2pquic.Peer, error) {
+	peer, err := p2pquic.NewPeer(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := peer.Listen(); err != nil {
+		peer.Close()
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	candidates, err := peer.DiscoverCandidates()
+	if err != nil {
+		peer.Close()
+		return nil, fmt.Errorf("failed to discover candidates: %w", err)
+	}
+	for _, c := range candidates {
+		config.Logger.Info("Discovered candidate", "candidate", fmt.Sprintf("%s:%d", c.IP, c.Port), "type", c.Type)
+	}
+	if err := peer.Register(); err != nil {
+		peer.Close()
+		return nil, fmt.Errorf("failed to register: %w", err)
+	}
+	config.Logger.Info("Registered with signaling server", "peer_id", config.PeerID, "url", config.SignalingURL)
+
+	go peer.ContinuousHolePunch(context.Background())
+	return peer, nil
+}
+
+// loadSignalingTLS builds the TLS configuration for the signaling server,
+// returning nil when no client certificate or CA is given
+func loadSignalingTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" && caFile == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,79 @@
+// Package ratelimit provides the token bucket rate limiter shared by the
+// punch safeguards and the signaling server
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket rate limiter keyed by an arbitrary string,
+// such as an address or a credential subject
+type Limiter struct {
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*bucket
+	mu      sync.Mutex
+	lastGC  time.Time
+}
+
+// bucket holds the tokens of a single key
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New creates a limiter that allows rate events per second per key, with
+// bursts of up to burst events
+func New(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		lastGC:  time.Now(),
+	}
+}
+
+// Allow reports whether an event for key may happen now and consumes a token if so
+func (l *Limiter) Allow(key string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.collectGarbage(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// collectGarbage drops buckets that have refilled completely (caller holds the lock)
+func (l *Limiter) collectGarbage(now time.Time) {
+	if now.Sub(l.lastGC) < time.Minute {
+		return
+	}
+	l.lastGC = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
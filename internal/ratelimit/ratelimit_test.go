@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// elapse moves the last refill of a bucket back, as if d had passed
+func elapse(l *Limiter, key string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buckets[key].last = l.buckets[key].last.Add(-d)
+}
+
+func TestLimiterBurst(t *testing.T) {
+	l := New(1, 3)
+
+	for i := range 3 {
+		if !l.Allow("a") {
+			t.Fatalf("Allow() %d within the burst = false", i)
+		}
+	}
+	if l.Allow("a") {
+		t.Fatal("Allow() beyond the burst = true")
+	}
+	if !l.Allow("b") {
+		t.Fatal("Allow() of another key = false")
+	}
+}
+
+func TestLimiterRefill(t *testing.T) {
+	l := New(10, 2)
+	l.Allow("a")
+	l.Allow("a")
+	if l.Allow("a") {
+		t.Fatal("Allow() of an empty bucket = true")
+	}
+
+	// 10 per second refills one token in 100ms
+	elapse(l, "a", 100*time.Millisecond)
+	if !l.Allow("a") {
+		t.Fatal("Allow() after a refill = false")
+	}
+	if l.Allow("a") {
+		t.Fatal("Allow() after the refilled token was used = true")
+	}
+
+	// The bucket never holds more than the burst
+	elapse(l, "a", time.Hour)
+	for i := range 2 {
+		if !l.Allow("a") {
+			t.Fatalf("Allow() %d after a long pause = false", i)
+		}
+	}
+	if l.Allow("a") {
+		t.Fatal("Allow() beyond the burst after a long pause = true")
+	}
+}
+
+func TestLimiterMinimumBurst(t *testing.T) {
+	l := New(1, 0)
+	if !l.Allow("a") {
+		t.Fatal("Allow() with a burst below 1 = false, want a burst of 1")
+	}
+	if l.Allow("a") {
+		t.Fatal("Allow() beyond a burst of 1 = true")
+	}
+}
+
+func TestLimiterCollectGarbage(t *testing.T) {
+	// One token per 100 seconds, so a minute refills no empty bucket
+	l := New(0.01, 2)
+	l.Allow("full")
+	l.Allow("empty")
+	l.Allow("empty")
+	elapse(l, "full", 100*time.Second)
+
+	l.collectGarbage(time.Now().Add(time.Minute))
+	if _, ok := l.buckets["full"]; ok {
+		t.Error("collectGarbage() kept a refilled bucket")
+	}
+	if _, ok := l.buckets["empty"]; !ok {
+		t.Error("collectGarbage() dropped a bucket that is not refilled")
+	}
+}
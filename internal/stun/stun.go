@@ -0,0 +1,59 @@
+// Package stun holds the STUN (RFC 8489) message constants shared by the
+// peers and the STUN endpoint of the signaling server
+package stun
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	// MagicCookie is the fixed value at offset 4 of every STUN message
+	MagicCookie = 0x2112a442
+
+	// HeaderSize is the size of the header of a STUN message
+	HeaderSize = 20
+
+	BindingRequest       = 0x0001
+	BindingSuccess       = 0x0101
+	AttrMappedAddress    = 0x0001
+	AttrXORMappedAddress = 0x0020
+
+	// AttrEchoDelay is a comprehension-optional attribute that asks the STUN
+	// endpoint of the signaling server to send a second binding response
+	// after the given number of milliseconds (uint32)
+	AttrEchoDelay = 0xc0de
+
+	// MaxEchoDelay is the longest delay the STUN endpoint of the signaling
+	// server answers an echo request after
+	MaxEchoDelay = 4 * time.Minute
+)
+
+// Attribute returns the value of the first attribute of type attr of a STUN
+// message, which must be at least HeaderSize long
+func Attribute(b []byte, attr uint16) ([]byte, bool) {
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if HeaderSize+length > len(b) {
+		return nil, false
+	}
+
+	attrs := b[HeaderSize : HeaderSize+length]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		size := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+size > len(attrs) {
+			return nil, false
+		}
+		if typ == attr {
+			return attrs[4 : 4+size], true
+		}
+
+		// Attributes are padded to a multiple of 4 bytes
+		next := 4 + (size+3)&^3
+		if next > len(attrs) {
+			return nil, false
+		}
+		attrs = attrs[next:]
+	}
+	return nil, false
+}
@@ -0,0 +1,61 @@
+package stun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// message builds a STUN message with the given attribute values, padded to
+// a multiple of 4 bytes
+func message(attrs map[uint16][]byte, order ...uint16) []byte {
+	b := make([]byte, HeaderSize)
+	binary.BigEndian.PutUint16(b[0:], BindingRequest)
+	binary.BigEndian.PutUint32(b[4:], MagicCookie)
+	for _, typ := range order {
+		value := attrs[typ]
+		b = binary.BigEndian.AppendUint16(b, typ)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+		b = append(b, value...)
+		b = append(b, make([]byte, (4-len(value)%4)%4)...)
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-HeaderSize))
+	return b
+}
+
+func TestAttribute(t *testing.T) {
+	delay := []byte{0, 0, 0x03, 0xe8}
+	attrs := map[uint16][]byte{0x8022: []byte("odd"), AttrEchoDelay: delay}
+	msg := message(attrs, 0x8022, AttrEchoDelay)
+
+	if got, ok := Attribute(msg, AttrEchoDelay); !ok || !bytes.Equal(got, delay) {
+		t.Fatalf("Attribute() after a padded attribute = %x, %v, want %x", got, ok, delay)
+	}
+	if got, ok := Attribute(msg, 0x8022); !ok || string(got) != "odd" {
+		t.Fatalf("Attribute() = %q, %v, want %q", got, ok, "odd")
+	}
+	if _, ok := Attribute(msg, AttrXORMappedAddress); ok {
+		t.Fatal("Attribute() of a missing attribute ok = true")
+	}
+
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{"header only", msg[:HeaderSize]},
+		{"length beyond message", msg[:len(msg)-1]},
+		{"attribute beyond length", func() []byte {
+			b := bytes.Clone(msg)
+			binary.BigEndian.PutUint16(b[HeaderSize+2:], 0xff)
+			return b
+		}()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := Attribute(tt.msg, AttrEchoDelay); ok {
+				t.Fatal("Attribute() ok = true")
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
+)
+
+// Dial opens a stream to a remote peer, asks it to connect to a host:port
+// address and returns the stream once the remote peer is connected. The
+// error wraps ErrRefused when the remote peer does not allow the address.
+func Dial(ctx context.Context, peer *p2pquic.Peer, remotePeerID, addr string) (net.Conn, error) {
+	conn, err := peer.DialStream(ctx, remotePeerID)
+	if err != nil {
+		return nil, err
+	}
+	if err := request(ctx, conn, Request{Kind: Connect, Addr: addr}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// request sends a request and waits for the answer until ctx is done
+func request(ctx context.Context, conn net.Conn, req Request) error {
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	if err := WriteRequest(conn, req); err != nil {
+		return err
+	}
+	if err := readResponse(conn); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	// ctx was done right after the answer, the deadline may be set
+	if !stop() {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// Forward accepts TCP connections on l and tunnels every connection through
+// a stream of its own to a remote peer, which connects it to a host:port
+// address (local forwarding). It returns when l is closed.
+func Forward(peer *p2pquic.Peer, l net.Listener, remotePeerID, addr string, logger *slog.Logger) error {
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	log := logger.With("peer_id", remotePeerID, "dest", addr)
+
+	for {
+		tcpConn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			stream, err := Dial(context.Background(), peer, remotePeerID, addr)
+			if err != nil {
+				log.Warn("Failed to open tunnel", "client", tcpConn.RemoteAddr().String(), "err", err)
+				tcpConn.Close()
+				return
+			}
+			log.Info("Tunnel opened", "client", tcpConn.RemoteAddr().String())
+			start := time.Now()
+			sent, received := Relay(tcpConn, stream)
+			log.Info("Tunnel closed", "client", tcpConn.RemoteAddr().String(), "sent", sent, "received", received, "duration", time.Since(start).Round(time.Millisecond))
+		}()
+	}
+}
+
+// RemoteForward asks a remote peer to listen on a host:port address and to
+// tunnel every connection back to this peer, which connects it to target
+// (remote forwarding). The Server of this peer must allow target for the
+// remote peer. It returns when ctx is done or the connection to the remote
+// peer is lost.
+func RemoteForward(ctx context.Context, peer *p2pquic.Peer, remotePeerID, listenAddr, target string) error {
+	conn, err := peer.DialStream(ctx, remotePeerID)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := request(ctx, conn, Request{Kind: Listen, Addr: listenAddr, Target: target}); err != nil {
+		return err
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	_, err = io.Copy(io.Discard, conn)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == nil {
+		err = errors.New("remote peer stopped listening")
+	}
+	return err
+}
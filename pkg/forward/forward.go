@@ -0,0 +1,313 @@
+// Package forward tunnels TCP connections through streams between peers.
+// Every TCP connection gets a stream of its own, which starts with a header
+// naming the destination and is answered by the remote peer with a status
+// before the data flows.
+package forward
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// version is the version of the stream header
+const version = 1
+
+// maxField is the maximum length of an address or message in a header
+const maxField = 1024
+
+// Kind is the request of a forwarding stream
+type Kind byte
+
+const (
+	// Connect asks the remote peer to connect to Addr and relay the stream to it
+	Connect Kind = 1
+
+	// Listen asks the remote peer to listen on Addr and open a Connect stream
+	// to Target back for every connection it accepts (remote forwarding). The
+	// stream stays open as long as the remote peer should listen.
+	Listen Kind = 2
+)
+
+// String returns the name of the kind
+func (k Kind) String() string {
+	switch k {
+	case Connect:
+		return "connect"
+	case Listen:
+		return "listen"
+	}
+	return fmt.Sprintf("kind(%d)", byte(k))
+}
+
+// status is the answer of the remote peer to a request
+type status byte
+
+const (
+	statusOK      status = 0
+	statusRefused status = 1
+	statusFailed  status = 2
+)
+
+var (
+	// ErrRefused is returned when the remote peer does not allow the destination
+	ErrRefused = errors.New("refused by remote peer")
+
+	// ErrFailed is returned when the remote peer could not connect or listen
+	ErrFailed = errors.New("failed on remote peer")
+
+	errVersion = errors.New("unsupported forwarding protocol version")
+)
+
+// Request is the header at the start of a forwarding stream
+type Request struct {
+	Kind Kind
+
+	// Addr is the destination host:port of Connect, or the address to
+	// listen on of Listen
+	Addr string
+
+	// Target is the destination of the Connect streams of a Listen request,
+	// which the requesting peer checks against its own remote forwards
+	Target string
+}
+
+// WriteRequest writes the header of a forwarding stream
+func WriteRequest(w io.Writer, req Request) error {
+	if len(req.Addr) > maxField || len(req.Target) > maxField {
+		return errors.New("address too long")
+	}
+	buf := []byte{version, byte(req.Kind)}
+	buf = appendField(buf, req.Addr)
+	buf = appendField(buf, req.Target)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadRequest reads the header of a forwarding stream
+func ReadRequest(r io.Reader) (Request, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return Request{}, err
+	}
+	if head[0] != version {
+		return Request{}, fmt.Errorf("%w %d", errVersion, head[0])
+	}
+	req := Request{Kind: Kind(head[1])}
+	var err error
+	if req.Addr, err = readField(r); err != nil {
+		return Request{}, err
+	}
+	if req.Target, err = readField(r); err != nil {
+		return Request{}, err
+	}
+	return req, nil
+}
+
+// writeResponse answers a request, with the error of a failed request
+func writeResponse(w io.Writer, err error) error {
+	buf := []byte{byte(statusOK)}
+	msg := ""
+	if err != nil {
+		buf[0] = byte(statusFailed)
+		msg = err.Error()
+		if errors.Is(err, ErrRefused) {
+			// readResponse wraps ErrRefused again on the other side
+			buf[0] = byte(statusRefused)
+			msg = strings.TrimPrefix(msg, ErrRefused.Error()+": ")
+		}
+		if len(msg) > maxField {
+			msg = msg[:maxField]
+		}
+	}
+	_, werr := w.Write(appendField(buf, msg))
+	return werr
+}
+
+// readResponse reads the answer to a request, which is ErrRefused or
+// ErrFailed with the message of the remote peer if it failed
+func readResponse(r io.Reader) error {
+	var st [1]byte
+	if _, err := io.ReadFull(r, st[:]); err != nil {
+		return err
+	}
+	msg, err := readField(r)
+	if err != nil {
+		return err
+	}
+	switch status(st[0]) {
+	case statusOK:
+		return nil
+	case statusRefused:
+		return fmt.Errorf("%w: %s", ErrRefused, msg)
+	default:
+		return fmt.Errorf("%w: %s", ErrFailed, msg)
+	}
+}
+
+// appendField appends a string with a 16-bit length
+func appendField(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+// readField reads a string with a 16-bit length
+func readField(r io.Reader) (string, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	length := binary.BigEndian.Uint16(n[:])
+	if length > maxField {
+		return "", errors.New("field too long")
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// Allowlist is a list of host:port patterns, where the host or the port may
+// be "*" to match any. Hosts are compared without case. An empty list
+// allows nothing.
+type Allowlist []string
+
+// ParseAllowlist parses a comma-separated list of host:port patterns
+func ParseAllowlist(s string) (Allowlist, error) {
+	var list Allowlist
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q, expected host:port: %w", pattern, err)
+		}
+		list = append(list, pattern)
+	}
+	return list, nil
+}
+
+// Allows reports whether a host:port address matches a pattern of the list
+func (l Allowlist) Allows(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range l {
+		h, p, _ := net.SplitHostPort(pattern)
+		if (h == "*" || strings.EqualFold(h, host)) && (p == "*" || p == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// CIDRPolicy restricts destinations by the IP address they resolve to.
+// Deny wins over Allow, and an empty Allow allows every address that is not
+// denied.
+type CIDRPolicy struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// ParseCIDRs parses a comma-separated list of CIDR prefixes, where a bare
+// IP address is a prefix of its full length
+func ParseCIDRs(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if ip, err := netip.ParseAddr(cidr); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Allows reports whether the policy allows an IP address
+func (p CIDRPolicy) Allows(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range p.Deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, prefix := range p.Allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Control checks the address a net.Dialer is about to connect to, after
+// name resolution, so a host name cannot resolve around the policy. Use it
+// as net.Dialer.ControlContext; the error wraps ErrRefused.
+func (p CIDRPolicy) Control(ctx context.Context, network, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrRefused, address, err)
+	}
+	if !p.Allows(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s is not allowed", ErrRefused, addrPort.Addr().Unmap())
+	}
+	return nil
+}
+
+// closeWriter is a connection that can close its sending side
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Relay copies data in both directions until both are done, closing the
+// sending side of each connection when the other one ended, and then
+// closes both. It returns the bytes copied from a to b and from b to a.
+func Relay(a, b net.Conn) (aToB, bToA int64) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		aToB = pipe(b, a)
+	}()
+	go func() {
+		defer wg.Done()
+		bToA = pipe(a, b)
+	}()
+	wg.Wait()
+	a.Close()
+	b.Close()
+	return aToB, bToA
+}
+
+// pipe copies src to dst and closes the sending side of dst, or all of it
+// when it cannot be half-closed
+func pipe(dst, src net.Conn) int64 {
+	n, err := io.Copy(dst, src)
+	if cw, ok := dst.(closeWriter); ok && err == nil {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+		src.Close()
+	}
+	return n
+}
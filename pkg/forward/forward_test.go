@@ -0,0 +1,179 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	tests := []Request{
+		{Kind: Connect, Addr: "example.com:80"},
+		{Kind: Listen, Addr: "127.0.0.1:8080", Target: "localhost:22"},
+		{Kind: Connect, Addr: "[2001:db8::1]:443"},
+	}
+
+	for _, req := range tests {
+		t.Run(req.Kind.String()+" "+req.Addr, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteRequest(&buf, req); err != nil {
+				t.Fatalf("WriteRequest() error = %v", err)
+			}
+			got, err := ReadRequest(&buf)
+			if err != nil {
+				t.Fatalf("ReadRequest() error = %v", err)
+			}
+			if got != req {
+				t.Fatalf("ReadRequest() = %+v, want %+v", got, req)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("ReadRequest() left %d bytes", buf.Len())
+			}
+		})
+	}
+}
+
+func TestReadRequestInvalid(t *testing.T) {
+	var valid bytes.Buffer
+	WriteRequest(&valid, Request{Kind: Connect, Addr: "example.com:80"})
+
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"empty", nil},
+		{"other version", append([]byte{version + 1}, valid.Bytes()[1:]...)},
+		{"truncated address", valid.Bytes()[:6]},
+		{"missing target", valid.Bytes()[:valid.Len()-2]},
+		{"field too long", []byte{version, byte(Connect), 0xff, 0xff}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadRequest(bytes.NewReader(tt.header)); err == nil {
+				t.Fatal("ReadRequest() error = nil")
+			}
+		})
+	}
+
+	if err := WriteRequest(&bytes.Buffer{}, Request{Kind: Connect, Addr: strings.Repeat("a", maxField+1)}); err == nil {
+		t.Error("WriteRequest() with a too long address error = nil")
+	}
+}
+
+func TestResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error  // nil for success, or the error it must wrap
+		msg  string // the message of the error that is read
+	}{
+		{"ok", nil, nil, ""},
+		{"refused", fmt.Errorf("%w: not allowed", ErrRefused), ErrRefused, "refused by remote peer: not allowed"},
+		{"failed", errors.New("connection refused"), ErrFailed, "failed on remote peer: connection refused"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeResponse(&buf, tt.err); err != nil {
+				t.Fatal(err)
+			}
+			err := readResponse(&buf)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("readResponse() error = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) || err.Error() != tt.msg {
+				t.Fatalf("readResponse() error = %v, want %v with %q", err, tt.want, tt.msg)
+			}
+		})
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	list, err := ParseAllowlist("localhost:22, *:80,Example.com:*,")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"localhost:22", true},
+		{"LOCALHOST:22", true},
+		{"localhost:23", false},
+		{"10.0.0.1:80", true},
+		{"example.com:443", true},
+		{"sub.example.com:443", false},
+		{"localhost", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := list.Allows(tt.addr); got != tt.want {
+				t.Errorf("Allows(%q) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+
+	if (Allowlist{}).Allows("localhost:22") {
+		t.Error("empty Allowlist allows an address")
+	}
+	if _, err := ParseAllowlist("localhost"); err == nil {
+		t.Error("ParseAllowlist() of a pattern without port error = nil")
+	}
+}
+
+func TestCIDRPolicy(t *testing.T) {
+	allow, err := ParseCIDRs("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := ParseCIDRs("10.1.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := CIDRPolicy{Allow: allow, Deny: deny}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.2.3.4", true},
+		{"10.1.2.3", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"::ffff:10.2.3.4", true},
+		{"::ffff:10.1.2.3", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := policy.Allows(netip.MustParseAddr(tt.ip)); got != tt.want {
+				t.Errorf("Allows(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+
+	denyOnly := CIDRPolicy{Deny: deny}
+	if !denyOnly.Allows(netip.MustParseAddr("192.0.2.2")) {
+		t.Error("CIDRPolicy without Allow refuses an address that is not denied")
+	}
+	if err := policy.Control(context.Background(), "tcp4", "10.1.2.3:80", nil); !errors.Is(err, ErrRefused) {
+		t.Errorf("Control() of a denied address error = %v, want ErrRefused", err)
+	}
+	if err := policy.Control(context.Background(), "tcp4", "10.2.3.4:80", nil); err != nil {
+		t.Errorf("Control() of an allowed address error = %v", err)
+	}
+	if _, err := ParseCIDRs("10.0.0.0/33"); err == nil {
+		t.Error("ParseCIDRs() of an invalid prefix error = nil")
+	}
+}
@@ -0,0 +1,196 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
+)
+
+const (
+	// headerTimeout bounds the time a remote peer takes to send the header
+	headerTimeout = 10 * time.Second
+
+	// defaultDialTimeout bounds the TCP connect to a destination
+	defaultDialTimeout = 10 * time.Second
+)
+
+// Server handles the forwarding streams that remote peers open
+type Server struct {
+	// Peer opens the streams back to the requesting peer for Listen requests
+	Peer *p2pquic.Peer
+
+	// AllowConnect reports whether a remote peer may connect to a host:port
+	// address (nil refuses all)
+	AllowConnect func(peerID, addr string) bool
+
+	// AllowListen reports whether a remote peer may have this peer listen
+	// on a host:port address (nil refuses all)
+	AllowListen func(peerID, addr string) bool
+
+	// DialTimeout bounds the TCP connect to a destination (zero means 10 seconds)
+	DialTimeout time.Duration
+
+	// Dial connects to the destination of a remote peer, for example with a
+	// net.Dialer that checks a CIDRPolicy. An error that wraps ErrRefused
+	// refuses the tunnel. Nil dials TCP.
+	Dial func(ctx context.Context, peerID, addr string) (net.Conn, error)
+
+	// Logger receives a line for every tunnel (nil discards them)
+	Logger *slog.Logger
+}
+
+// Serve handles the streams of a listener, such as the one returned by
+// Peer.StreamListener, until it fails
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// log returns the logger of the server
+func (s *Server) log() *slog.Logger {
+	if s.Logger == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+	return s.Logger
+}
+
+// handle reads the header of a stream and serves its request
+func (s *Server) handle(conn net.Conn) {
+	peerID := conn.RemoteAddr().String()
+
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	req, err := ReadRequest(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		s.log().Warn("Failed to read forwarding request", "peer_id", peerID, "err", err)
+		conn.Close()
+		return
+	}
+
+	switch req.Kind {
+	case Connect:
+		s.connect(conn, peerID, req)
+	case Listen:
+		s.listen(conn, peerID, req)
+	default:
+		writeResponse(conn, fmt.Errorf("unsupported request %s", req.Kind))
+		conn.Close()
+	}
+}
+
+// connect connects to the destination of a Connect request and relays the stream to it
+func (s *Server) connect(conn net.Conn, peerID string, req Request) {
+	log := s.log().With("peer_id", peerID, "dest", req.Addr)
+	if s.AllowConnect == nil || !s.AllowConnect(peerID, req.Addr) {
+		log.Warn("Refused tunnel: destination not allowed")
+		writeResponse(conn, fmt.Errorf("%w: %s is not allowed", ErrRefused, req.Addr))
+		conn.Close()
+		return
+	}
+
+	timeout := s.DialTimeout
+	if timeout == 0 {
+		timeout = defaultDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	target, err := s.dial(ctx, peerID, req.Addr)
+	cancel()
+	if errors.Is(err, ErrRefused) {
+		log.Warn("Refused tunnel: destination not allowed", "err", err)
+		writeResponse(conn, fmt.Errorf("%w: %s is not allowed", ErrRefused, req.Addr))
+		conn.Close()
+		return
+	}
+	if err != nil {
+		log.Warn("Failed to connect tunnel", "err", err)
+		writeResponse(conn, err)
+		conn.Close()
+		return
+	}
+	if err := writeResponse(conn, nil); err != nil {
+		target.Close()
+		conn.Close()
+		return
+	}
+
+	log = log.With("remote", target.RemoteAddr().String())
+	log.Info("Tunnel opened")
+	start := time.Now()
+	received, sent := Relay(conn, target)
+	log.Info("Tunnel closed", "sent", sent, "received", received, "duration", time.Since(start).Round(time.Millisecond))
+}
+
+// dial connects to the destination of a Connect request
+func (s *Server) dial(ctx context.Context, peerID, addr string) (net.Conn, error) {
+	if s.Dial != nil {
+		return s.Dial(ctx, peerID, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// listen listens on the address of a Listen request and tunnels every
+// connection back to the requesting peer, until the stream of the request ends
+func (s *Server) listen(conn net.Conn, peerID string, req Request) {
+	defer conn.Close()
+
+	log := s.log().With("peer_id", peerID, "addr", req.Addr, "target", req.Target)
+	if s.AllowListen == nil || !s.AllowListen(peerID, req.Addr) {
+		log.Warn("Refused remote forward: address not allowed")
+		writeResponse(conn, fmt.Errorf("%w: listening on %s is not allowed", ErrRefused, req.Addr))
+		return
+	}
+	if s.Peer == nil {
+		writeResponse(conn, fmt.Errorf("remote forwarding is not supported"))
+		return
+	}
+
+	ln, err := net.Listen("tcp", req.Addr)
+	if err != nil {
+		log.Warn("Failed to listen for remote forward", "err", err)
+		writeResponse(conn, err)
+		return
+	}
+	if err := writeResponse(conn, nil); err != nil {
+		ln.Close()
+		return
+	}
+	log.Info("Remote forward listening")
+
+	// The requesting peer keeps the stream open while it wants the forward
+	go func() {
+		io.Copy(io.Discard, conn)
+		ln.Close()
+	}()
+
+	for {
+		tcpConn, err := ln.Accept()
+		if err != nil {
+			break
+		}
+		go func() {
+			stream, err := Dial(context.Background(), s.Peer, peerID, req.Target)
+			if err != nil {
+				log.Warn("Failed to open remote forward tunnel", "err", err)
+				tcpConn.Close()
+				return
+			}
+			log.Info("Remote forward tunnel opened", "client", tcpConn.RemoteAddr().String())
+			start := time.Now()
+			sent, received := Relay(tcpConn, stream)
+			log.Info("Remote forward tunnel closed", "sent", sent, "received", received, "duration", time.Since(start).Round(time.Millisecond))
+		}()
+	}
+	log.Info("Remote forward stopped")
+}
@@ -0,0 +1,181 @@
+package forward
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
+)
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+
+	socksConnect = 0x01
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded          = 0x00
+	socksGeneralFailure     = 0x01
+	socksNotAllowed         = 0x02
+	socksHostUnreachable    = 0x04
+	socksCommandUnsupported = 0x07
+	socksAddressUnsupported = 0x08
+)
+
+// ServeSOCKS runs a SOCKS5 proxy on l that tunnels every CONNECT request
+// through a stream of its own to an exit peer, which connects to the
+// destination and applies its own policy. Host names are resolved by the
+// exit peer. Only CONNECT without authentication is supported, so l should
+// not be reachable by others. It returns when l is closed.
+func ServeSOCKS(peer *p2pquic.Peer, l net.Listener, exitPeerID string, logger *slog.Logger) error {
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	log := logger.With("peer_id", exitPeerID)
+
+	for {
+		tcpConn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveSOCKS(peer, tcpConn, exitPeerID, log.With("client", tcpConn.RemoteAddr().String()))
+	}
+}
+
+// serveSOCKS handles the handshake and the request of a SOCKS5 client
+func serveSOCKS(peer *p2pquic.Peer, tcpConn net.Conn, exitPeerID string, log *slog.Logger) {
+	tcpConn.SetDeadline(time.Now().Add(headerTimeout))
+	addr, err := readSOCKSRequest(tcpConn)
+	if err != nil {
+		log.Warn("Failed SOCKS request", "err", err)
+		tcpConn.Close()
+		return
+	}
+	log = log.With("dest", addr)
+
+	// Opening the tunnel may take longer than the header timeout (lookup,
+	// punching and handshake), so only the reply gets a deadline
+	tcpConn.SetDeadline(time.Time{})
+	stream, err := Dial(context.Background(), peer, exitPeerID, addr)
+	tcpConn.SetWriteDeadline(time.Now().Add(headerTimeout))
+	if err != nil {
+		log.Warn("Failed to open SOCKS tunnel", "err", err)
+		writeSOCKSReply(tcpConn, socksReply(err))
+		tcpConn.Close()
+		return
+	}
+	if err := writeSOCKSReply(tcpConn, socksSucceeded); err != nil {
+		stream.Close()
+		tcpConn.Close()
+		return
+	}
+	tcpConn.SetWriteDeadline(time.Time{})
+
+	log.Info("SOCKS tunnel opened")
+	start := time.Now()
+	sent, received := Relay(tcpConn, stream)
+	log.Info("SOCKS tunnel closed", "sent", sent, "received", received, "duration", time.Since(start).Round(time.Millisecond))
+}
+
+// readSOCKSRequest negotiates no authentication and reads a CONNECT
+// request, answering unsupported methods, commands and address types
+func readSOCKSRequest(rw io.ReadWriter) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := rw.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoAcceptable {
+		return "", errors.New("client requires authentication")
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(rw, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", req[0])
+	}
+
+	var host string
+	switch req[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(rw, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(rw, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(rw, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		writeSOCKSReply(rw, socksAddressUnsupported)
+		return "", fmt.Errorf("unsupported address type %d", req[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(rw, port[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socksConnect {
+		writeSOCKSReply(rw, socksCommandUnsupported)
+		return "", fmt.Errorf("unsupported command %d", req[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksReply returns the reply code for an error of Dial
+func socksReply(err error) byte {
+	switch {
+	case errors.Is(err, ErrRefused):
+		return socksNotAllowed
+	case errors.Is(err, ErrFailed):
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
+
+// writeSOCKSReply answers a request; the bound address is not known to the
+// client side of the tunnel and is sent as 0.0.0.0:0
+func writeSOCKSReply(w io.Writer, reply byte) error {
+	_, err := w.Write([]byte{socksVersion, reply, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
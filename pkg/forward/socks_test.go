@@ -0,0 +1,80 @@
+package forward
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// socksConn is a client conversation: what the client sends and what the
+// proxy answers
+type socksConn struct {
+	io.Reader
+	out bytes.Buffer
+}
+
+func (c *socksConn) Write(b []byte) (int, error) {
+	return c.out.Write(b)
+}
+
+func TestReadSOCKSRequest(t *testing.T) {
+	noAuth := []byte{socksVersion, 1, socksNoAuth}
+	request := func(cmd, atyp byte, addr ...byte) []byte {
+		return append(append([]byte{socksVersion, cmd, 0, atyp}, addr...), 0x01, 0xbb)
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  string // the destination, or empty for an error
+		reply []byte // what the proxy answers
+	}{
+		{"IPv4", append(noAuth, request(socksConnect, socksIPv4, 192, 0, 2, 1)...), "192.0.2.1:443", []byte{5, socksNoAuth}},
+		{"IPv6", append(noAuth, request(socksConnect, socksIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1)...), "[2001:db8::1]:443", []byte{5, socksNoAuth}},
+		{"domain", append(noAuth, request(socksConnect, socksDomain, append([]byte{11}, "example.com"...)...)...), "example.com:443", []byte{5, socksNoAuth}},
+		{"no auth among methods", append([]byte{socksVersion, 2, 0x02, socksNoAuth}, request(socksConnect, socksIPv4, 192, 0, 2, 1)...), "192.0.2.1:443", []byte{5, socksNoAuth}},
+		{"SOCKS4", []byte{4, 1, 0, 80, 192, 0, 2, 1, 0}, "", nil},
+		{"authentication required", []byte{socksVersion, 1, 0x02}, "", []byte{5, socksNoAcceptable}},
+		{"BIND", append(noAuth, request(0x02, socksIPv4, 192, 0, 2, 1)...), "", []byte{5, socksNoAuth, 5, socksCommandUnsupported, 0, socksIPv4, 0, 0, 0, 0, 0, 0}},
+		{"unknown address type", append(noAuth, request(socksConnect, 0x05)...), "", []byte{5, socksNoAuth, 5, socksAddressUnsupported, 0, socksIPv4, 0, 0, 0, 0, 0, 0}},
+		{"truncated", append(noAuth, socksVersion, socksConnect, 0, socksIPv4, 192), "", []byte{5, socksNoAuth}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &socksConn{Reader: bytes.NewReader(tt.input)}
+			got, err := readSOCKSRequest(conn)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("readSOCKSRequest() = %q, want an error", got)
+				}
+			} else if err != nil || got != tt.want {
+				t.Fatalf("readSOCKSRequest() = %q, %v, want %q", got, err, tt.want)
+			}
+			if !bytes.Equal(conn.out.Bytes(), tt.reply) {
+				t.Errorf("answered % x, want % x", conn.out.Bytes(), tt.reply)
+			}
+		})
+	}
+}
+
+func TestSOCKSReply(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"refused", ErrRefused, socksNotAllowed},
+		{"failed", ErrFailed, socksHostUnreachable},
+		{"other", errors.New("no route to peer"), socksGeneralFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := socksReply(tt.err); got != tt.want {
+				t.Errorf("socksReply() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package p2pquic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// PeerReflexiveCandidate is a remote address that was learned from
+	// punches or an incoming connection, but never registered
+	PeerReflexiveCandidate CandidateType = "prflx"
+
+	// maxPendingAccepts is the number of verified connections that wait for
+	// Accept or AcceptFrom, the oldest one is closed beyond it
+	maxPendingAccepts = 32
+
+	// identityErrorCode closes a connection whose peer ID could not be verified
+	identityErrorCode quic.ApplicationErrorCode = 0x2
+)
+
+// CandidatePair is the local and the remote candidate that a connection uses
+type CandidatePair struct {
+	Local  Candidate
+	Remote Candidate
+}
+
+// Conn is a QUIC connection to a remote peer whose peer ID was verified
+// against the certificate fingerprint it registered with signaling
+type Conn struct {
+	*quic.Conn
+
+	remotePeerID string
+	verified     bool
+	times        ConnectTimes
+
+	mu         sync.Mutex
+	pair       CandidatePair // the local candidate changes with migrations
+	migrations int
+}
+
+// RemotePeerID returns the peer ID of the remote peer
+func (c *Conn) RemotePeerID() string {
+	return c.remotePeerID
+}
+
+// Verified reports whether the remote certificate matched the fingerprint
+// registered for the peer ID. Accepted connections are always verified,
+// connections dialed with WithCandidates only when WithFingerprint is given.
+func (c *Conn) Verified() bool {
+	return c.verified
+}
+
+// CandidatePair returns the local and remote candidate of the connection
+func (c *Conn) CandidatePair() CandidatePair {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pair
+}
+
+// HandshakeDuration returns how long the QUIC handshake took. For accepted
+// connections it is measured from the first packet of the remote peer.
+func (c *Conn) HandshakeDuration() time.Duration {
+	return c.times.Handshake
+}
+
+// migrated records a switch to a new local candidate
+func (c *Conn) migrated(local Candidate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pair.Local = local
+	c.migrations++
+}
+
+// handshakeStartKey is the context key of the time an incoming connection started
+type handshakeStartKey struct{}
+
+// connContext stores the start time, and the qlog file if qlog is enabled,
+// in the context of incoming connections
+func (p *Peer) connContext(ctx context.Context, _ *quic.ClientInfo) (context.Context, error) {
+	ctx = context.WithValue(ctx, handshakeStartKey{}, time.Now())
+	if p.config.QlogDir != "" {
+		ctx = context.WithValue(ctx, qlogFileKey{}, &qlogFile{})
+	}
+	return ctx, nil
+}
+
+// Accept accepts the next incoming connection whose remote peer ID was verified
+func (p *Peer) Accept(ctx context.Context) (*Conn, error) {
+	return p.accept(ctx, "")
+}
+
+// AcceptFrom accepts the next incoming connection from a specific peer.
+// Connections from other peers stay queued for Accept.
+func (p *Peer) AcceptFrom(ctx context.Context, remotePeerID string) (*Conn, error) {
+	return p.accept(ctx, remotePeerID)
+}
+
+// accept takes the first pending connection from remotePeerID (any peer if
+// empty), waiting until one arrives, ctx is done or the listener is closed
+func (p *Peer) accept(ctx context.Context, remotePeerID string) (*Conn, error) {
+	if p.ctx.Err() != nil {
+		return nil, ErrPeerClosed
+	}
+	if p.quicListener.Load() == nil {
+		return nil, fmt.Errorf("peer is not listening, call Listen first")
+	}
+
+	for {
+		p.acceptMu.Lock()
+		// Connections replaced by a newer one while queued are skipped
+		p.accepted = slices.DeleteFunc(p.accepted, func(c *Conn) bool { return c.Context().Err() != nil })
+		for i, conn := range p.accepted {
+			if remotePeerID == "" || conn.remotePeerID == remotePeerID {
+				p.accepted = append(p.accepted[:i], p.accepted[i+1:]...)
+				p.acceptMu.Unlock()
+				p.conns.touch(conn)
+				return conn, nil
+			}
+		}
+		err, notify := p.acceptErr, p.acceptNotify
+		p.acceptMu.Unlock()
+
+		if err != nil {
+			return nil, p.closedErr(err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+// acceptLoop accepts connections from the listener and verifies them until
+// the listener is closed
+func (p *Peer) acceptLoop(listener *quic.Listener) {
+	for {
+		conn, err := listener.Accept(p.ctx)
+		if err != nil {
+			p.acceptMu.Lock()
+			p.acceptErr = err
+			close(p.acceptNotify)
+			p.acceptNotify = make(chan struct{})
+			p.acceptMu.Unlock()
+			return
+		}
+		go p.verifyIncoming(conn)
+	}
+}
+
+// verifyIncoming checks the peer ID of an incoming connection and queues it
+// for Accept, or closes it when the identity does not match
+func (p *Peer) verifyIncoming(qconn *quic.Conn) {
+	remotePeerID, err := p.verifyClient(qconn)
+	if err != nil {
+		p.log.Warn("Rejected connection", "addr", qconn.RemoteAddr().String(), "err", err)
+		qconn.CloseWithError(identityErrorCode, "peer identity not verified")
+		return
+	}
+	p.renameQlog(qconn, remotePeerID)
+
+	conn := &Conn{
+		Conn:         qconn,
+		remotePeerID: remotePeerID,
+		verified:     true,
+	}
+	if start, ok := qconn.Context().Value(handshakeStartKey{}).(time.Time); ok {
+		conn.times.Handshake = time.Since(start)
+	}
+	remote := p.punches.remoteCandidate(remotePeerID, qconn.RemoteAddr())
+	conn.pair = CandidatePair{Local: p.localCandidateFor(remote), Remote: remote}
+
+	p.stopBurst(remotePeerID)
+
+	if qconn.ConnectionState().TLS.NegotiatedProtocol == HTTP3ALPN {
+		p.serveHTTP3(conn)
+		return
+	}
+
+	// A duplicate of an existing connection to the peer is closed by the
+	// connection manager and not handed to Accept
+	if _, kept := p.conns.add(conn, false); !kept {
+		return
+	}
+
+	p.acceptMu.Lock()
+	p.accepted = append(p.accepted, conn)
+	if len(p.accepted) > maxPendingAccepts {
+		p.accepted[0].CloseWithError(closeErrorCode, "too many pending connections")
+		p.accepted = p.accepted[1:]
+	}
+	close(p.acceptNotify)
+	p.acceptNotify = make(chan struct{})
+	p.acceptMu.Unlock()
+}
+
+// localCandidateFor returns the local candidate that pairs with a remote
+// candidate: a host candidate for a host candidate in the same subnet,
+// otherwise the server-reflexive candidate if there is one
+func (p *Peer) localCandidateFor(remote Candidate) Candidate {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var host, reflexive *Candidate
+	remoteIP := net.ParseIP(remote.IP)
+	for i, c := range p.candidates {
+		switch c.Type {
+		case HostCandidate:
+			if host == nil || sameSubnet(c.IP, remoteIP) {
+				host = &p.candidates[i]
+			}
+		case ServerReflexiveCandidate:
+			if reflexive == nil {
+				reflexive = &p.candidates[i]
+			}
+		}
+	}
+
+	switch {
+	case remote.Type == HostCandidate && host != nil:
+		return *host
+	case reflexive != nil:
+		return *reflexive
+	case host != nil:
+		return *host
+	}
+	return Candidate{IP: net.IPv4zero.String(), Port: p.GetActualPort(), Type: HostCandidate}
+}
+
+// sameSubnet reports whether ip is in the subnet of the local interface address localIP
+func sameSubnet(localIP string, ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil || ip == nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.String() == localIP {
+			return ipnet.Contains(ip)
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package p2pquic
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrPeerClosed is returned by calls on a Peer that was closed, including
+	// calls that were in progress when Close was called
+	ErrPeerClosed = errors.New("peer closed")
+
+	// ErrPeerNotFound means the remote peer is not registered with signaling
+	// (or its registration expired)
+	ErrPeerNotFound = errors.New("peer not found")
+
+	// ErrNoCandidates means there are no candidates to register or to dial
+	ErrNoCandidates = errors.New("no candidates")
+
+	// ErrAllCandidatesFailed means no candidate of the remote peer could be
+	// reached, errors.As with *AllCandidatesFailedError gives the error of
+	// every candidate
+	ErrAllCandidatesFailed = errors.New("all candidates failed")
+
+	// ErrSignalingUnavailable means the signaling server could not be reached
+	// or answered with a server error or rate limit, the request can be retried
+	ErrSignalingUnavailable = errors.New("signaling server unavailable")
+
+	// ErrIdentityMismatch means the certificate of the remote peer does not
+	// match its peer ID or its registered fingerprint
+	ErrIdentityMismatch = errors.New("peer identity mismatch")
+)
+
+// CandidateError is the failure of one candidate of a remote peer
+type CandidateError struct {
+	Candidate Candidate
+	Err       error
+}
+
+// Error returns the candidate address with its error
+func (e CandidateError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.Candidate.IP, e.Candidate.Port, e.Err)
+}
+
+// Unwrap returns the error of the candidate
+func (e CandidateError) Unwrap() error {
+	return e.Err
+}
+
+// AllCandidatesFailedError is returned by Connect when neither hole punching
+// nor dialing succeeded for any candidate of the remote peer. It matches
+// ErrAllCandidatesFailed and the errors of the individual candidates.
+type AllCandidatesFailedError struct {
+	PeerID     string
+	Candidates []CandidateError
+}
+
+// Error lists the error of every candidate
+func (e *AllCandidatesFailedError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "no candidate of %s could be reached", e.PeerID)
+	for i, c := range e.Candidates {
+		if i == 0 {
+			b.WriteString(": ")
+		} else {
+			b.WriteString("; ")
+		}
+		b.WriteString(c.Error())
+	}
+	return b.String()
+}
+
+// Is reports whether target is ErrAllCandidatesFailed
+func (e *AllCandidatesFailedError) Is(target error) bool {
+	return target == ErrAllCandidatesFailed
+}
+
+// Unwrap returns the errors of the candidates
+func (e *AllCandidatesFailedError) Unwrap() []error {
+	errs := make([]error, len(e.Candidates))
+	for i, c := range e.Candidates {
+		errs[i] = c
+	}
+	return errs
+}
+
+// SignalingError is a request to the signaling server that was answered
+// with an error status. A 404 matches ErrPeerNotFound, a 429 or 5xx matches
+// ErrSignalingUnavailable.
+type SignalingError struct {
+	Op         string // "registration", "lookup", ...
+	StatusCode int
+	Message    string // response body
+}
+
+// Error returns the operation, status and message of the server
+func (e *SignalingError) Error() string {
+	return fmt.Sprintf("%s failed: %d %s: %s", e.Op, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is maps the status code to ErrPeerNotFound or ErrSignalingUnavailable
+func (e *SignalingError) Is(target error) bool {
+	switch target {
+	case ErrPeerNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrSignalingUnavailable:
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+	}
+	return false
+}
+
+// closedErr returns ErrPeerClosed once the peer is closed, and err otherwise
+func (p *Peer) closedErr(err error) error {
+	if err != nil && p.ctx.Err() != nil {
+		return ErrPeerClosed
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package p2pquic
+
+import (
+	"net"
+	"time"
+)
+
+// EventType identifies a step of NAT traversal or the connection lifecycle
+type EventType string
+
+const (
+	// EventCandidateDiscovered is a local or server-reflexive candidate found
+	// by DiscoverCandidates, after a network change or by the keepalive
+	EventCandidateDiscovered EventType = "candidate_discovered"
+
+	// EventSTUNResult is the outcome of a STUN binding, with the
+	// server-reflexive candidate or the error, and the round-trip time
+	EventSTUNResult EventType = "stun_result"
+
+	// EventRegistered is the outcome of a registration with signaling
+	EventRegistered EventType = "registered"
+
+	// EventPunchSent is a punch packet sent to a candidate of a remote peer
+	EventPunchSent EventType = "punch_sent"
+
+	// EventPunchReceived is an authenticated punch request or reply from a remote peer
+	EventPunchReceived EventType = "punch_received"
+
+	// EventDialStarted is a QUIC dial to a candidate of a remote peer
+	EventDialStarted EventType = "dial_started"
+
+	// EventDialFailed is a QUIC dial that failed, with the error and how long it took
+	EventDialFailed EventType = "dial_failed"
+
+	// EventDialSucceeded is a QUIC dial that succeeded, with the handshake duration
+	EventDialSucceeded EventType = "dial_succeeded"
+
+	// EventConnectionClosed is a connection to a remote peer that was closed,
+	// with the cause and how long it was open
+	EventConnectionClosed EventType = "connection_closed"
+
+	// EventPathMigrated is an outgoing connection that moved to a new path
+	// after a network change, or failed to, with the probe duration
+	EventPathMigrated EventType = "path_migrated"
+)
+
+// Event is a step of NAT traversal or of the lifecycle of a connection, as
+// delivered to Config.OnEvent
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// PeerID is the remote peer, empty for events about the local peer
+	PeerID string
+
+	// Candidate is the candidate the event is about, if any: the local
+	// candidate for discovery, STUN and path migration, the remote candidate
+	// otherwise
+	Candidate Candidate
+
+	// Duration is how long the step took: the STUN round trip, the
+	// registration, the dial, the path probe, or the lifetime of a closed connection
+	Duration time.Duration
+
+	// Err is the error of a failed step, or the cause of a closed connection
+	Err error
+}
+
+// emit delivers an event to Config.OnEvent, if set
+func (p *Peer) emit(e Event) {
+	if p.config.OnEvent == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	p.config.OnEvent(e)
+}
+
+// emitCandidates emits EventCandidateDiscovered for every candidate
+func (p *Peer) emitCandidates(candidates []Candidate) {
+	for _, c := range candidates {
+		p.emit(Event{Type: EventCandidateDiscovered, Candidate: c})
+	}
+}
+
+// candidateOf returns the candidate of a UDP address with an unknown type
+func candidateOf(addr *net.UDPAddr) Candidate {
+	return Candidate{IP: addr.IP.String(), Port: addr.Port}
+}
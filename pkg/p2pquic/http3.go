@@ -0,0 +1,230 @@
+package p2pquic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// HTTP3ALPN is the ALPN of HTTP/3 connections between peers. They are
+	// separate from the connection of Connect and Accept, whose streams
+	// belong to the application.
+	HTTP3ALPN = "p2pquic-h3"
+
+	// HostSuffix is the suffix of the host names that address a peer in
+	// URLs, as in https://bob.p2p/
+	HostSuffix = ".p2p"
+)
+
+// ErrNotPeerHost is returned by HTTPTransport for a URL whose host does not end in HostSuffix
+var ErrNotPeerHost = errors.New("host is not a peer")
+
+// httpPeerIDKey is the context key of the peer ID of an HTTP/3 connection
+type httpPeerIDKey struct{}
+
+// ServeHTTP3 serves the HTTP/3 requests of remote peers with handler until
+// the peer is closed, or http.DefaultServeMux if handler is nil. The
+// RemoteAddr of a request is the verified peer ID of the client.
+func (p *Peer) ServeHTTP3(handler http.Handler) error {
+	if err := p.Listen(); err != nil {
+		return err
+	}
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+
+	server := &http3.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if peerID, ok := r.Context().Value(httpPeerIDKey{}).(string); ok {
+				r.RemoteAddr = peerID
+			}
+			handler.ServeHTTP(w, r)
+		}),
+		ConnContext: func(ctx context.Context, c *quic.Conn) context.Context {
+			return context.WithValue(ctx, httpPeerIDKey{}, c.ConnectionState().TLS.PeerCertificates[0].Subject.CommonName)
+		},
+		Logger: p.log,
+	}
+	if !p.httpServer.CompareAndSwap(nil, server) {
+		return errors.New("already serving HTTP/3")
+	}
+	defer p.httpServer.CompareAndSwap(server, nil)
+
+	<-p.done
+	server.Close()
+	return ErrPeerClosed
+}
+
+// serveHTTP3 serves a verified incoming HTTP/3 connection, or closes it when
+// the peer does not serve HTTP/3
+func (p *Peer) serveHTTP3(conn *Conn) {
+	server := p.httpServer.Load()
+	if server == nil {
+		p.log.Info("Refused HTTP/3 connection: not serving HTTP/3", "peer_id", conn.remotePeerID)
+		conn.CloseWithError(closeErrorCode, "not serving HTTP/3")
+		return
+	}
+	go func() {
+		if err := server.ServeQUICConn(conn.Conn); err != nil && conn.Context().Err() == nil {
+			p.log.Warn("Failed to serve HTTP/3", "peer_id", conn.remotePeerID, "err", err)
+		}
+	}()
+}
+
+// peerIDFromHost returns the peer ID of a "<peer ID>.p2p" host, with or without port
+func peerIDFromHost(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if len(host) <= len(HostSuffix) || !strings.EqualFold(host[len(host)-len(HostSuffix):], HostSuffix) {
+		return "", false
+	}
+	return host[:len(host)-len(HostSuffix)], true
+}
+
+// httpClient is the HTTP/3 connection to one remote peer, or the dial of it
+type httpClient struct {
+	ready chan struct{} // closed when the dial finished
+	conn  *Conn
+	cc    *http3.ClientConn
+	err   error
+}
+
+// HTTPTransport is an http.RoundTripper that sends the requests for
+// "<peer ID>.p2p" hosts over HTTP/3 to the peer. It dials one connection per
+// remote peer with hole punching, and dials again once it is closed. It is
+// safe for concurrent use.
+type HTTPTransport struct {
+	peer      *Peer
+	transport http3.Transport
+
+	mu      sync.Mutex
+	clients map[string]*httpClient // by remote peer ID
+	closed  bool
+}
+
+// HTTPTransport returns a transport for requests to remote peers, for use
+// as http.Client.Transport
+func (p *Peer) HTTPTransport() *HTTPTransport {
+	return &HTTPTransport{
+		peer:      p,
+		transport: http3.Transport{Logger: p.log},
+		clients:   make(map[string]*httpClient),
+	}
+}
+
+// RoundTrip sends a request to the peer named by its host. Both http and
+// https URLs are sent over the encrypted HTTP/3 connection.
+func (t *HTTPTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	peerID, ok := peerIDFromHost(req.URL.Host)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q does not end in %s", ErrNotPeerHost, req.URL.Host, HostSuffix)
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported protocol scheme %q", req.URL.Scheme)
+	}
+
+	cc, err := t.client(req.Context(), peerID)
+	if err != nil {
+		return nil, err
+	}
+	return cc.RoundTrip(req)
+}
+
+// client returns the live HTTP/3 connection to a remote peer, waits for a
+// dial to it that is in progress, or dials a new connection
+func (t *HTTPTransport) client(ctx context.Context, remotePeerID string) (*http3.ClientConn, error) {
+	for {
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		c, ok := t.clients[remotePeerID]
+		if !ok {
+			c = &httpClient{ready: make(chan struct{})}
+			t.clients[remotePeerID] = c
+			t.mu.Unlock()
+			t.dial(ctx, remotePeerID, c)
+		} else {
+			t.mu.Unlock()
+		}
+
+		select {
+		case <-c.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if c.err != nil {
+			// The dial was bounded by the context of another request
+			if isContextErr(c.err) && ctx.Err() == nil {
+				continue
+			}
+			return nil, c.err
+		}
+		if c.conn.Context().Err() == nil {
+			return c.cc, nil
+		}
+
+		t.mu.Lock()
+		if t.clients[remotePeerID] == c {
+			delete(t.clients, remotePeerID)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// dial connects to a remote peer with the HTTP/3 ALPN until ctx is done,
+// after the dials of Connect to the same peer, and finishes c
+func (t *HTTPTransport) dial(ctx context.Context, remotePeerID string, c *httpClient) {
+	defer close(c.ready)
+
+	conn, err := t.peer.conns.dialOther(ctx, remotePeerID, func() (*Conn, error) {
+		return t.peer.dial(remotePeerID, &connectConfig{alpn: HTTP3ALPN, ctx: ctx}, nil)
+	})
+	if err != nil {
+		t.mu.Lock()
+		if t.clients[remotePeerID] == c {
+			delete(t.clients, remotePeerID)
+		}
+		t.mu.Unlock()
+		c.err = err
+		return
+	}
+
+	t.mu.Lock()
+	closed := t.closed
+	t.mu.Unlock()
+	if closed {
+		conn.CloseWithError(closeErrorCode, "closed")
+		c.err = net.ErrClosed
+		return
+	}
+	c.conn = conn
+	c.cc = t.transport.NewClientConn(conn.Conn)
+}
+
+// Close closes the HTTP/3 connections of the transport
+func (t *HTTPTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	clients := t.clients
+	t.clients = make(map[string]*httpClient)
+	t.mu.Unlock()
+
+	for _, c := range clients {
+		<-c.ready
+		if c.conn != nil {
+			c.conn.CloseWithError(closeErrorCode, "closed")
+		}
+	}
+	return nil
+}
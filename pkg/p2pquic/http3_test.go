@@ -0,0 +1,81 @@
+package p2pquic
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPeerIDFromHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+		ok   bool
+	}{
+		{"bob.p2p", "bob", true},
+		{"bob.p2p:443", "bob", true},
+		{"BOB.P2P", "BOB", true},
+		{"sensor.1.p2p", "sensor.1", true},
+		{".p2p", "", false},
+		{"p2p", "", false},
+		{"bob.example.com", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got, ok := peerIDFromHost(tt.host)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("peerIDFromHost(%q) = %q, %v, want %q, %v", tt.host, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHTTP3(t *testing.T) {
+	signaling := newTestSignaling(t)
+	alice := newTestPeer(t, "alice", signaling.URL)
+	bob := newTestPeer(t, "bob", signaling.URL)
+
+	go alice.ServeHTTP3(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr+" "+r.URL.Path)
+	}))
+	deadline := time.Now().Add(time.Second)
+	for alice.httpServer.Load() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("ServeHTTP3() did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	transport := bob.HTTPTransport()
+	defer transport.Close()
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	// The connection is shared by the requests to the same peer
+	for range 2 {
+		resp, err := client.Get("https://alice.p2p/hello")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The handler sees the verified peer ID of the client
+		if string(body) != "bob /hello" {
+			t.Fatalf("body = %q, want %q", body, "bob /hello")
+		}
+	}
+
+	// HTTP/3 connections are not kept by the connection manager
+	if conns := bob.Conns(); len(conns) != 0 {
+		t.Errorf("Conns() = %d connections, want none", len(conns))
+	}
+
+	if _, err := client.Get("https://example.com/"); !errors.Is(err, ErrNotPeerHost) {
+		t.Errorf("Get() of another host error = %v, want ErrNotPeerHost", err)
+	}
+}
@@ -0,0 +1,130 @@
+package p2pquic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// peerALPN is the ALPN of the connections of Connect and Accept
+const peerALPN = "p2pquic"
+
+// generateTLSConfig creates a self-signed certificate for QUIC with the peer
+// ID as common name, and returns it with the fingerprint that is registered
+// with signaling. Peers send the certificate in both directions, and check
+// the certificate of the other side against its registered fingerprint.
+func generateTLSConfig(peerID string) (*tls.Config, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: peerID},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		panic(err)
+	}
+
+	fingerprint := sha256.Sum256(certDER)
+	return &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+		// Certificates are self-signed, the identity is checked against the
+		// fingerprint from signaling instead of a certificate authority
+		InsecureSkipVerify: true,
+		ClientAuth:         tls.RequireAnyClientCert,
+		NextProtos:         []string{peerALPN, HTTP3ALPN},
+	}, fingerprint[:]
+}
+
+// checkIdentity checks that a certificate names the expected peer and, if a
+// fingerprint is known, that it is the registered certificate
+func checkIdentity(cert []byte, peerID string, fingerprint []byte) error {
+	parsed, err := x509.ParseCertificate(cert)
+	if err != nil {
+		return err
+	}
+	if parsed.Subject.CommonName != peerID {
+		return fmt.Errorf("%w: certificate is for peer %q, not %q", ErrIdentityMismatch, parsed.Subject.CommonName, peerID)
+	}
+	if len(fingerprint) > 0 {
+		actual := sha256.Sum256(cert)
+		if !bytes.Equal(actual[:], fingerprint) {
+			return fmt.Errorf("%w: certificate of peer %q does not match its registered fingerprint", ErrIdentityMismatch, peerID)
+		}
+	}
+	return nil
+}
+
+// dialTLSConfig returns the TLS configuration for dialing a remote peer with
+// an ALPN, which checks the remote certificate against its peer ID and fingerprint
+func (p *Peer) dialTLSConfig(remotePeerID string, fingerprint []byte, alpn string) *tls.Config {
+	cfg := p.tlsConfig.Clone()
+	cfg.NextProtos = []string{alpn}
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no certificate")
+		}
+		return checkIdentity(rawCerts[0], remotePeerID, fingerprint)
+	}
+	return cfg
+}
+
+// verifyClient returns the peer ID of an incoming connection after checking
+// the client certificate against the fingerprint the peer registered. The
+// fingerprint is known from its connection request, or looked up with signaling.
+func (p *Peer) verifyClient(conn *quic.Conn) (string, error) {
+	certs := conn.ConnectionState().TLS.PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.New("no client certificate")
+	}
+	peerID := certs[0].Subject.CommonName
+	if peerID == "" {
+		return "", errors.New("client certificate has no peer ID")
+	}
+
+	// A peer that restarted has a new certificate, so a mismatch with the
+	// known fingerprint is checked against signaling again
+	if fingerprint := p.punches.fingerprint(peerID); len(fingerprint) > 0 {
+		if err := checkIdentity(certs[0].Raw, peerID, fingerprint); err == nil {
+			return peerID, nil
+		}
+	}
+
+	info, err := p.signaling().GetPeer(peerID)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up peer %q: %w", peerID, err)
+	}
+	if len(info.Fingerprint) == 0 {
+		return "", fmt.Errorf("%w: peer %q registered no certificate fingerprint", ErrIdentityMismatch, peerID)
+	}
+	if err := checkIdentity(certs[0].Raw, peerID, info.Fingerprint); err != nil {
+		return "", err
+	}
+	p.punches.setPeer(info)
+	return peerID, nil
+}
@@ -0,0 +1,164 @@
+package p2pquic
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/internal/ratelimit"
+)
+
+const (
+	// defaultPunchRate is the default limit of punch packets per second in total
+	defaultPunchRate = 200
+
+	// defaultPunchRatePerDestination is the default limit of punch packets per second to one address
+	defaultPunchRatePerDestination = 10
+
+	// maxPunchCandidates is the maximum number of addresses punched per remote peer
+	maxPunchCandidates = 16
+
+	// maxUnansweredPunches is the number of punches sent to an address that
+	// never sent anything back before we stop punching it. The count is kept
+	// across connection attempts, and one punch burst can reach it.
+	maxUnansweredPunches = 20
+
+	// unansweredCooldown is how long an address that never answered is not
+	// punched, and how long a partial count of unanswered punches is kept
+	unansweredCooldown = time.Minute
+
+	// broadcastRefreshInterval is how often the local broadcast addresses are refreshed
+	broadcastRefreshInterval = time.Minute
+)
+
+var (
+	// errPunchRefused is wrapped by all errors for punches that were not sent
+	errPunchRefused = errors.New("punch refused")
+
+	errPunchAddress    = fmt.Errorf("%w: not a unicast address", errPunchRefused)
+	errPunchCandidates = fmt.Errorf("%w: too many candidates", errPunchRefused)
+	errPunchRate       = fmt.Errorf("%w: rate limited", errPunchRefused)
+	errPunchUnanswered = fmt.Errorf("%w: destination never answered", errPunchRefused)
+)
+
+// PunchStats counts the hole-punching traffic exchanged with a remote peer
+type PunchStats struct {
+	// Sent is the number of punch requests sent
+	Sent int
+
+	// Received is the number of valid punch requests received
+	Received int
+
+	// Replies is the number of valid replies received
+	Replies int
+
+	// RefusedAddress counts punches refused because the destination is not a
+	// unicast address (unspecified, multicast or broadcast)
+	RefusedAddress int
+
+	// RefusedCandidates counts punches refused because the peer has more
+	// than 16 candidate addresses
+	RefusedCandidates int
+
+	// RefusedRate counts punches and replies refused by the rate limits
+	RefusedRate int
+
+	// RefusedUnanswered counts punches refused because the destination never
+	// answered the previous 20 punches, for a minute after the last of them
+	RefusedUnanswered int
+}
+
+// count records a refused punch in the statistics
+func (s *PunchStats) count(err error) {
+	switch err {
+	case errPunchAddress:
+		s.RefusedAddress++
+	case errPunchCandidates:
+		s.RefusedCandidates++
+	case errPunchRate:
+		s.RefusedRate++
+	case errPunchUnanswered:
+		s.RefusedUnanswered++
+	}
+}
+
+// punchLimits enforces the total and per-destination punch rates
+type punchLimits struct {
+	total       *ratelimit.Limiter
+	destination *ratelimit.Limiter
+}
+
+// newPunchLimits creates the punch rate limits from the config, with bursts
+// of up to one second worth of packets
+func newPunchLimits(config Config) *punchLimits {
+	total, perDestination := config.PunchRate, config.PunchRatePerDestination
+	if total <= 0 {
+		total = defaultPunchRate
+	}
+	if perDestination <= 0 {
+		perDestination = defaultPunchRatePerDestination
+	}
+	return &punchLimits{
+		total:       ratelimit.New(float64(total), total),
+		destination: ratelimit.New(float64(perDestination), perDestination),
+	}
+}
+
+// allow reports whether a packet may be sent to addr now
+func (l *punchLimits) allow(addr *net.UDPAddr) bool {
+	return l.destination.Allow(addr.String()) && l.total.Allow("")
+}
+
+// broadcastCache caches the directed broadcast addresses of the local networks
+type broadcastCache struct {
+	mu      sync.Mutex
+	addrs   []net.IP
+	updated time.Time
+}
+
+// isBroadcast reports whether ip is the broadcast address of a local network
+func (c *broadcastCache) isBroadcast(ip net.IP) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.updated) > broadcastRefreshInterval {
+		c.addrs = c.addrs[:0]
+		c.updated = time.Now()
+		if ifaceAddrs, err := net.InterfaceAddrs(); err == nil {
+			for _, a := range ifaceAddrs {
+				ipnet, ok := a.(*net.IPNet)
+				if !ok || ipnet.IP.To4() == nil || len(ipnet.Mask) != net.IPv4len {
+					continue
+				}
+				ones, bits := ipnet.Mask.Size()
+				if bits-ones < 2 {
+					continue // point-to-point and /31 networks have no broadcast address
+				}
+				bcast := make(net.IP, net.IPv4len)
+				for i, b := range ipnet.IP.To4() {
+					bcast[i] = b | ^ipnet.Mask[i]
+				}
+				c.addrs = append(c.addrs, bcast)
+			}
+		}
+	}
+
+	for _, bcast := range c.addrs {
+		if ip.Equal(bcast) {
+			return true
+		}
+	}
+	return false
+}
+
+// validPunchAddr reports whether addr may receive punch packets: a unicast
+// address (not unspecified, multicast or broadcast) with a non-zero port
+func (c *broadcastCache) validPunchAddr(addr *net.UDPAddr) bool {
+	ip := addr.IP
+	if ip == nil || ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) || addr.Port == 0 {
+		return false
+	}
+	return !c.isBroadcast(ip)
+}
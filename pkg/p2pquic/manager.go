@@ -0,0 +1,349 @@
+package p2pquic
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// simultaneousOpenWindow is how close in time two connections between the
+	// same peers must be established to count as a simultaneous open. Outside
+	// of it the newer connection replaces the older one, which is probably
+	// stale after a restart of the remote peer.
+	simultaneousOpenWindow = 10 * time.Second
+
+	// maxIdleCheckInterval bounds the time between two idle checks
+	maxIdleCheckInterval = 10 * time.Second
+
+	// idleBytesPerCheck is the traffic per idle check that a connection
+	// carrying only keepalives stays below
+	idleBytesPerCheck = 512
+
+	// duplicateErrorCode closes the losing connection of a simultaneous open
+	duplicateErrorCode quic.ApplicationErrorCode = 0x3
+
+	// idleErrorCode closes connections that were idle for too long
+	idleErrorCode quic.ApplicationErrorCode = 0x4
+
+	// limitErrorCode refuses incoming connections beyond Config.MaxConnections
+	limitErrorCode quic.ApplicationErrorCode = 0x5
+)
+
+// ErrTooManyConnections is returned by Connect when Config.MaxConnections is reached
+var ErrTooManyConnections = errors.New("too many connections")
+
+// managedConn is the live connection to one remote peer
+type managedConn struct {
+	conn        *Conn
+	dialer      string // peer ID of the side that dialed
+	established time.Time
+	lastActive  time.Time
+	lastBytes   uint64
+}
+
+// pendingDial is a Connect in progress that other callers for the same peer
+// wait for, or a dial of another protocol that later dials wait for
+type pendingDial struct {
+	done chan struct{}
+	err  error
+}
+
+// connManager keeps at most one live connection per remote peer, shares it
+// between callers, and evicts connections that stay idle
+type connManager struct {
+	localID     string
+	log         *slog.Logger
+	emit        func(Event)
+	max         int
+	idleTimeout time.Duration
+
+	mu     sync.Mutex
+	conns  map[string]*managedConn // by remote peer ID
+	dials  map[string]*pendingDial // by remote peer ID
+	others map[string]*pendingDial // dials of other protocols, by remote peer ID
+	notify chan struct{}           // closed and replaced when a connection is stored
+}
+
+// newConnManager creates a connection manager with the limits of the config
+// that reports closed connections to emit
+func newConnManager(config Config, emit func(Event)) *connManager {
+	return &connManager{
+		localID:     config.PeerID,
+		log:         config.Logger,
+		emit:        emit,
+		max:         config.MaxConnections,
+		idleTimeout: config.IdleConnTimeout,
+		conns:       make(map[string]*managedConn),
+		dials:       make(map[string]*pendingDial),
+		others:      make(map[string]*pendingDial),
+		notify:      make(chan struct{}),
+	}
+}
+
+// connect returns the live connection to a remote peer, waits for a dial to
+// it that is in progress, or dials a new connection. Waiting ends when ctx is
+// done; a dial in progress that was canceled by the ctx of its caller is
+// dialed again.
+func (m *connManager) connect(ctx context.Context, remotePeerID string, dial func() (*Conn, error)) (*Conn, error) {
+	m.mu.Lock()
+	for {
+		if mc := m.live(remotePeerID); mc != nil {
+			mc.lastActive = time.Now()
+			m.mu.Unlock()
+			return mc.conn, nil
+		}
+		// A dial of another protocol is waited for without sharing its error
+		other, shared := m.others[remotePeerID]
+		pending, ok := m.dials[remotePeerID]
+		if shared {
+			pending = other
+		} else if !ok {
+			break
+		}
+		m.mu.Unlock()
+		select {
+		case <-pending.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !shared && pending.err != nil && !isContextErr(pending.err) {
+			return nil, pending.err
+		}
+		m.mu.Lock()
+	}
+
+	if m.max > 0 && len(m.conns)+len(m.dials) >= m.max {
+		m.mu.Unlock()
+		return nil, ErrTooManyConnections
+	}
+	pending := &pendingDial{done: make(chan struct{})}
+	m.dials[remotePeerID] = pending
+	m.mu.Unlock()
+
+	conn, err := dial()
+	if err == nil {
+		conn, _ = m.add(conn, true)
+	}
+
+	m.mu.Lock()
+	delete(m.dials, remotePeerID)
+	m.mu.Unlock()
+	pending.err = err
+	close(pending.done)
+
+	return conn, err
+}
+
+// isContextErr reports whether err is the error of a canceled or expired context
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// dialOther dials a connection of another protocol that the manager does
+// not keep, such as HTTP/3, once the dials to the same peer in progress are
+// done, and makes later dials wait for it, so the peer is not punched by two
+// dials at the same time.
+func (m *connManager) dialOther(ctx context.Context, remotePeerID string, dial func() (*Conn, error)) (*Conn, error) {
+	m.mu.Lock()
+	for {
+		pending, ok := m.dials[remotePeerID]
+		if !ok {
+			pending, ok = m.others[remotePeerID]
+		}
+		if !ok {
+			break
+		}
+		m.mu.Unlock()
+		select {
+		case <-pending.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		m.mu.Lock()
+	}
+	pending := &pendingDial{done: make(chan struct{})}
+	m.others[remotePeerID] = pending
+	m.mu.Unlock()
+
+	conn, err := dial()
+
+	m.mu.Lock()
+	delete(m.others, remotePeerID)
+	m.mu.Unlock()
+	pending.err = err
+	close(pending.done)
+
+	return conn, err
+}
+
+// add stores a new connection, dialed by us or accepted. When a connection to
+// the same peer exists, one of them is closed: in a simultaneous open the
+// connection dialed by the peer with the lower peer ID wins on both sides,
+// otherwise the newer connection wins. It returns the connection to use and
+// whether the new connection was kept.
+func (m *connManager) add(conn *Conn, dialed bool) (*Conn, bool) {
+	remotePeerID := conn.remotePeerID
+	now := time.Now()
+	mc := &managedConn{conn: conn, dialer: remotePeerID, established: now, lastActive: now}
+	if dialed {
+		mc.dialer = m.localID
+	}
+
+	m.mu.Lock()
+	existing := m.live(remotePeerID)
+
+	// Our own dial to the peer would win, so wait for its outcome instead of
+	// handing out a connection that is closed right after
+	if existing == nil && !dialed && m.localID < remotePeerID {
+		if pending, ok := m.dials[remotePeerID]; ok {
+			m.mu.Unlock()
+			<-pending.done
+			m.mu.Lock()
+			existing = m.live(remotePeerID)
+		}
+	}
+
+	if existing == nil {
+		_, dialing := m.dials[remotePeerID]
+		if !dialed && !dialing && m.max > 0 && len(m.conns)+len(m.dials) >= m.max {
+			m.mu.Unlock()
+			m.log.Warn("Refused connection: too many connections", "peer_id", remotePeerID, "max", m.max)
+			conn.CloseWithError(limitErrorCode, "too many connections")
+			return nil, false
+		}
+		m.store(mc)
+		m.mu.Unlock()
+		return conn, true
+	}
+
+	keepNew := true
+	if existing.dialer != mc.dialer && now.Sub(existing.established) < simultaneousOpenWindow {
+		keepNew = mc.dialer < existing.dialer
+	}
+	if !keepNew {
+		existing.lastActive = now
+		m.mu.Unlock()
+		m.log.Info("Closing duplicate connection", "peer_id", remotePeerID, "dialer", mc.dialer)
+		conn.CloseWithError(duplicateErrorCode, "duplicate connection")
+		return existing.conn, false
+	}
+
+	m.store(mc)
+	m.mu.Unlock()
+	m.log.Info("Closing duplicate connection", "peer_id", remotePeerID, "dialer", existing.dialer)
+	existing.conn.CloseWithError(duplicateErrorCode, "duplicate connection")
+	return conn, true
+}
+
+// store makes mc the connection of its peer and removes it once it is closed
+// (caller holds the lock)
+func (m *connManager) store(mc *managedConn) {
+	remotePeerID := mc.conn.remotePeerID
+	m.conns[remotePeerID] = mc
+	close(m.notify)
+	m.notify = make(chan struct{})
+
+	go func() {
+		<-mc.conn.Context().Done()
+		m.mu.Lock()
+		if m.conns[remotePeerID] == mc {
+			delete(m.conns, remotePeerID)
+		}
+		m.mu.Unlock()
+
+		m.emit(Event{
+			Type:      EventConnectionClosed,
+			PeerID:    remotePeerID,
+			Candidate: mc.conn.CandidatePair().Remote,
+			Duration:  time.Since(mc.established),
+			Err:       context.Cause(mc.conn.Context()),
+		})
+	}()
+}
+
+// live returns the connection of a peer if it is still open (caller holds the lock)
+func (m *connManager) live(remotePeerID string) *managedConn {
+	mc, ok := m.conns[remotePeerID]
+	if !ok || mc.conn.Context().Err() != nil {
+		return nil
+	}
+	return mc
+}
+
+// touch marks the connection of a peer as used
+func (m *connManager) touch(conn *Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if mc := m.live(conn.remotePeerID); mc != nil && mc.conn == conn {
+		mc.lastActive = time.Now()
+	}
+}
+
+// all returns the live connections
+func (m *connManager) all() []*Conn {
+	conns, _ := m.watch()
+	return conns
+}
+
+// watch returns the live connections and a channel that is closed when
+// a connection is added
+func (m *connManager) watch() ([]*Conn, <-chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conns := make([]*Conn, 0, len(m.conns))
+	for id := range m.conns {
+		if mc := m.live(id); mc != nil {
+			conns = append(conns, mc.conn)
+		}
+	}
+	return conns, m.notify
+}
+
+// evictIdle closes connections that were neither handed out nor carried
+// more than keepalive traffic for the idle timeout, until done is closed
+func (m *connManager) evictIdle(done <-chan struct{}) {
+	interval := max(min(m.idleTimeout/2, maxIdleCheckInterval), time.Millisecond)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		var idle []*Conn
+		m.mu.Lock()
+		for _, mc := range m.conns {
+			stats := mc.conn.ConnectionStats()
+			bytes := stats.BytesSent + stats.BytesReceived
+			if bytes-mc.lastBytes > idleBytesPerCheck {
+				mc.lastActive = now
+			}
+			mc.lastBytes = bytes
+			if now.Sub(mc.lastActive) >= m.idleTimeout {
+				idle = append(idle, mc.conn)
+			}
+		}
+		m.mu.Unlock()
+
+		for _, conn := range idle {
+			m.log.Info("Closing idle connection", "peer_id", conn.remotePeerID, "idle", m.idleTimeout)
+			conn.CloseWithError(idleErrorCode, "idle")
+		}
+	}
+}
+
+// Conns returns the live connections of the peer, at most one per remote peer
+func (p *Peer) Conns() []*Conn {
+	return p.conns.all()
+}
@@ -0,0 +1,153 @@
+package p2pquic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// newTestConns returns a function that opens a new QUIC connection on
+// loopback for every call, wrapped as a connection to remotePeerID
+func newTestConns(t *testing.T) func(remotePeerID string) *Conn {
+	t.Helper()
+
+	tlsConfig, _ := generateTLSConfig("test")
+	listener, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			if _, err := listener.Accept(context.Background()); err != nil {
+				return
+			}
+		}
+	}()
+
+	return func(remotePeerID string) *Conn {
+		t.Helper()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		qconn, err := quic.DialAddr(ctx, listener.Addr().String(), &tls.Config{
+			Certificates:       tlsConfig.Certificates,
+			InsecureSkipVerify: true,
+			NextProtos:         []string{peerALPN},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { qconn.CloseWithError(0, "") })
+		return &Conn{Conn: qconn, remotePeerID: remotePeerID}
+	}
+}
+
+// isClosed reports whether a connection is closed within a second
+func isClosed(conn *Conn) bool {
+	select {
+	case <-conn.Context().Done():
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+// newTestManager returns a connection manager without logging or events
+func newTestManager(localID string, maxConns int) *connManager {
+	return newConnManager(Config{PeerID: localID, Logger: slog.New(slog.DiscardHandler), MaxConnections: maxConns}, func(Event) {})
+}
+
+func TestConnManagerDuplicates(t *testing.T) {
+	newConn := newTestConns(t)
+
+	tests := []struct {
+		name        string
+		localID     string
+		firstDialed bool          // whether the existing connection was dialed by us
+		age         time.Duration // age of the existing connection
+		newDialed   bool
+		keepNew     bool
+	}{
+		{"simultaneous open, our dial wins", "alice", true, 0, false, false},
+		{"simultaneous open, their dial wins", "carol", true, 0, false, true},
+		{"simultaneous open, accepted first, our dial wins", "alice", false, 0, true, true},
+		{"simultaneous open, accepted first, their dial wins", "carol", false, 0, true, false},
+		{"outside the simultaneous open window", "alice", true, time.Minute, false, true},
+		{"reconnect by the same side", "alice", true, 0, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(tt.localID, 0)
+			first, second := newConn("bob"), newConn("bob")
+
+			if _, kept := m.add(first, tt.firstDialed); !kept {
+				t.Fatal("add() of the first connection kept = false")
+			}
+			m.mu.Lock()
+			m.conns["bob"].established = time.Now().Add(-tt.age)
+			m.mu.Unlock()
+
+			got, kept := m.add(second, tt.newDialed)
+			if kept != tt.keepNew {
+				t.Fatalf("add() kept = %v, want %v", kept, tt.keepNew)
+			}
+			winner, loser := first, second
+			if tt.keepNew {
+				winner, loser = second, first
+			}
+			if got != winner {
+				t.Error("add() did not return the connection that was kept")
+			}
+			if !isClosed(loser) {
+				t.Error("the duplicate connection was not closed")
+			}
+			if conns := m.all(); len(conns) != 1 || conns[0] != winner {
+				t.Errorf("all() = %v, want only the kept connection", conns)
+			}
+		})
+	}
+}
+
+func TestConnManagerMaxConnections(t *testing.T) {
+	newConn := newTestConns(t)
+	m := newTestManager("alice", 1)
+
+	if _, kept := m.add(newConn("bob"), false); !kept {
+		t.Fatal("add() below the limit kept = false")
+	}
+
+	// Incoming connections beyond the limit are refused
+	refused := newConn("carol")
+	if got, kept := m.add(refused, false); kept || got != nil {
+		t.Fatalf("add() beyond the limit = %v, %v, want nil, false", got, kept)
+	}
+	if !isClosed(refused) {
+		t.Error("the refused connection was not closed")
+	}
+
+	// Dials beyond the limit do not start
+	dialed := false
+	_, err := m.connect(context.Background(), "carol", func() (*Conn, error) {
+		dialed = true
+		return nil, errors.New("dialed")
+	})
+	if !errors.Is(err, ErrTooManyConnections) || dialed {
+		t.Fatalf("connect() beyond the limit error = %v, dialed = %v, want ErrTooManyConnections", err, dialed)
+	}
+
+	// The live connection is still shared
+	conn, err := m.connect(context.Background(), "bob", func() (*Conn, error) {
+		t.Error("connect() dialed a peer with a live connection")
+		return nil, errors.New("dialed")
+	})
+	if err != nil || conn.RemotePeerID() != "bob" {
+		t.Fatalf("connect() to a connected peer = %v, %v", conn, err)
+	}
+}
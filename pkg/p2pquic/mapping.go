@@ -0,0 +1,216 @@
+package p2pquic
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/internal/stun"
+)
+
+// STUNAttrEchoDelay is a comprehension-optional STUN attribute that asks a
+// p2pquic-signal STUN endpoint to send a second binding response after the
+// given number of milliseconds (uint32). The delayed response carries the
+// attribute too, so it can be told apart from the immediate one.
+const STUNAttrEchoDelay = stun.AttrEchoDelay
+
+// MaxMappingProbe is the longest silence interval MeasureMappingLifetime
+// can probe, the longest delay a p2pquic-signal STUN endpoint answers after
+const MaxMappingProbe = stun.MaxEchoDelay
+
+const (
+	// echoGrace is how long a probe waits beyond its silence for the delayed response
+	echoGrace = 3 * time.Second
+
+	// minKeepAlivePeriod is the shortest KeepAlivePeriod that is recommended
+	minKeepAlivePeriod = 5 * time.Second
+)
+
+// DefaultMappingProbes are the silence intervals probed by MeasureMappingLifetime
+var DefaultMappingProbes = []time.Duration{
+	10 * time.Second,
+	20 * time.Second,
+	30 * time.Second,
+	45 * time.Second,
+	60 * time.Second,
+	90 * time.Second,
+	120 * time.Second,
+	180 * time.Second,
+}
+
+// MappingProbe is the result of probing a NAT mapping after a period of silence
+type MappingProbe struct {
+	// Silence is how long the mapping stayed idle
+	Silence time.Duration
+
+	// Mapped is the public address the NAT assigned
+	Mapped *net.UDPAddr
+
+	// Alive reports whether the endpoint could still reach the mapping
+	Alive bool
+
+	// Err is set when the mapping could not be opened at all
+	Err error
+}
+
+// MappingLifetime is the result of MeasureMappingLifetime
+type MappingLifetime struct {
+	// Alive is the longest silence after which the mapping still worked
+	// (zero if it never did)
+	Alive time.Duration
+
+	// Expired is the shortest silence after which the mapping was gone
+	// (zero if it never expired within the probed intervals)
+	Expired time.Duration
+
+	// KeepAlivePeriod is the recommended value for Config.KeepAlivePeriod
+	KeepAlivePeriod time.Duration
+
+	// Probes holds the individual results, ordered by silence
+	Probes []MappingProbe
+}
+
+// MeasureMappingLifetime measures how long the local NAT keeps an idle UDP
+// mapping. For every silence interval it opens a fresh mapping through the
+// STUN endpoint of p2pquic-signal, stays silent, and checks whether the
+// endpoint can still reach the mapping after that time. The probes run in
+// parallel, so the measurement takes as long as the longest interval.
+// Without intervals, DefaultMappingProbes are used.
+func MeasureMappingLifetime(ctx context.Context, stunServer string, intervals ...time.Duration) (*MappingLifetime, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp4", stunServer)
+	if err != nil {
+		return nil, err
+	}
+	if len(intervals) == 0 {
+		intervals = DefaultMappingProbes
+	}
+	for _, silence := range intervals {
+		if silence <= 0 || silence > MaxMappingProbe {
+			return nil, fmt.Errorf("probe interval %s out of range (at most %s)", silence, MaxMappingProbe)
+		}
+	}
+
+	probes := make([]MappingProbe, len(intervals))
+	var wg sync.WaitGroup
+	for i, silence := range intervals {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probes[i] = probeMapping(ctx, serverAddr, silence)
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(probes, func(i, j int) bool { return probes[i].Silence < probes[j].Silence })
+
+	result := &MappingLifetime{Probes: probes}
+	opened := false
+	for _, probe := range probes {
+		if probe.Err != nil {
+			continue
+		}
+		opened = true
+		if probe.Alive {
+			result.Alive = probe.Silence
+		} else if result.Expired == 0 {
+			result.Expired = probe.Silence
+		}
+	}
+	if !opened {
+		return nil, fmt.Errorf("no mapping could be opened through %s: %w", stunServer, probes[0].Err)
+	}
+
+	// Refresh well before the mapping can expire
+	result.KeepAlivePeriod = max(result.Alive/2, minKeepAlivePeriod)
+	if result.Expired > 0 {
+		result.KeepAlivePeriod = min(result.KeepAlivePeriod, result.Expired/3)
+	}
+	result.KeepAlivePeriod = max(result.KeepAlivePeriod, minKeepAlivePeriod)
+
+	return result, nil
+}
+
+// probeMapping opens a mapping on a fresh socket, asks the endpoint to answer
+// again after silence and waits for that answer without sending anything
+func probeMapping(ctx context.Context, serverAddr *net.UDPAddr, silence time.Duration) MappingProbe {
+	probe := MappingProbe{Silence: silence}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		probe.Err = err
+		return probe
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	req, txID := newSTUNEchoRequest(silence)
+	buf := make([]byte, 1500)
+
+	// Open the mapping, retransmitting until the immediate response arrives
+	for range stunAttempts {
+		if _, err := conn.WriteToUDP(req, serverAddr); err != nil {
+			probe.Err = err
+			return probe
+		}
+		conn.SetReadDeadline(time.Now().Add(stunRetransmit))
+		probe.Mapped = readEcho(conn, buf, txID, false)
+		if probe.Mapped != nil {
+			break
+		}
+	}
+	if probe.Mapped == nil {
+		probe.Err = fmt.Errorf("%w from %s", errSTUNTimeout, serverAddr)
+		return probe
+	}
+
+	// Stay silent and wait for the delayed response
+	conn.SetReadDeadline(time.Now().Add(silence + echoGrace))
+	probe.Alive = readEcho(conn, buf, txID, true) != nil
+	return probe
+}
+
+// readEcho reads until a binding response for txID arrives (with or without
+// the echo delay attribute) or the read deadline passes
+func readEcho(conn *net.UDPConn, buf []byte, txID stunTxID, delayed bool) *net.UDPAddr {
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil
+		}
+		id, addr, err := parseSTUNBindingSuccess(buf[:n])
+		if err != nil || id != txID {
+			continue
+		}
+		if stunHasAttribute(buf[:n], STUNAttrEchoDelay) == delayed {
+			return addr
+		}
+	}
+}
+
+// newSTUNEchoRequest creates a binding request that asks for a second response after delay
+func newSTUNEchoRequest(delay time.Duration) ([]byte, stunTxID) {
+	req, txID := newSTUNBindingRequest()
+	req = binary.BigEndian.AppendUint16(req, STUNAttrEchoDelay)
+	req = binary.BigEndian.AppendUint16(req, 4)
+	req = binary.BigEndian.AppendUint32(req, uint32(delay.Milliseconds()))
+	binary.BigEndian.PutUint16(req[2:], uint16(len(req)-stun.HeaderSize))
+	return req, txID
+}
+
+// stunHasAttribute reports whether a STUN message carries an attribute
+func stunHasAttribute(b []byte, attr uint16) bool {
+	if !isSTUNPacket(b) {
+		return false
+	}
+	_, ok := stun.Attribute(b, attr)
+	return ok
+}
@@ -0,0 +1,267 @@
+package p2pquic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// DefaultNetworkPollInterval is used when Config.NetworkPollInterval is zero
+	DefaultNetworkPollInterval = 2 * time.Second
+
+	// migrationTimeout bounds the validation of a new path
+	migrationTimeout = 5 * time.Second
+
+	// reconnectErrorCode closes a connection that is replaced after a network change
+	reconnectErrorCode quic.ApplicationErrorCode = 0x1
+)
+
+// dialedConn is an outgoing connection that is migrated or re-established
+// when the local network changes
+type dialedConn struct {
+	conn         *Conn
+	remotePeerID string
+	opts         []ConnectOption
+	managed      bool // re-established by its PeerConn instead of recover
+
+	// path is the path the connection migrated to, nil while it uses the
+	// shared socket. The sockets of all paths are closed with the connection,
+	// because closing a quic.Transport destroys the connections that used it.
+	path       *quic.Path
+	transports []*quic.Transport
+}
+
+// track remembers an outgoing connection until it is closed
+func (p *Peer) track(conn *Conn, remotePeerID string, opts []ConnectOption, managed bool) {
+	d := &dialedConn{conn: conn, remotePeerID: remotePeerID, opts: opts, managed: managed}
+
+	p.dialedMu.Lock()
+	p.dialed[conn.Conn] = d
+	p.dialedMu.Unlock()
+
+	go func() {
+		<-conn.Context().Done()
+
+		p.dialedMu.Lock()
+		delete(p.dialed, conn.Conn)
+		p.dialedMu.Unlock()
+		p.closeTransports(d)
+	}()
+}
+
+// closeTransports closes the sockets of the paths of a connection
+func (p *Peer) closeTransports(d *dialedConn) {
+	p.dialedMu.Lock()
+	transports := d.transports
+	d.transports = nil
+	p.dialedMu.Unlock()
+
+	for _, tr := range transports {
+		tr.Close()
+		tr.Conn.Close()
+	}
+}
+
+// watchNetwork polls the local interface addresses and handles every change
+// until the peer is closed
+func (p *Peer) watchNetwork(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	addrs := localAddrs()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		current := localAddrs()
+		if slices.Equal(addrs, current) {
+			continue
+		}
+		p.log.Info("Local addresses changed", "old", addrs, "new", current)
+		addrs = current
+		p.HandleNetworkChange()
+	}
+}
+
+// localAddrs returns the sorted non-loopback IPv4 addresses of the local interfaces
+func localAddrs() []string {
+	var addrs []string
+	for _, c := range getLocalCandidates(0) {
+		addrs = append(addrs, c.IP)
+	}
+	slices.Sort(addrs)
+	return addrs
+}
+
+// HandleNetworkChange refreshes the candidates after the local network
+// changed, re-registers them when the peer was registered, and moves every
+// outgoing connection to a new path. A connection whose new path cannot be
+// validated is replaced by a new connection to the same peer, which is passed
+// to Config.OnReconnect. It is called automatically when the interface
+// addresses change, applications that learn about network changes earlier
+// (for example from the operating system) can call it directly.
+func (p *Peer) HandleNetworkChange() {
+	if p.ctx.Err() != nil {
+		return
+	}
+	if p.registered.Load() {
+		p.refreshCandidates()
+		if err := p.Register(); err != nil {
+			p.log.Warn("Failed to re-register after network change", "err", err)
+		}
+	}
+
+	p.dialedMu.Lock()
+	dialed := make([]*dialedConn, 0, len(p.dialed))
+	for _, d := range p.dialed {
+		dialed = append(dialed, d)
+	}
+	p.dialedMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, d := range dialed {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.recover(d)
+		}()
+	}
+	wg.Wait()
+}
+
+// refreshCandidates discovers the candidates again without logging every step
+func (p *Peer) refreshCandidates() {
+	var candidates []Candidate
+	if p.config.EnableSTUN {
+		if mapped, err := p.stunBind(p.stunServer()); err == nil {
+			candidates = append(candidates, Candidate{IP: mapped.IP.String(), Port: mapped.Port, Type: ServerReflexiveCandidate})
+		} else {
+			p.log.Warn("STUN discovery after network change failed", "err", err)
+		}
+	}
+	candidates = append(candidates, getLocalCandidates(p.GetActualPort())...)
+
+	p.mu.Lock()
+	p.candidates = candidates
+	p.mu.Unlock()
+	p.emitCandidates(candidates)
+}
+
+// recover migrates an outgoing connection to a new path, or reconnects to the
+// remote peer when migration fails. Connections of a PeerConn are only
+// closed, the PeerConn reconnects them.
+func (p *Peer) recover(d *dialedConn) {
+	if d.conn.Context().Err() != nil {
+		return
+	}
+
+	start := time.Now()
+	err := p.migrate(d)
+	if err == nil {
+		return
+	}
+	p.emit(Event{Type: EventPathMigrated, PeerID: d.remotePeerID, Duration: time.Since(start), Err: err})
+	p.log.Warn("Failed to migrate connection, reconnecting", "peer_id", d.remotePeerID, "err", err)
+
+	// Close the socket of the failed path only after the connection, because
+	// closing it first destroys the connection without telling the remote peer
+	d.conn.CloseWithError(reconnectErrorCode, "network changed")
+	p.closeTransports(d)
+	if d.managed {
+		return
+	}
+	conn, err := p.Connect(d.remotePeerID, d.opts...)
+	if err != nil {
+		p.log.Warn("Failed to reconnect", "peer_id", d.remotePeerID, "err", err)
+		return
+	}
+
+	p.log.Info("Reconnected", "peer_id", d.remotePeerID)
+	if p.config.OnReconnect != nil {
+		p.config.OnReconnect(d.remotePeerID, conn)
+	}
+}
+
+// migrate probes a path from a new socket, which gets its own NAT mapping on
+// the current network, and switches the connection to it once validated.
+// On failure the socket stays with the connection until recover closed it.
+func (p *Peer) migrate(d *dialedConn) error {
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return fmt.Errorf("failed to create UDP socket: %w", err)
+	}
+	transport := &quic.Transport{Conn: udpConn}
+
+	p.dialedMu.Lock()
+	if _, ok := p.dialed[d.conn.Conn]; !ok {
+		p.dialedMu.Unlock()
+		udpConn.Close()
+		return net.ErrClosed
+	}
+	d.transports = append(d.transports, transport)
+	p.dialedMu.Unlock()
+
+	path, err := d.conn.AddPath(transport)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(d.conn.Context(), migrationTimeout)
+	defer cancel()
+	if err := path.Probe(ctx); err != nil {
+		path.Close()
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("path from %s not validated within %s", udpConn.LocalAddr(), migrationTimeout)
+		}
+		return err
+	}
+	if err := path.Switch(); err != nil {
+		path.Close()
+		return err
+	}
+
+	// Abandon the path the connection used before, unless it is the shared socket
+	p.dialedMu.Lock()
+	oldPath := d.path
+	d.path = path
+	p.dialedMu.Unlock()
+
+	if oldPath != nil {
+		oldPath.Close()
+	}
+
+	// The socket listens on all interfaces, record the address of the
+	// interface that packets to the remote peer leave from
+	local := candidateOf(udpConn.LocalAddr().(*net.UDPAddr))
+	if ip := routeSource(d.conn.RemoteAddr()); ip != nil {
+		local.IP = ip.String()
+	}
+	local.Type = HostCandidate
+	d.conn.migrated(local)
+	p.emit(Event{Type: EventPathMigrated, PeerID: d.remotePeerID, Candidate: local, Duration: time.Since(start)})
+	p.log.Info("Migrated connection", "peer_id", d.remotePeerID, "local_port", local.Port)
+	return nil
+}
+
+// routeSource returns the local address that the system sends packets to
+// remote from, or nil if there is no route. Connecting a UDP socket sends
+// nothing.
+func routeSource(remote net.Addr) net.IP {
+	conn, err := net.Dial("udp4", remote.String())
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
@@ -0,0 +1,241 @@
+package p2pquic
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// streamCloseErrorCode stops the remote peer from sending on a StreamConn that was closed
+const streamCloseErrorCode quic.StreamErrorCode = 0x0
+
+// Network is the network name of the addresses of StreamConn and Listener
+const Network = "p2pquic"
+
+// streamPreamble is written by DialStream on every stream it opens, so the
+// stream reaches the remote peer even when the protocol on top of it waits
+// for the remote peer to speak first. A Listener consumes it before the
+// stream is returned by Accept.
+var streamPreamble = [4]byte{'P', '2', 'Q', 1}
+
+// streamPreambleTimeout is how long a Listener waits for the preamble of a stream
+const streamPreambleTimeout = 10 * time.Second
+
+// Addr is the address of one end of a stream, identified by its peer ID
+type Addr struct {
+	PeerID string
+
+	// UDPAddr is the address of the underlying QUIC connection, nil for the
+	// address of a Listener
+	UDPAddr net.Addr
+}
+
+// Network returns "p2pquic"
+func (a Addr) Network() string {
+	return Network
+}
+
+// String returns the peer ID
+func (a Addr) String() string {
+	return a.PeerID
+}
+
+// StreamConn is a QUIC stream to a remote peer that implements net.Conn,
+// for protocols and libraries written against net.Conn
+type StreamConn struct {
+	*quic.Stream
+	conn  *Conn
+	local string
+}
+
+// newStreamConn wraps a stream of a connection of the local peer
+func newStreamConn(conn *Conn, stream *quic.Stream, localPeerID string) *StreamConn {
+	return &StreamConn{Stream: stream, conn: conn, local: localPeerID}
+}
+
+// Conn returns the connection that carries the stream
+func (c *StreamConn) Conn() *Conn {
+	return c.conn
+}
+
+// RemotePeerID returns the peer ID of the remote peer
+func (c *StreamConn) RemotePeerID() string {
+	return c.conn.remotePeerID
+}
+
+// LocalAddr returns the local peer ID and UDP address
+func (c *StreamConn) LocalAddr() net.Addr {
+	return Addr{PeerID: c.local, UDPAddr: c.conn.LocalAddr()}
+}
+
+// RemoteAddr returns the remote peer ID and UDP address
+func (c *StreamConn) RemoteAddr() net.Addr {
+	return Addr{PeerID: c.conn.remotePeerID, UDPAddr: c.conn.RemoteAddr()}
+}
+
+// CloseWrite closes the sending side, the remote peer reads io.EOF after
+// the data that was written
+func (c *StreamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+// Close closes both sides of the stream, but not the connection
+func (c *StreamConn) Close() error {
+	c.Stream.CancelRead(streamCloseErrorCode)
+	return c.Stream.Close()
+}
+
+// DialStream connects to a remote peer, or uses the live connection to it,
+// and opens a stream as a net.Conn. The stream starts with a short preamble
+// that the Listener of the remote peer consumes, so streams opened otherwise
+// are not accepted by a Listener.
+func (p *Peer) DialStream(ctx context.Context, remotePeerID string, opts ...ConnectOption) (*StreamConn, error) {
+	conn, err := p.ConnectContext(ctx, remotePeerID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, p.closedErr(err)
+	}
+	if _, err := stream.Write(streamPreamble[:]); err != nil {
+		stream.CancelRead(streamCloseErrorCode)
+		stream.CancelWrite(streamCloseErrorCode)
+		return nil, p.closedErr(err)
+	}
+	p.conns.touch(conn)
+	return newStreamConn(conn, stream, p.config.PeerID), nil
+}
+
+// Listener is a net.Listener that accepts the streams remote peers open on
+// any connection of the peer, accepted or dialed
+type Listener struct {
+	peer    *Peer
+	ctx     context.Context
+	cancel  context.CancelFunc
+	streams chan *StreamConn
+
+	mu      sync.Mutex
+	serving map[*Conn]bool
+}
+
+// StreamListener starts listening and returns a net.Listener for the streams
+// of remote peers. It takes over Accept: incoming connections are accepted by
+// the listener, and streams should not be accepted on the connections of the
+// peer elsewhere while it is open.
+func (p *Peer) StreamListener() (*Listener, error) {
+	if err := p.Listen(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	l := &Listener{
+		peer:    p,
+		ctx:     ctx,
+		cancel:  cancel,
+		streams: make(chan *StreamConn),
+		serving: make(map[*Conn]bool),
+	}
+	go l.acceptConns()
+	go l.watchConns()
+	return l, nil
+}
+
+// Accept waits for the next stream a remote peer opens with DialStream
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-l.streams:
+		return stream, nil
+	case <-l.ctx.Done():
+		if l.peer.ctx.Err() != nil {
+			return nil, ErrPeerClosed
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting streams, the connections of the peer stay open
+func (l *Listener) Close() error {
+	l.cancel()
+	return nil
+}
+
+// Addr returns the address of the local peer
+func (l *Listener) Addr() net.Addr {
+	return Addr{PeerID: l.peer.config.PeerID}
+}
+
+// acceptConns accepts incoming connections, so they do not pile up unaccepted
+func (l *Listener) acceptConns() {
+	for {
+		conn, err := l.peer.Accept(l.ctx)
+		if err != nil {
+			return
+		}
+		l.serve(conn)
+	}
+}
+
+// watchConns serves every connection the connection manager keeps
+func (l *Listener) watchConns() {
+	for {
+		conns, changed := l.peer.conns.watch()
+		for _, conn := range conns {
+			l.serve(conn)
+		}
+		select {
+		case <-changed:
+		case <-l.ctx.Done():
+			return
+		}
+	}
+}
+
+// serve accepts the streams of a connection until it or the listener is closed
+func (l *Listener) serve(conn *Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.serving[conn] {
+		return
+	}
+	l.serving[conn] = true
+
+	go func() {
+		defer func() {
+			l.mu.Lock()
+			delete(l.serving, conn)
+			l.mu.Unlock()
+		}()
+		for {
+			stream, err := conn.AcceptStream(l.ctx)
+			if err != nil {
+				return
+			}
+			l.peer.conns.touch(conn)
+			go l.deliver(conn, stream)
+		}
+	}()
+}
+
+// deliver reads the preamble of a stream and hands the stream to Accept,
+// or resets it when the preamble is missing or the listener is closed
+func (l *Listener) deliver(conn *Conn, stream *quic.Stream) {
+	var preamble [len(streamPreamble)]byte
+	stream.SetReadDeadline(time.Now().Add(streamPreambleTimeout))
+	_, err := io.ReadFull(stream, preamble[:])
+	stream.SetReadDeadline(time.Time{})
+	if err == nil && preamble == streamPreamble {
+		select {
+		case l.streams <- newStreamConn(conn, stream, l.peer.config.PeerID):
+			return
+		case <-l.ctx.Done():
+		}
+	} else {
+		l.peer.log.Debug("Dropped stream without preamble", "peer_id", conn.remotePeerID, "err", err)
+	}
+	stream.CancelRead(streamCloseErrorCode)
+	stream.CancelWrite(streamCloseErrorCode)
+}
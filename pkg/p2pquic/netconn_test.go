@@ -0,0 +1,99 @@
+package p2pquic
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// readAll reads a stream until io.EOF, failing the test on errors
+func readAll(t *testing.T, r io.Reader) string {
+	t.Helper()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	return string(b)
+}
+
+func TestStreamListener(t *testing.T) {
+	signaling := newTestSignaling(t)
+	alice := newTestPeer(t, "alice", signaling.URL)
+	bob := newTestPeer(t, "bob", signaling.URL)
+
+	listener, err := alice.StreamListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := bob.DialStream(ctx, "alice")
+	if err != nil {
+		t.Fatalf("DialStream() error = %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	client.CloseWrite()
+
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	defer server.Close()
+
+	// The preamble is consumed by the listener
+	if got := readAll(t, server); got != "ping" {
+		t.Fatalf("server read %q, want %q", got, "ping")
+	}
+	if _, err := server.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	server.(*StreamConn).CloseWrite()
+	if got := readAll(t, client); got != "pong" {
+		t.Fatalf("client read %q, want %q", got, "pong")
+	}
+
+	if addr := server.RemoteAddr(); addr.Network() != Network || addr.String() != "bob" {
+		t.Errorf("RemoteAddr() = %s/%s, want %s/bob", addr.Network(), addr, Network)
+	}
+	if addr := client.LocalAddr(); addr.String() != "bob" {
+		t.Errorf("LocalAddr() = %s, want bob", addr)
+	}
+	if addr := listener.Addr(); addr.String() != "alice" {
+		t.Errorf("Addr() = %s, want alice", addr)
+	}
+
+	// A stream without the preamble is not accepted
+	raw, err := client.Conn().OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Write([]byte("junk"))
+	raw.Close()
+	second, err := bob.DialStream(ctx, "alice")
+	if err != nil {
+		t.Fatalf("DialStream() error = %v", err)
+	}
+	second.Write([]byte("second"))
+	second.CloseWrite()
+	server, err = listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	if got := readAll(t, server); got != "second" {
+		t.Fatalf("server read %q, want the stream with the preamble", got)
+	}
+
+	listener.Close()
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept() after Close error = %v, want net.ErrClosed", err)
+	}
+}
@@ -2,31 +2,57 @@ package p2pquic
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
+	"errors"
 	"fmt"
-	"log"
-	"math/big"
+	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 )
 
 // Peer represents a P2P QUIC peer
 type Peer struct {
 	config          Config
-	signalingClient *SignalingClient
-	udpConn         *net.UDPConn
-	quicListener    *quic.Listener
+	log             *slog.Logger
+	signalingClient atomic.Pointer[SignalingClient]
+	udpConn         atomic.Pointer[net.UDPConn]
+	transport       atomic.Pointer[quic.Transport]
+	quicListener    atomic.Pointer[quic.Listener]
+	bindMu          sync.Mutex // serializes creating the socket and the listener
 	tlsConfig       *tls.Config
+	fingerprint     []byte
 	candidates      []Candidate
+	punchKey        []byte
+	punches         *punchTable
+	bursts          map[string]*burst // by remote peer ID
+	burstMu         sync.Mutex
+	stunPending     map[stunTxID]chan *net.UDPAddr
+	stunMu          sync.Mutex
+	keepAlive       sync.Once
+	refresh         sync.Once
+	registered      atomic.Bool
+	dialed          map[*quic.Conn]*dialedConn
+	dialedMu        sync.Mutex
+	conns           *connManager
+	httpServer      atomic.Pointer[http3.Server]
+	mu              sync.Mutex // guards candidates
+	accepted        []*Conn    // verified connections waiting for Accept
+	acceptErr       error
+	acceptNotify    chan struct{} // closed and replaced when accepted or acceptErr changes
+	acceptMu        sync.Mutex
+	ctx             context.Context // canceled by Close
+	cancel          context.CancelFunc
+	done            <-chan struct{} // closed by Close
 }
 
-// NewPeer creates a new P2P QUIC peer
+// NewPeer creates a new P2P QUIC peer. A Peer is safe for concurrent use:
+// Connect, Accept, Register and UpdateSignalingClient may be called from
+// several goroutines.
 func NewPeer(config Config) (*Peer, error) {
 	if config.PeerID == "" {
 		return nil, fmt.Errorf("peer ID is required")
@@ -34,11 +60,32 @@ func NewPeer(config Config) (*Peer, error) {
 	if config.SignalingURL == "" {
 		config.SignalingURL = "http://localhost:8080"
 	}
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.DiscardHandler)
+	}
 
+	tlsConfig, fingerprint := generateTLSConfig(config.PeerID)
+	tlsConfig.KeyLogWriter = config.KeyLogWriter
+	ctx, cancel := context.WithCancel(context.Background())
 	peer := &Peer{
-		config:          config,
-		signalingClient: NewSignalingClient(config.SignalingURL),
-		tlsConfig:       generateTLSConfig(),
+		config:       config,
+		log:          config.Logger,
+		tlsConfig:    tlsConfig,
+		fingerprint:  fingerprint,
+		acceptNotify: make(chan struct{}),
+		punchKey:     newPunchKey(),
+		punches:      newPunchTable(config),
+		bursts:       make(map[string]*burst),
+		stunPending:  make(map[stunTxID]chan *net.UDPAddr),
+		dialed:       make(map[*quic.Conn]*dialedConn),
+		ctx:          ctx,
+		cancel:       cancel,
+		done:         ctx.Done(),
+	}
+	peer.conns = newConnManager(config, peer.emit)
+	peer.signalingClient.Store(NewSignalingClient(config.SignalingURL, config.signalingOptions()...))
+	if config.IdleConnTimeout > 0 {
+		go peer.conns.evictIdle(peer.done)
 	}
 
 	return peer, nil
@@ -47,24 +94,29 @@ func NewPeer(config Config) (*Peer, error) {
 // DiscoverCandidates discovers NAT traversal candidates.
 // Must be called after Listen() or Bind() to ensure the actual port is known.
 func (p *Peer) DiscoverCandidates() ([]Candidate, error) {
-	if p.udpConn == nil {
+	if p.ctx.Err() != nil {
+		return nil, ErrPeerClosed
+	}
+	udpConn := p.udpConn.Load()
+	if udpConn == nil {
 		return nil, fmt.Errorf("must call Listen() or Bind() before DiscoverCandidates() to ensure correct port is reported")
 	}
 
 	var candidates []Candidate
 
 	// Get local port from UDP connection
-	addr := p.udpConn.LocalAddr().(*net.UDPAddr)
+	addr := udpConn.LocalAddr().(*net.UDPAddr)
 	localPort := addr.Port
 
-	// Try STUN discovery if enabled - use temporary socket to avoid blocking
+	// Try STUN discovery if enabled, on the shared socket so the discovered
+	// port is the one the NAT maps our QUIC traffic to
 	if p.config.EnableSTUN {
-		log.Printf("Attempting STUN discovery...")
-		if stunCand, err := discoverPublicIP(localPort); err == nil {
-			log.Printf("STUN discovered: %s:%d", stunCand.IP, stunCand.Port)
-			candidates = append(candidates, *stunCand)
+		start := time.Now()
+		if mapped, err := p.stunBind(p.stunServer()); err == nil {
+			p.log.Info("STUN discovered public address", "candidate", mapped.String(), "duration", time.Since(start))
+			candidates = append(candidates, Candidate{IP: mapped.IP.String(), Port: mapped.Port, Type: ServerReflexiveCandidate})
 		} else {
-			log.Printf("STUN discovery failed: %v (continuing with local candidates)", err)
+			p.log.Warn("STUN discovery failed, continuing with local candidates", "server", p.stunServer(), "err", err)
 		}
 	}
 
@@ -72,332 +124,464 @@ func (p *Peer) DiscoverCandidates() ([]Candidate, error) {
 	localCands := getLocalCandidates(localPort)
 	candidates = append(candidates, localCands...)
 
+	p.mu.Lock()
 	p.candidates = candidates
+	p.mu.Unlock()
+	p.emitCandidates(candidates)
 	return candidates, nil
 }
 
-// Register registers this peer with the signaling server
+// Register registers this peer with the signaling server.
+// The first successful registration starts refreshing it every
+// RegisterInterval, so it does not expire while the peer runs. With STUN
+// enabled, it also starts the keepalive that refreshes the NAT mapping and
+// re-registers when it changes.
 func (p *Peer) Register() error {
-	if len(p.candidates) == 0 {
-		return fmt.Errorf("no candidates to register, call DiscoverCandidates first")
+	p.mu.Lock()
+	candidates := append([]Candidate(nil), p.candidates...)
+	p.mu.Unlock()
+
+	if len(candidates) == 0 {
+		return fmt.Errorf("%w to register, call DiscoverCandidates first", ErrNoCandidates)
+	}
+	if p.ctx.Err() != nil {
+		return ErrPeerClosed
+	}
+
+	start := time.Now()
+	err := p.signaling().RegisterPeer(&PeerInfo{
+		ID:          p.config.PeerID,
+		Candidates:  candidates,
+		PunchKey:    p.punchKey,
+		Fingerprint: p.fingerprint,
+	})
+	p.emit(Event{Type: EventRegistered, Duration: time.Since(start), Err: err})
+	if err != nil {
+		return p.closedErr(err)
 	}
+	p.registered.Store(true)
+
+	if p.config.RegisterInterval >= 0 {
+		p.refresh.Do(func() {
+			interval := p.config.RegisterInterval
+			if interval == 0 {
+				interval = DefaultRegisterInterval
+			}
+			go p.refreshLoop(interval)
+		})
+	}
+	if p.config.EnableSTUN && p.config.KeepAlivePeriod >= 0 {
+		p.keepAlive.Do(func() {
+			period := p.config.KeepAlivePeriod
+			if period == 0 {
+				period = DefaultKeepAlivePeriod
+			}
+			go p.keepAliveLoop(period)
+		})
+	}
+
+	return nil
+}
+
+// refreshLoop re-registers periodically, because the signaling server
+// drops registrations that are not refreshed within its TTL
+func (p *Peer) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
 
-	return p.signalingClient.Register(p.config.PeerID, p.candidates)
+		if err := p.Register(); err != nil && !errors.Is(err, ErrPeerClosed) {
+			p.log.Warn("Failed to refresh registration", "err", err)
+		}
+	}
 }
 
 // Listen starts listening for incoming QUIC connections
 func (p *Peer) Listen() error {
-	udpAddr := &net.UDPAddr{
-		IP:   net.IPv4zero,
-		Port: p.config.LocalPort,
+	if err := p.bind(); err != nil {
+		return err
 	}
 
-	var err error
-	p.udpConn, err = net.ListenUDP("udp4", udpAddr)
-	if err != nil {
-		return fmt.Errorf("failed to create UDP socket: %w", err)
+	p.bindMu.Lock()
+	defer p.bindMu.Unlock()
+	if p.quicListener.Load() != nil {
+		return nil
 	}
-
-	// Configure QUIC with extended idle timeout and keepalive
-	quicConfig := &quic.Config{
-		MaxIdleTimeout:  5 * time.Minute,  // Extended idle timeout
-		KeepAlivePeriod: 30 * time.Second, // Send keepalive pings
+	transport := p.transport.Load()
+	if transport == nil {
+		return ErrPeerClosed
 	}
-
-	p.quicListener, err = quic.Listen(p.udpConn, p.tlsConfig, quicConfig)
+	// A failed listener leaves the peer usable, closing it is up to the caller
+	listener, err := transport.Listen(p.tlsConfig, p.quicConfig(""))
 	if err != nil {
-		p.udpConn.Close()
-		return fmt.Errorf("failed to start QUIC listener: %w", err)
+		return p.closedErr(fmt.Errorf("failed to start QUIC listener: %w", err))
 	}
+	p.quicListener.Store(listener)
+	go p.acceptLoop(listener)
 
-	log.Printf("QUIC listener started on port %d", p.GetActualPort())
+	p.log.Info("QUIC listener started", "port", p.GetActualPort())
 	return nil
 }
 
 // Bind creates the UDP socket without starting a QUIC listener
 // Use this for clients that only need to dial out, not accept connections
 func (p *Peer) Bind() error {
+	if err := p.bind(); err != nil {
+		return err
+	}
+	p.log.Info("UDP socket bound", "port", p.GetActualPort())
+	return nil
+}
+
+// bind creates the UDP socket and the QUIC transport that shares it with
+// hole-punching packets, unless they already exist
+func (p *Peer) bind() error {
+	p.bindMu.Lock()
+	defer p.bindMu.Unlock()
+
+	if p.ctx.Err() != nil {
+		return ErrPeerClosed
+	}
+	if p.udpConn.Load() != nil {
+		return nil
+	}
+
 	udpAddr := &net.UDPAddr{
 		IP:   net.IPv4zero,
 		Port: p.config.LocalPort,
 	}
-	var err error
-	p.udpConn, err = net.ListenUDP("udp4", udpAddr)
+	udpConn, err := net.ListenUDP("udp4", udpAddr)
 	if err != nil {
 		return fmt.Errorf("failed to create UDP socket: %w", err)
 	}
-	log.Printf("UDP socket bound on port %d", p.GetActualPort())
-	return nil
-}
 
-// Accept accepts an incoming QUIC connection
-func (p *Peer) Accept(ctx context.Context) (*quic.Conn, error) {
-	if p.quicListener == nil {
-		return nil, fmt.Errorf("peer is not listening, call Listen first")
+	transport := &quic.Transport{Conn: udpConn, ConnContext: p.connContext}
+	p.udpConn.Store(udpConn)
+	p.transport.Store(transport)
+	go p.readLoop(transport)
+
+	if p.config.NetworkPollInterval >= 0 {
+		interval := p.config.NetworkPollInterval
+		if interval == 0 {
+			interval = DefaultNetworkPollInterval
+		}
+		go p.watchNetwork(interval)
 	}
 
-	return p.quicListener.Accept(ctx)
+	return nil
 }
 
 // GetActualPort returns the actual port from the UDP listener
 func (p *Peer) GetActualPort() int {
-	if p.udpConn == nil {
+	udpConn := p.udpConn.Load()
+	if udpConn == nil {
 		return p.config.LocalPort
 	}
-	addr := p.udpConn.LocalAddr().(*net.UDPAddr)
+	addr := udpConn.LocalAddr().(*net.UDPAddr)
 	return addr.Port
 }
 
-// UpdateSignalingClient updates the signaling client with a new URL
+// UpdateSignalingClient updates the signaling client with a new URL. Calls
+// that are in progress finish with the previous client.
 func (p *Peer) UpdateSignalingClient(url string) {
-	p.config.SignalingURL = url
-	p.signalingClient = NewSignalingClient(url)
-	log.Printf("Updated signaling client to use %s", url)
+	p.signalingClient.Store(NewSignalingClient(url, p.config.signalingOptions()...))
+	p.log.Info("Updated signaling client", "url", url)
+}
+
+// signaling returns the current signaling client
+func (p *Peer) signaling() *SignalingClient {
+	return p.signalingClient.Load()
 }
 
 // Connect connects to a remote peer.
 // If no candidates are provided via options, the peer's candidates are fetched from the signaling server.
 // Use WithCandidates to provide candidates directly and bypass the signaling server lookup.
-func (p *Peer) Connect(remotePeerID string, opts ...ConnectOption) (*quic.Conn, error) {
+// The remote certificate must name remotePeerID and match its registered
+// fingerprint (or the one given with WithFingerprint).
+//
+// There is at most one live connection per remote peer: Connect returns the
+// existing connection, dialed or accepted, and concurrent calls for the same
+// peer share one dial. Closing the returned connection closes it for all
+// callers. When both peers connect to each other at the same time, the
+// connection dialed by the peer with the lower peer ID is kept on both sides
+// and the other one is closed. A caller that got the closed connection gets
+// the remaining one by calling Connect again.
+func (p *Peer) Connect(remotePeerID string, opts ...ConnectOption) (*Conn, error) {
+	return p.ConnectContext(context.Background(), remotePeerID, opts...)
+}
+
+// ConnectContext is like Connect, but gives up when ctx is done: the lookup,
+// the connection request, the punching and the handshake are canceled and
+// ctx.Err() is returned. A dial shared with other callers is canceled only
+// for the caller whose ctx is done, the others dial again.
+func (p *Peer) ConnectContext(ctx context.Context, remotePeerID string, opts ...ConnectOption) (*Conn, error) {
 	// Apply options
-	cfg := &connectConfig{}
+	cfg := &connectConfig{ctx: ctx}
 	for _, opt := range opts {
 		opt(cfg)
 	}
 
-	var candidates []Candidate
+	if p.ctx.Err() != nil {
+		return nil, ErrPeerClosed
+	}
+	conn, err := p.conns.connect(ctx, remotePeerID, func() (*Conn, error) {
+		return p.dial(remotePeerID, cfg, opts)
+	})
+	return conn, p.closedErr(err)
+}
+
+// dial looks up, punches and dials a new connection to a remote peer
+func (p *Peer) dial(remotePeerID string, cfg *connectConfig, opts []ConnectOption) (*Conn, error) {
+	var remotePeer *PeerInfo
+	var key []byte // MAC key of the punches, see pairKey
+	var times ConnectTimes
+	start := time.Now()
+
+	ctx := p.ctx
+	if cfg.ctx != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(cfg.ctx)
+		defer cancel()
+		stop := context.AfterFunc(p.ctx, cancel)
+		defer stop()
+	}
 
 	// Use provided candidates or fetch from signaling server
 	if len(cfg.candidates) > 0 {
-		candidates = cfg.candidates
-		log.Printf("Using %d provided candidates", len(candidates))
+		remotePeer = &PeerInfo{ID: remotePeerID, Candidates: cfg.candidates, Fingerprint: cfg.fingerprint}
+		p.log.Debug("Using provided candidates", "peer_id", remotePeerID, "candidates", len(cfg.candidates))
 	} else {
 		// Get remote peer info from signaling server
-		remotePeer, err := p.signalingClient.GetPeer(remotePeerID)
+		var err error
+		remotePeer, err = p.signaling().getPeer(ctx, remotePeerID)
+		if ctx.Err() != nil {
+			return nil, p.closedErr(ctx.Err())
+		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to get remote peer info: %w", err)
 		}
-		candidates = remotePeer.Candidates
-		log.Printf("Found remote peer with %d candidates", len(candidates))
+		p.log.Debug("Found remote peer", "peer_id", remotePeerID, "candidates", len(remotePeer.Candidates))
+
+		// Ask the remote peer to punch toward us. The connect key of this
+		// attempt is only delivered with the request, and the remote peer
+		// answers punches keyed with it, so without a request the punches
+		// cannot be confirmed.
+		connectKey := newPunchKey()
+		if err := p.signaling().requestConnect(ctx, p.config.PeerID, remotePeerID, connectKey); ctx.Err() != nil {
+			return nil, p.closedErr(ctx.Err())
+		} else if err != nil {
+			p.log.Warn("Failed to request connection, continuing", "peer_id", remotePeerID, "err", err)
+		} else {
+			key = pairKey(remotePeer.PunchKey, connectKey)
+		}
+		times.Signaling = time.Since(start)
 	}
 
-	// Create UDP connection if not already created
-	if p.udpConn == nil {
-		udpAddr := &net.UDPAddr{
-			IP:   net.IPv4zero,
-			Port: p.config.LocalPort,
-		}
-		var err error
-		p.udpConn, err = net.ListenUDP("udp4", udpAddr)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create UDP socket: %w", err)
-		}
+	if len(remotePeer.Candidates) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrNoCandidates, remotePeerID)
 	}
 
-	// Perform UDP hole-punching
-	log.Println("Performing UDP hole-punch...")
-	if err := p.holePunch(candidates); err != nil {
-		return nil, fmt.Errorf("hole-punch failed: %w", err)
+	// Create UDP connection if not already created
+	if err := p.bind(); err != nil {
+		return nil, err
 	}
 
-	// Wait for holes to be established
-	time.Sleep(2 * time.Second)
+	// Perform UDP hole-punching. With a MAC key the remote peer answers our
+	// punches, and only candidates that answered are dialed. Without one
+	// (candidates provided directly, or no connection request delivered)
+	// the punches only open our NAT mapping.
+	candidates := remotePeer.Candidates
+	start = time.Now()
+	a := p.punches.begin(remotePeer, key)
+	defer p.punches.end(a)
+	if key == nil {
+		p.punchUntilConfirmed(ctx, a, candidates, unconfirmedPunchWait)
+	} else {
+		confirmed := p.punchUntilConfirmed(ctx, a, candidates, punchTimeout)
+		if len(confirmed) == 0 {
+			if p.ctx.Err() != nil {
+				return nil, ErrPeerClosed
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			failed := &AllCandidatesFailedError{PeerID: remotePeerID}
+			for _, c := range candidates {
+				failed.Candidates = append(failed.Candidates, CandidateError{Candidate: c, Err: errNoPunchReply})
+			}
+			return nil, failed
+		}
+		candidates = confirmed
+	}
+	times.Punching = time.Since(start)
 
 	// Attempt QUIC connection
-	log.Println("Attempting QUIC connection...")
-	return p.connectQUIC(candidates)
+	alpn := cfg.alpn
+	if alpn == "" {
+		alpn = peerALPN
+	}
+	conn, err := p.connectQUIC(ctx, remotePeerID, remotePeer.Fingerprint, candidates, alpn)
+	if err != nil {
+		return nil, err
+	}
+	if p.ctx.Err() != nil {
+		conn.CloseWithError(closeErrorCode, "peer closed")
+		return nil, ErrPeerClosed
+	}
+	times.Handshake = conn.times.Handshake
+	conn.times = times
+
+	// Connections of other protocols are not migrated after a network
+	// change, their users dial again once they fail
+	if cfg.alpn == "" {
+		p.track(conn, remotePeerID, opts, cfg.managed)
+	}
+	return conn, nil
 }
 
-// ContinuousHolePunch continuously polls for peers and sends punch packets
+// ContinuousHolePunch waits for connection requests from other peers and
+// punches toward each requesting peer in a bounded burst, so their punches
+// can pass our NAT. It returns when ctx is done or the peer is closed.
 func (p *Peer) ContinuousHolePunch(ctx context.Context) {
-	if p.udpConn == nil {
-		log.Println("Warning: UDP connection not initialized for continuous hole-punching")
+	if p.udpConn.Load() == nil {
+		p.log.Warn("UDP connection not initialized for continuous hole-punching")
 		return
 	}
 
-	knownPeers := make(map[string]bool)
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(p.ctx, cancel)
+	defer stop()
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			peers, err := p.signalingClient.GetAllPeers()
-			if err != nil {
-				log.Printf("Failed to get peers: %v", err)
-				continue
+	for ctx.Err() == nil {
+		requests, err := p.signaling().WaitConnectRequests(ctx, p.config.PeerID, connectRequestWait)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			p.log.Warn("Failed to get connection requests", "err", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(connectRequestRetry):
 			}
+			continue
+		}
 
-			for _, peer := range peers {
-				// Skip ourselves
-				if peer.ID == p.config.PeerID {
-					continue
-				}
-
-				// Check if this is a new peer
-				if !knownPeers[peer.ID] {
-					log.Printf("Discovered new peer: %s with %d candidates", peer.ID, len(peer.Candidates))
-					knownPeers[peer.ID] = true
-				}
-
-				// Send punch packets to all candidates
-				for _, candidate := range peer.Candidates {
-					addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", candidate.IP, candidate.Port))
-					if err != nil {
-						continue
-					}
-					p.udpConn.WriteToUDP([]byte("PUNCH"), addr)
-				}
+		for _, remote := range requests {
+			if remote.ID == p.config.PeerID {
+				continue
 			}
+			p.log.Info("Peer requested a connection, punching", "peer_id", remote.ID, "candidates", len(remote.Candidates))
+			p.startBurst(ctx, remote)
 		}
 	}
 }
 
-// Close closes the peer and releases resources
+// Close closes the peer and its connections, stops its background
+// goroutines and makes calls in progress return ErrPeerClosed
 func (p *Peer) Close() error {
-	if p.quicListener != nil {
-		p.quicListener.Close()
+	p.cancel()
+
+	p.bindMu.Lock()
+	defer p.bindMu.Unlock()
+
+	if listener := p.quicListener.Swap(nil); listener != nil {
+		listener.Close()
+	}
+	if transport := p.transport.Swap(nil); transport != nil {
+		transport.Close()
 	}
-	if p.udpConn != nil {
-		return p.udpConn.Close()
+	if udpConn := p.udpConn.Swap(nil); udpConn != nil {
+		return udpConn.Close()
 	}
 	return nil
 }
 
 // GetUDPConn returns the underlying UDP connection for manual hole-punching
 func (p *Peer) GetUDPConn() *net.UDPConn {
-	return p.udpConn
+	return p.udpConn.Load()
 }
 
-// holePunch performs UDP hole-punching to remote candidates
-func (p *Peer) holePunch(remoteCandidates []Candidate) error {
-	for _, candidate := range remoteCandidates {
-		addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", candidate.IP, candidate.Port))
-		if err != nil {
-			log.Printf("Failed to resolve %s:%d: %v", candidate.IP, candidate.Port, err)
-			continue
-		}
-
-		// Send multiple packets to ensure hole is punched
-		for i := 0; i < 5; i++ {
-			_, err = p.udpConn.WriteToUDP([]byte("PUNCH"), addr)
-			if err != nil {
-				log.Printf("Failed to send punch packet to %s: %v", addr, err)
-			} else {
-				log.Printf("Sent punch packet to %s", addr)
-			}
-			time.Sleep(100 * time.Millisecond)
-		}
+// writeTo sends a non-QUIC packet on the shared socket
+func (p *Peer) writeTo(b []byte, addr net.Addr) error {
+	transport := p.transport.Load()
+	if transport == nil {
+		return ErrPeerClosed
 	}
-
-	return nil
+	_, err := transport.WriteTo(b, addr)
+	return p.closedErr(err)
 }
 
-// connectQUIC attempts to connect to remote candidates via QUIC
-func (p *Peer) connectQUIC(remoteCandidates []Candidate) (*quic.Conn, error) {
+// connectQUIC attempts to connect to remote candidates via QUIC until ctx is done
+func (p *Peer) connectQUIC(ctx context.Context, remotePeerID string, fingerprint []byte, remoteCandidates []Candidate, alpn string) (*Conn, error) {
+	tlsConfig := p.dialTLSConfig(remotePeerID, fingerprint, alpn)
+	transport := p.transport.Load()
+	if transport == nil {
+		return nil, ErrPeerClosed
+	}
+	quicConfig := p.quicConfig(remotePeerID)
+	failed := &AllCandidatesFailedError{PeerID: remotePeerID}
 	for _, candidate := range remoteCandidates {
 		addr := fmt.Sprintf("%s:%d", candidate.IP, candidate.Port)
-		log.Printf("Attempting QUIC connection to %s", addr)
+		p.log.Debug("Attempting QUIC connection", "peer_id", remotePeerID, "candidate", addr)
 
 		remoteAddr, err := net.ResolveUDPAddr("udp4", addr)
 		if err != nil {
-			log.Printf("Failed to resolve %s: %v", addr, err)
+			p.log.Warn("Failed to resolve candidate", "peer_id", remotePeerID, "candidate", addr, "err", err)
+			failed.Candidates = append(failed.Candidates, CandidateError{Candidate: candidate, Err: err})
 			continue
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 		defer cancel()
 
-		// Configure QUIC with extended idle timeout and keepalive
-		quicConfig := &quic.Config{
-			MaxIdleTimeout:  5 * time.Minute,  // Extended idle timeout
-			KeepAlivePeriod: 30 * time.Second, // Send keepalive pings
-		}
-
-		quicConn, err := quic.Dial(ctx, p.udpConn, remoteAddr, p.tlsConfig, quicConfig)
+		start := time.Now()
+		p.emit(Event{Type: EventDialStarted, PeerID: remotePeerID, Candidate: candidate, Time: start})
+		quicConn, err := transport.Dial(dialCtx, remoteAddr, tlsConfig, quicConfig)
 		if err != nil {
-			log.Printf("Failed to connect to %s: %v", addr, err)
+			if p.ctx.Err() != nil {
+				return nil, ErrPeerClosed
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			p.emit(Event{Type: EventDialFailed, PeerID: remotePeerID, Candidate: candidate, Duration: time.Since(start), Err: err})
+			p.log.Info("Failed to connect to candidate", "peer_id", remotePeerID, "candidate", addr, "duration", time.Since(start), "err", err)
+			failed.Candidates = append(failed.Candidates, CandidateError{Candidate: candidate, Err: err})
 			continue
 		}
 
-		log.Printf("Successfully connected to %s", addr)
-		return quicConn, nil
-	}
-
-	return nil, fmt.Errorf("failed to connect to any candidate")
-}
-
-// discoverPublicIP uses STUN to discover public IP
-func discoverPublicIP(localPort int) (*Candidate, error) {
-	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: 0}) // Use random port to avoid conflicts
-	if err != nil {
-		return nil, err
+		conn := &Conn{
+			Conn:         quicConn,
+			remotePeerID: remotePeerID,
+			verified:     len(fingerprint) > 0,
+			pair:         CandidatePair{Local: p.localCandidateFor(candidate), Remote: candidate},
+			times:        ConnectTimes{Handshake: time.Since(start)},
+		}
+		p.emit(Event{Type: EventDialSucceeded, PeerID: remotePeerID, Candidate: candidate, Duration: conn.times.Handshake})
+		p.log.Info("Connected", "peer_id", remotePeerID, "candidate", addr, "duration", conn.times.Handshake)
+		return conn, nil
 	}
-	defer conn.Close()
-
-	return performSTUNDiscovery(conn, localPort)
-}
 
-// discoverPublicIPWithConn uses STUN with an existing UDP connection
-func discoverPublicIPWithConn(conn *net.UDPConn) (*Candidate, error) {
-	addr := conn.LocalAddr().(*net.UDPAddr)
-	return performSTUNDiscovery(conn, addr.Port)
+	return nil, failed
 }
 
-// performSTUNDiscovery performs the actual STUN discovery
-func performSTUNDiscovery(conn *net.UDPConn, localPort int) (*Candidate, error) {
-	stunAddr, _ := net.ResolveUDPAddr("udp4", "stun.l.google.com:19302")
-
-	// Simple STUN binding request
-	stunReq := []byte{
-		0x00, 0x01, // Binding Request
-		0x00, 0x00, // Length
-		0x21, 0x12, 0xa4, 0x42, // Magic Cookie
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Transaction ID
-	}
-
-	conn.SetDeadline(time.Now().Add(3 * time.Second))
-	defer conn.SetDeadline(time.Time{}) // Clear deadline
-
-	_, err := conn.WriteToUDP(stunReq, stunAddr)
-	if err != nil {
-		return nil, err
-	}
-
-	buf := make([]byte, 1024)
-	n, _, err := conn.ReadFromUDP(buf)
-	if err != nil {
-		return nil, err
-	}
-
-	// Parse STUN response (simplified)
-	if n > 20 {
-		// Look for XOR-MAPPED-ADDRESS attribute (0x0020)
-		for i := 20; i < n-8; i++ {
-			if buf[i] == 0x00 && buf[i+1] == 0x20 {
-				// Found XOR-MAPPED-ADDRESS
-				// port := int(buf[i+6])<<8 | int(buf[i+7])
-				// port ^= 0x2112 // XOR with magic cookie
-
-				ip := net.IPv4(
-					buf[i+8]^0x21,
-					buf[i+9]^0x12,
-					buf[i+10]^0xa4,
-					buf[i+11]^0x42,
-				)
-
-				// Return discovered public IP with our local port
-				return &Candidate{
-					IP:   ip.String(),
-					Port: localPort,
-				}, nil
-			}
-		}
+// quicConfig returns the QUIC configuration with an extended idle timeout and
+// keepalive, tracing to the qlog directory if set. The remote peer ID is empty
+// for the listener.
+func (p *Peer) quicConfig(remotePeerID string) *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:  5 * time.Minute,  // Extended idle timeout
+		KeepAlivePeriod: 30 * time.Second, // Send keepalive pings
+		Tracer:          p.qlogTracer(remotePeerID),
 	}
-
-	return nil, fmt.Errorf("failed to parse STUN response")
 }
 
 // getLocalCandidates returns local network candidates
@@ -415,6 +599,7 @@ func getLocalCandidates(port int) []Candidate {
 				candidates = append(candidates, Candidate{
 					IP:   ipnet.IP.String(),
 					Port: port,
+					Type: HostCandidate,
 				})
 			}
 		}
@@ -422,36 +607,3 @@ func getLocalCandidates(port int) []Candidate {
 
 	return candidates
 }
-
-// generateTLSConfig creates a self-signed certificate for QUIC
-func generateTLSConfig() *tls.Config {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		panic(err)
-	}
-
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(24 * time.Hour),
-	}
-
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
-	if err != nil {
-		panic(err)
-	}
-
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
-	if err != nil {
-		panic(err)
-	}
-
-	return &tls.Config{
-		Certificates:       []tls.Certificate{tlsCert},
-		InsecureSkipVerify: true, // For demo purposes only
-		NextProtos:         []string{"p2pquic"},
-	}
-}
@@ -0,0 +1,297 @@
+package p2pquic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListenFailureKeepsPeer(t *testing.T) {
+	peer, err := NewPeer(Config{PeerID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if err := peer.Bind(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Occupy the listener of the transport, so Listen fails
+	other, err := peer.transport.Load().Listen(peer.tlsConfig, peer.quicConfig(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.Listen(); err == nil || errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("Listen() error = %v, want a listener error", err)
+	}
+	if _, err := peer.DiscoverCandidates(); err != nil {
+		t.Fatalf("DiscoverCandidates() after a failed Listen error = %v", err)
+	}
+
+	other.Close()
+	if err := peer.Listen(); err != nil {
+		t.Fatalf("Listen() after the listener was freed error = %v", err)
+	}
+
+	peer.Close()
+	if err := peer.Listen(); !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("Listen() after Close error = %v, want ErrPeerClosed", err)
+	}
+}
+
+func TestRegisterRefresh(t *testing.T) {
+	var registrations atomic.Int32
+	signaling := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/register" {
+			registrations.Add(1)
+		}
+	}))
+	defer signaling.Close()
+
+	peer, err := NewPeer(Config{PeerID: "alice", SignalingURL: signaling.URL, RegisterInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if err := peer.Bind(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.DiscoverCandidates(); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.Register(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for registrations.Load() < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("registrations = %d, want the registration refreshed without STUN", registrations.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The refresh stops with the peer
+	peer.Close()
+	time.Sleep(50 * time.Millisecond)
+	closed := registrations.Load()
+	time.Sleep(100 * time.Millisecond)
+	if got := registrations.Load(); got != closed {
+		t.Errorf("registrations after Close = %d, want %d", got, closed)
+	}
+}
+
+func TestConnectContext(t *testing.T) {
+	// A signaling server that never answers
+	hang := make(chan struct{})
+	signaling := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-hang:
+		}
+	}))
+	defer signaling.Close()
+	defer close(hang)
+
+	peer, err := NewPeer(Config{PeerID: "alice", SignalingURL: signaling.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	tests := []struct {
+		name string
+		opts []ConnectOption
+	}{
+		{"lookup", nil},
+		{"punching", []ConnectOption{WithCandidates(Candidate{IP: "192.0.2.1", Port: 4242, Type: HostCandidate})}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			_, err := peer.DialStream(ctx, "bob", tt.opts...)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("DialStream() error = %v, want context.DeadlineExceeded", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("DialStream() returned after %s", elapsed)
+			}
+		})
+	}
+
+	// A caller whose ctx is still live dials again after a shared dial was canceled
+	first, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := peer.ConnectContext(first, "bob")
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	second, cancelSecond := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancelSecond()
+	secondDone := make(chan error, 1)
+	go func() {
+		_, err := peer.ConnectContext(second, "bob")
+		secondDone <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("ConnectContext() of the canceled caller error = %v, want context.Canceled", err)
+	}
+	select {
+	case err := <-secondDone:
+		t.Fatalf("ConnectContext() of the other caller returned %v with the canceled dial", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := <-secondDone; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ConnectContext() of the other caller error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+// newTestSignaling starts an in-memory signaling server with registration,
+// lookup and connection requests
+func newTestSignaling(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	var mu sync.Mutex
+	peers := make(map[string]PeerInfo)
+	requests := make(map[string][]PeerInfo)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		var info PeerInfo
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		peers[info.ID] = info
+		mu.Unlock()
+	})
+	mux.HandleFunc("/peer", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		info, ok := peers[r.URL.Query().Get("id")]
+		mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(info)
+	})
+	mux.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			From string `json:"from"`
+			To   string `json:"to"`
+			Key  []byte `json:"key"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		from, ok := peers[req.From]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		from.ConnectKey = req.Key
+		requests[req.To] = append(requests[req.To], from)
+	})
+	mux.HandleFunc("/connect-requests", func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		deadline := time.Now().Add(time.Second)
+		for {
+			mu.Lock()
+			pending := requests[id]
+			delete(requests, id)
+			mu.Unlock()
+			if len(pending) > 0 || time.Now().After(deadline) || r.Context().Err() != nil {
+				json.NewEncoder(w).Encode(append([]PeerInfo{}, pending...))
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// newTestPeer starts a registered peer on loopback that answers connection requests
+func newTestPeer(t *testing.T, id, signalingURL string) *Peer {
+	t.Helper()
+
+	peer, err := NewPeer(Config{PeerID: id, SignalingURL: signalingURL, RegisterInterval: -1, NetworkPollInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	if err := peer.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	peer.mu.Lock()
+	peer.candidates = []Candidate{{IP: "127.0.0.1", Port: peer.GetActualPort(), Type: HostCandidate}}
+	peer.mu.Unlock()
+	if err := peer.Register(); err != nil {
+		t.Fatal(err)
+	}
+	go peer.ContinuousHolePunch(context.Background())
+	return peer
+}
+
+func TestSimultaneousConnect(t *testing.T) {
+	signaling := newTestSignaling(t)
+	alice := newTestPeer(t, "alice", signaling.URL)
+	bob := newTestPeer(t, "bob", signaling.URL)
+
+	// Each peer dials while it punches for the connection request of the
+	// other, so both hold a dial and a burst toward the same peer
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	for _, c := range []struct {
+		peer   *Peer
+		remote string
+	}{{alice, "bob"}, {bob, "alice"}} {
+		go func() {
+			conn, err := c.peer.Connect(c.remote)
+			results <- result{conn, err}
+		}()
+	}
+
+	for range 2 {
+		r := <-results
+		if r.err != nil {
+			t.Fatalf("Connect() error = %v", r.err)
+		}
+	}
+
+	// Both sides keep a connection to the other
+	for _, c := range []struct {
+		peer   *Peer
+		remote string
+	}{{alice, "bob"}, {bob, "alice"}} {
+		conn, err := c.peer.Connect(c.remote)
+		if err != nil {
+			t.Fatalf("Connect(%q) after the simultaneous open error = %v", c.remote, err)
+		}
+		if conn.RemotePeerID() != c.remote {
+			t.Errorf("RemotePeerID() = %q, want %q", conn.RemotePeerID(), c.remote)
+		}
+	}
+}
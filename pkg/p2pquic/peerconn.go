@@ -0,0 +1,346 @@
+package p2pquic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// DefaultReconnectAttempts is used when WithMaxReconnectAttempts is not given
+	DefaultReconnectAttempts = 10
+
+	// defaultMinBackoff and defaultMaxBackoff bound the delay between reconnect attempts
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+
+	// closeErrorCode closes a connection on request of the application
+	closeErrorCode quic.ApplicationErrorCode = 0x0
+)
+
+// ErrReconnecting is returned by PeerConn.OpenStream while the connection is
+// being re-established and stream opens are not buffered
+var ErrReconnecting = errors.New("connection is reconnecting")
+
+// ErrConnectionFailed is returned by a PeerConn that gave up reconnecting
+var ErrConnectionFailed = errors.New("connection failed")
+
+// ConnState is the state of a PeerConn
+type ConnState int
+
+const (
+	// StateConnecting is the state until the first connection is established
+	StateConnecting ConnState = iota
+
+	// StateConnected means a live connection is available
+	StateConnected
+
+	// StateReconnecting means the connection was lost and is re-established
+	StateReconnecting
+
+	// StateFailed means all reconnect attempts failed, the PeerConn is unusable
+	StateFailed
+
+	// StateClosed means the PeerConn was closed by the application
+	StateClosed
+)
+
+// String returns the name of the state
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateFailed:
+		return "failed"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// PeerConn is a connection to a remote peer that re-establishes itself with
+// signaling lookup, hole punching and dialing whenever the underlying QUIC
+// connection is lost. It is safe for concurrent use.
+type PeerConn struct {
+	peer         *Peer
+	remotePeerID string
+	opts         []ConnectOption
+	cfg          *connectConfig
+
+	mu         sync.Mutex
+	conn       *Conn
+	state      ConnState
+	err        error         // last connection error, set in StateFailed
+	changed    chan struct{} // closed and replaced on every state change
+	reconnects int
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Dial connects to a remote peer and returns a PeerConn that reconnects with
+// exponential backoff when the connection is lost. The first connection is
+// retried with the same backoff until it succeeds, the attempts are used up
+// or ctx is done.
+func (p *Peer) Dial(ctx context.Context, remotePeerID string, opts ...ConnectOption) (*PeerConn, error) {
+	cfg := &connectConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	pc := &PeerConn{
+		peer:         p,
+		remotePeerID: remotePeerID,
+		opts:         append(slices.Clone(opts), managedConnect()),
+		cfg:          cfg,
+		state:        StateConnecting,
+		changed:      make(chan struct{}),
+		closed:       make(chan struct{}),
+	}
+	pc.notify(StateConnecting, nil)
+
+	conn, err := pc.connect(ctx)
+	if err != nil {
+		pc.setState(StateFailed, nil, err)
+		return nil, err
+	}
+
+	pc.setState(StateConnected, conn, nil)
+	go pc.monitor(conn)
+	return pc, nil
+}
+
+// RemotePeerID returns the ID of the remote peer
+func (pc *PeerConn) RemotePeerID() string {
+	return pc.remotePeerID
+}
+
+// State returns the current state
+func (pc *PeerConn) State() ConnState {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.state
+}
+
+// Conn returns the current connection, or nil while reconnecting.
+// The returned connection is replaced after a reconnect.
+func (pc *PeerConn) Conn() *Conn {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.state != StateConnected {
+		return nil
+	}
+	return pc.conn
+}
+
+// OpenStream opens a stream on the current connection. While reconnecting it
+// returns ErrReconnecting, or waits for the new connection when stream opens
+// are buffered with WithBufferedStreams.
+func (pc *PeerConn) OpenStream(ctx context.Context) (*quic.Stream, error) {
+	for {
+		conn, err := pc.current(ctx, pc.cfg.bufferStreams)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := conn.OpenStreamSync(ctx)
+		if err == nil || ctx.Err() != nil || !pc.cfg.bufferStreams || conn.Context().Err() == nil {
+			return stream, err
+		}
+		// The connection was lost while opening, wait for the next one
+	}
+}
+
+// AcceptStream accepts the next stream the remote peer opens, across reconnects
+func (pc *PeerConn) AcceptStream(ctx context.Context) (*quic.Stream, error) {
+	for {
+		conn, err := pc.current(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := conn.AcceptStream(ctx)
+		if err == nil || ctx.Err() != nil || conn.Context().Err() == nil {
+			return stream, err
+		}
+	}
+}
+
+// Close closes the connection and stops reconnecting
+func (pc *PeerConn) Close() error {
+	pc.mu.Lock()
+	conn := pc.conn
+	pc.mu.Unlock()
+
+	pc.closeOnce.Do(func() { close(pc.closed) })
+	pc.setState(StateClosed, nil, nil)
+	if conn != nil {
+		return conn.CloseWithError(closeErrorCode, "closed")
+	}
+	return nil
+}
+
+// current returns the live connection. With wait it blocks while
+// (re)connecting, otherwise it returns ErrReconnecting.
+func (pc *PeerConn) current(ctx context.Context, wait bool) (*Conn, error) {
+	for {
+		pc.mu.Lock()
+		state, conn, err, changed := pc.state, pc.conn, pc.err, pc.changed
+		pc.mu.Unlock()
+
+		switch state {
+		case StateConnected:
+			if conn.Context().Err() == nil {
+				return conn, nil
+			}
+		case StateFailed:
+			return nil, fmt.Errorf("%w: %w", ErrConnectionFailed, err)
+		case StateClosed:
+			return nil, net.ErrClosed
+		}
+
+		if !wait {
+			return nil, ErrReconnecting
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// monitor waits for the loss of a connection and re-establishes it
+func (pc *PeerConn) monitor(conn *Conn) {
+	for {
+		select {
+		case <-conn.Context().Done():
+		case <-pc.closed:
+			return
+		}
+
+		select {
+		case <-pc.closed:
+			return
+		default:
+		}
+
+		pc.peer.log.Warn("Connection lost, reconnecting", "peer_id", pc.remotePeerID, "err", context.Cause(conn.Context()))
+		pc.setState(StateReconnecting, nil, context.Cause(conn.Context()))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-pc.closed:
+			case <-pc.peer.done:
+			case <-ctx.Done():
+			}
+			cancel()
+		}()
+		next, err := pc.connect(ctx)
+		cancel()
+
+		if err != nil {
+			select {
+			case <-pc.closed:
+			default:
+				pc.peer.log.Error("Giving up reconnecting", "peer_id", pc.remotePeerID, "err", err)
+				pc.setState(StateFailed, nil, err)
+			}
+			return
+		}
+
+		select {
+		case <-pc.closed:
+			next.CloseWithError(closeErrorCode, "closed")
+			return
+		default:
+		}
+
+		pc.peer.log.Info("Reconnected", "peer_id", pc.remotePeerID)
+		pc.mu.Lock()
+		pc.reconnects++
+		pc.mu.Unlock()
+		pc.setState(StateConnected, next, nil)
+		conn = next
+	}
+}
+
+// connect calls Connect with exponential backoff until it succeeds, the
+// attempts are used up or ctx is done
+func (pc *PeerConn) connect(ctx context.Context) (*Conn, error) {
+	attempts := pc.cfg.maxAttempts
+	if attempts == 0 {
+		attempts = DefaultReconnectAttempts
+	}
+	backoff := pc.cfg.minBackoff
+	if backoff <= 0 {
+		backoff = defaultMinBackoff
+	}
+	maxBackoff := pc.cfg.maxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		conn, err := pc.peer.ConnectContext(ctx, pc.remotePeerID, pc.opts...)
+		if err == nil {
+			return conn, nil
+		}
+		if errors.Is(err, ErrPeerClosed) {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempts > 0 && attempt >= attempts {
+			return nil, fmt.Errorf("%d attempts to connect to %s failed, last error: %w", attempt, pc.remotePeerID, err)
+		}
+
+		// Back off with up to 20% jitter, so peers that lost their
+		// connections at the same time do not retry in lockstep
+		delay := backoff - time.Duration(rand.Int64N(int64(backoff)/5+1))
+		pc.peer.log.Info("Connect attempt failed, retrying", "peer_id", pc.remotePeerID, "attempt", attempt, "delay", delay.Round(time.Millisecond), "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-pc.peer.done:
+			return nil, ErrPeerClosed
+		case <-time.After(delay):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// setState changes the state, wakes up waiting calls and calls the state handler
+func (pc *PeerConn) setState(state ConnState, conn *Conn, err error) {
+	pc.mu.Lock()
+	if pc.state == StateClosed {
+		pc.mu.Unlock()
+		return
+	}
+	pc.state = state
+	pc.conn = conn
+	pc.err = err
+	close(pc.changed)
+	pc.changed = make(chan struct{})
+	pc.mu.Unlock()
+
+	pc.notify(state, err)
+}
+
+// notify calls the state handler, if any
+func (pc *PeerConn) notify(state ConnState, err error) {
+	if pc.cfg.onStateChange != nil {
+		pc.cfg.onStateChange(state, err)
+	}
+}
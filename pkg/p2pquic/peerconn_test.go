@@ -0,0 +1,68 @@
+package p2pquic
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerConnReconnect(t *testing.T) {
+	signaling := newTestSignaling(t)
+	newTestPeer(t, "alice", signaling.URL)
+	bob := newTestPeer(t, "bob", signaling.URL)
+
+	states := make(chan ConnState, 16)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pc, err := bob.Dial(ctx, "alice", WithReconnectBackoff(10*time.Millisecond, 50*time.Millisecond), WithStateHandler(func(state ConnState, err error) {
+		states <- state
+	}))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer pc.Close()
+
+	// waitState waits for the state handler to report state
+	waitState := func(want ConnState) {
+		t.Helper()
+		for {
+			select {
+			case state := <-states:
+				if state == want {
+					return
+				}
+			case <-ctx.Done():
+				t.Fatalf("state %s was not reported", want)
+			}
+		}
+	}
+	waitState(StateConnected)
+
+	// Losing the connection dials a new one
+	first := pc.Conn()
+	first.CloseWithError(0, "lost")
+	waitState(StateReconnecting)
+	waitState(StateConnected)
+
+	if conn := pc.Conn(); conn == nil || conn == first {
+		t.Fatal("Conn() after a reconnect is not a new connection")
+	}
+	if got := pc.Stats().Reconnects; got != 1 {
+		t.Errorf("Reconnects = %d, want 1", got)
+	}
+	stream, err := pc.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("OpenStream() after a reconnect error = %v", err)
+	}
+	stream.Close()
+
+	pc.Close()
+	if pc.State() != StateClosed {
+		t.Errorf("State() after Close = %s, want %s", pc.State(), StateClosed)
+	}
+	if _, err := pc.OpenStream(ctx); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("OpenStream() after Close error = %v, want net.ErrClosed", err)
+	}
+}
@@ -0,0 +1,843 @@
+package p2pquic
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Punch packets are sent on the same UDP socket as QUIC. Their first byte has
+// the two most significant bits cleared, so quic-go hands them to
+// Transport.ReadNonQUICPacket instead of treating them as QUIC packets.
+//
+// Packet layout:
+//
+//	magic (4) | type (1) | nonce (16) | len (1) | sender ID | len (1) | target ID | MAC (16)
+//
+// The MAC is a truncated HMAC-SHA256 over everything before it, keyed with a
+// key derived from both peers: the punch key of the peer that accepts the
+// connection, which it publishes through the signaling server, and a random
+// connect key of the peer that connects, which is generated for every
+// connection attempt and only delivered to the accepting peer with the
+// connection request. So looking up a peer is not enough to make it answer
+// punches. Packets in both directions, and replies that echo the nonce of a
+// request, are authenticated with the same key.
+var punchMagic = [4]byte{0x1f, 'P', '2', 'P'}
+
+const (
+	punchRequest byte = 1
+	punchReply   byte = 2
+
+	punchNonceSize = 16
+	punchMACSize   = 16
+
+	// punchKeySize is the size of the random punch key of a peer, and of the
+	// connect key of a connection attempt
+	punchKeySize = 32
+
+	// punchInterval is the time between punch rounds during Connect
+	punchInterval = 200 * time.Millisecond
+
+	// punchTimeout is how long Connect punches before giving up on confirmation
+	punchTimeout = 5 * time.Second
+
+	// unconfirmedPunchWait is how long Connect punches peers without a punch key
+	unconfirmedPunchWait = 2 * time.Second
+
+	// maxOutstandingNonces bounds the nonces remembered per remote peer
+	maxOutstandingNonces = 64
+
+	// connectRequestWait is how long a single long poll for connection requests waits
+	connectRequestWait = 30 * time.Second
+
+	// connectRequestRetry is the delay before retrying a failed long poll
+	connectRequestRetry = 5 * time.Second
+
+	// punchStateTTL is how long the punch state of an idle remote peer is kept
+	punchStateTTL = 2 * time.Minute
+)
+
+var errInvalidPunch = errors.New("invalid punch packet")
+
+// errNoPunchReply is the error of a candidate that never answered our punches
+var errNoPunchReply = errors.New("no punch reply")
+
+// punchPacket is a decoded punch request or reply
+type punchPacket struct {
+	typ    byte
+	nonce  [punchNonceSize]byte
+	sender string
+	target string
+}
+
+// marshal encodes the packet and appends its MAC
+func (pp *punchPacket) marshal(key []byte) []byte {
+	b := make([]byte, 0, len(punchMagic)+1+punchNonceSize+2+len(pp.sender)+len(pp.target)+punchMACSize)
+	b = append(b, punchMagic[:]...)
+	b = append(b, pp.typ)
+	b = append(b, pp.nonce[:]...)
+	b = append(b, byte(len(pp.sender)))
+	b = append(b, pp.sender...)
+	b = append(b, byte(len(pp.target)))
+	b = append(b, pp.target...)
+	return append(b, punchMAC(key, b)...)
+}
+
+// isPunchPacket reports whether b starts with the punch magic
+func isPunchPacket(b []byte) bool {
+	return len(b) >= len(punchMagic) && [4]byte(b[:4]) == punchMagic
+}
+
+// unmarshalPunch decodes a punch packet and verifies its MAC with the keys
+// returned by keysFor, which receives the decoded (not yet verified) packet.
+// It returns the packet and the key that verified it.
+func unmarshalPunch(b []byte, keysFor func(*punchPacket) [][]byte) (*punchPacket, []byte, error) {
+	if !isPunchPacket(b) || len(b) < len(punchMagic)+1+punchNonceSize+2+punchMACSize {
+		return nil, nil, errInvalidPunch
+	}
+
+	pp := &punchPacket{typ: b[4]}
+	copy(pp.nonce[:], b[5:5+punchNonceSize])
+
+	rest := b[5+punchNonceSize : len(b)-punchMACSize]
+	var ok bool
+	if pp.sender, rest, ok = readShortString(rest); !ok {
+		return nil, nil, errInvalidPunch
+	}
+	if pp.target, rest, ok = readShortString(rest); !ok || len(rest) != 0 {
+		return nil, nil, errInvalidPunch
+	}
+
+	keys := keysFor(pp)
+	if len(keys) == 0 {
+		return nil, nil, fmt.Errorf("%w: no key for %s", errInvalidPunch, pp.sender)
+	}
+	signed, mac := b[:len(b)-punchMACSize], b[len(b)-punchMACSize:]
+	for _, key := range keys {
+		if hmac.Equal(mac, punchMAC(key, signed)) {
+			return pp, key, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%w: bad MAC from %s", errInvalidPunch, pp.sender)
+}
+
+// readShortString reads a length-prefixed string of at most 255 bytes
+func readShortString(b []byte) (string, []byte, bool) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", nil, false
+	}
+	n := int(b[0])
+	return string(b[1 : 1+n]), b[1+n:], true
+}
+
+// punchMAC computes the truncated HMAC of a punch packet
+func punchMAC(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)[:punchMACSize]
+}
+
+// pairKey derives the MAC key of the punches between two peers from the
+// punch key of the accepting peer and the connect key of the connecting peer.
+// It returns nil when either key is missing.
+func pairKey(punchKey, connectKey []byte) []byte {
+	if len(punchKey) == 0 || len(connectKey) == 0 {
+		return nil
+	}
+	mac := hmac.New(sha256.New, punchKey)
+	mac.Write(connectKey)
+	return mac.Sum(nil)
+}
+
+// newPunchKey generates a random punch key or connect key
+func newPunchKey() []byte {
+	key := make([]byte, punchKeySize)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// CandidateState is the hole-punching state of a remote candidate
+type CandidateState int
+
+const (
+	// CandidateSent means punches were sent but nothing was received yet
+	CandidateSent CandidateState = iota + 1
+
+	// CandidateReceived means a valid punch was received from the candidate
+	CandidateReceived
+
+	// CandidateConfirmed means a valid reply to our punch was received from
+	// the candidate, so the path works in both directions
+	CandidateConfirmed
+)
+
+// String returns the name of the state
+func (s CandidateState) String() string {
+	switch s {
+	case CandidateSent:
+		return "sent"
+	case CandidateReceived:
+		return "received"
+	case CandidateConfirmed:
+		return "confirmed"
+	}
+	return "unknown"
+}
+
+// CandidateStatus is the hole-punching status of a remote candidate
+type CandidateStatus struct {
+	Candidate    Candidate
+	State        CandidateState
+	PunchesSent  int
+	LastSent     time.Time
+	LastReceived time.Time
+}
+
+// unansweredPunches counts the punches sent to an address since it last sent anything back
+type unansweredPunches struct {
+	count   int
+	last    time.Time // when the last punch was sent
+	blocked time.Time // when the count reached maxUnansweredPunches
+}
+
+// remotePunch holds the punch state of one remote peer
+type remotePunch struct {
+	fingerprint []byte
+	registered  []Candidate                   // candidates from signaling or WithCandidates
+	attempts    []*punchAttempt               // connection attempts in progress
+	candidates  map[string]*CandidateStatus   // by address
+	unanswered  map[string]*unansweredPunches // by address, kept across connection attempts
+	stats       PunchStats
+	lastActive  time.Time
+}
+
+// punchAttempt is the punch state of one connection attempt with a remote
+// peer: a dial of ours, or a burst that answers a connection request of the
+// peer. Every attempt has the MAC key of its own connect key, so when both
+// peers connect to each other at the same time, the dial and the burst
+// toward the same peer each verify and answer the punches of their key.
+type punchAttempt struct {
+	peerID     string
+	key        []byte // nil when the remote peer cannot answer, see sendPunch
+	nonces     map[[punchNonceSize]byte]struct{}
+	nonceOrder [][punchNonceSize]byte
+	addrs      map[string]Candidate // confirmed candidates, by address
+	confirmed  chan struct{}        // closed on the first confirmation
+}
+
+// punchTable tracks the punch state of all remote peers and enforces the
+// safeguards that keep punching from being abused for reflection attacks
+type punchTable struct {
+	mu         sync.Mutex
+	peers      map[string]*remotePunch
+	limits     *punchLimits
+	log        *slog.Logger
+	broadcasts broadcastCache
+	lastGC     time.Time
+}
+
+// newPunchTable creates an empty punch table with the rate limits of the config
+func newPunchTable(config Config) *punchTable {
+	return &punchTable{
+		peers:  make(map[string]*remotePunch),
+		limits: newPunchLimits(config),
+		log:    config.Logger,
+		lastGC: time.Now(),
+	}
+}
+
+// remote returns the state of a remote peer, creating it if needed, and
+// drops the state of peers that were idle for too long and have no
+// connection attempt in progress (caller holds the lock)
+func (t *punchTable) remote(peerID string) *remotePunch {
+	now := time.Now()
+	if now.Sub(t.lastGC) >= time.Minute {
+		t.lastGC = now
+		for id, r := range t.peers {
+			if len(r.attempts) == 0 && now.Sub(r.lastActive) > punchStateTTL {
+				delete(t.peers, id)
+			}
+		}
+	}
+
+	r, ok := t.peers[peerID]
+	if !ok {
+		r = &remotePunch{
+			candidates: make(map[string]*CandidateStatus),
+			unanswered: make(map[string]*unansweredPunches),
+		}
+		t.peers[peerID] = r
+	}
+	r.lastActive = now
+	return r
+}
+
+// begin starts a connection attempt with a remote peer whose punches are
+// authenticated with key (see pairKey), and stores the registered candidates
+// and certificate fingerprint of the peer like setPeer. The candidates of
+// earlier attempts are forgotten, unless another attempt is still in
+// progress; the statistics and the unanswered punch counts that did not
+// expire yet are kept.
+func (t *punchTable) begin(info *PeerInfo, key []byte) *punchAttempt {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r := t.remote(info.ID)
+	r.update(info)
+	if len(r.attempts) == 0 {
+		r.candidates = make(map[string]*CandidateStatus)
+	}
+
+	now := time.Now()
+	for addr, u := range r.unanswered {
+		if u.expired(now) {
+			delete(r.unanswered, addr)
+		}
+	}
+
+	a := &punchAttempt{
+		peerID:    info.ID,
+		key:       key,
+		nonces:    make(map[[punchNonceSize]byte]struct{}),
+		addrs:     make(map[string]Candidate),
+		confirmed: make(chan struct{}),
+	}
+	r.attempts = append(r.attempts, a)
+	return a
+}
+
+// end finishes a connection attempt, after which punches with its key are
+// no longer verified or answered
+func (t *punchTable) end(a *punchAttempt) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if r, ok := t.peers[a.peerID]; ok {
+		r.attempts = slices.DeleteFunc(r.attempts, func(other *punchAttempt) bool { return other == a })
+	}
+}
+
+// expired reports whether the count no longer applies: the cooldown after
+// the last punch, or after the count was reached, has passed
+func (u *unansweredPunches) expired(now time.Time) bool {
+	if !u.blocked.IsZero() {
+		return now.Sub(u.blocked) >= unansweredCooldown
+	}
+	return now.Sub(u.last) >= unansweredCooldown
+}
+
+// candidate returns the status of a remote address, creating it if needed.
+// It returns nil when the peer already has the maximum number of addresses (caller holds the lock).
+func (r *remotePunch) candidate(addr *net.UDPAddr) *CandidateStatus {
+	key := addr.String()
+	c, ok := r.candidates[key]
+	if !ok {
+		if len(r.candidates) >= maxPunchCandidates {
+			return nil
+		}
+		c = &CandidateStatus{Candidate: Candidate{IP: addr.IP.String(), Port: addr.Port}}
+		r.candidates[key] = c
+	}
+	return c
+}
+
+// setPeer stores the registered candidates of a remote peer, and its
+// certificate fingerprint if it is known
+func (t *punchTable) setPeer(info *PeerInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.remote(info.ID).update(info)
+}
+
+// update stores the registered candidates and fingerprint of info (caller holds the lock)
+func (r *remotePunch) update(info *PeerInfo) {
+	r.registered = info.Candidates
+	if len(info.Fingerprint) > 0 {
+		r.fingerprint = info.Fingerprint
+	}
+}
+
+// fingerprint returns the certificate fingerprint of a remote peer, or nil if unknown
+func (t *punchTable) fingerprint(peerID string) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if r, ok := t.peers[peerID]; ok {
+		return r.fingerprint
+	}
+	return nil
+}
+
+// remoteCandidate returns the registered candidate of a remote peer with
+// address addr, or a peer-reflexive candidate if it was never registered
+func (t *punchTable) remoteCandidate(peerID string, addr net.Addr) Candidate {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	udpAddr, _ := addr.(*net.UDPAddr)
+	if udpAddr == nil {
+		return Candidate{Type: PeerReflexiveCandidate}
+	}
+	c := Candidate{IP: udpAddr.IP.String(), Port: udpAddr.Port}
+	if r, ok := t.peers[peerID]; ok {
+		return r.typed(c)
+	}
+	c.Type = PeerReflexiveCandidate
+	return c
+}
+
+// typed returns c with the type of the registered candidate with the same
+// address, or as peer-reflexive candidate (caller holds the lock)
+func (r *remotePunch) typed(c Candidate) Candidate {
+	for _, registered := range r.registered {
+		if registered.IP == c.IP && registered.Port == c.Port {
+			return registered
+		}
+	}
+	c.Type = PeerReflexiveCandidate
+	return c
+}
+
+// keys returns the MAC keys of the connection attempts with a remote peer
+// that are in progress
+func (t *punchTable) keys(peerID string) [][]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var keys [][]byte
+	if r, ok := t.peers[peerID]; ok {
+		for _, a := range r.attempts {
+			if a.key != nil {
+				keys = append(keys, a.key)
+			}
+		}
+	}
+	return keys
+}
+
+// attempt returns the connection attempt with a remote peer in progress
+// whose punches are authenticated with key, or nil if there is none
+func (t *punchTable) attempt(peerID string, key []byte) *punchAttempt {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if r, ok := t.peers[peerID]; ok {
+		for _, a := range r.attempts {
+			if a.key != nil && bytes.Equal(a.key, key) {
+				return a
+			}
+		}
+	}
+	return nil
+}
+
+// send checks whether a punch request of an attempt may be sent to addr. If
+// so, it records the punch and remembers its nonce in the attempt, otherwise
+// the refusal is counted.
+func (t *punchTable) send(a *punchAttempt, addr *net.UDPAddr, nonce [punchNonceSize]byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r := t.remote(a.peerID)
+	err := t.allowSend(r, addr)
+	if err != nil {
+		r.stats.count(err)
+		return err
+	}
+
+	c := r.candidate(addr)
+	c.PunchesSent++
+	c.LastSent = time.Now()
+	if c.State == 0 {
+		c.State = CandidateSent
+	}
+	r.stats.Sent++
+
+	u, ok := r.unanswered[addr.String()]
+	if !ok {
+		u = &unansweredPunches{}
+		r.unanswered[addr.String()] = u
+	}
+	u.count++
+	u.last = c.LastSent
+
+	a.nonces[nonce] = struct{}{}
+	a.nonceOrder = append(a.nonceOrder, nonce)
+	if len(a.nonceOrder) > maxOutstandingNonces {
+		delete(a.nonces, a.nonceOrder[0])
+		a.nonceOrder = a.nonceOrder[1:]
+	}
+
+	return nil
+}
+
+// allowSend applies the punch safeguards to a destination (caller holds the lock)
+func (t *punchTable) allowSend(r *remotePunch, addr *net.UDPAddr) error {
+	if !t.broadcasts.validPunchAddr(addr) {
+		return errPunchAddress
+	}
+	c := r.candidate(addr)
+	if c == nil {
+		return errPunchCandidates
+	}
+	if u, ok := r.unanswered[addr.String()]; ok {
+		now := time.Now()
+		if u.expired(now) {
+			delete(r.unanswered, addr.String())
+		} else if u.count >= maxUnansweredPunches {
+			if u.blocked.IsZero() {
+				u.blocked = now
+				t.log.Debug("Stopped punching unanswered candidate", "candidate", addr.String(), "punches", maxUnansweredPunches, "cooldown", unansweredCooldown)
+			}
+			return errPunchUnanswered
+		}
+	}
+	if !t.limits.allow(addr) {
+		return errPunchRate
+	}
+	return nil
+}
+
+// allowReply checks whether a reply to a punch from addr may be sent and
+// counts the refusal if not
+func (t *punchTable) allowReply(peerID string, addr *net.UDPAddr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.limits.allow(addr) {
+		return true
+	}
+	t.remote(peerID).stats.count(errPunchRate)
+	return false
+}
+
+// validSource reports whether punches from addr may be answered at all
+func (t *punchTable) validSource(addr *net.UDPAddr) bool {
+	return t.broadcasts.validPunchAddr(addr)
+}
+
+// received records a valid punch request from addr. It reports whether we
+// should punch back: the address is not confirmed yet and we did not punch
+// it recently.
+func (t *punchTable) received(peerID string, addr *net.UDPAddr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r := t.remote(peerID)
+	r.stats.Received++
+	c := r.candidate(addr)
+	if c == nil {
+		return false
+	}
+	c.LastReceived = time.Now()
+	delete(r.unanswered, addr.String())
+	if c.State < CandidateReceived {
+		c.State = CandidateReceived
+	}
+
+	return c.State != CandidateConfirmed && time.Since(c.LastSent) >= punchInterval
+}
+
+// confirm records a valid reply from addr to an attempt. It returns true
+// only when the reply answers one of the outstanding punches of the attempt
+// and newly confirms the address for it.
+func (t *punchTable) confirm(a *punchAttempt, addr *net.UDPAddr, nonce [punchNonceSize]byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, ok := t.peers[a.peerID]
+	if !ok {
+		return false
+	}
+	if _, ok := a.nonces[nonce]; !ok {
+		return false
+	}
+	delete(a.nonces, nonce)
+	r.stats.Replies++
+
+	c := r.candidate(addr)
+	if c == nil {
+		return false
+	}
+	c.LastReceived = time.Now()
+	delete(r.unanswered, addr.String())
+	c.State = CandidateConfirmed
+	if _, ok := a.addrs[addr.String()]; ok {
+		return false
+	}
+
+	a.addrs[addr.String()] = c.Candidate
+	select {
+	case <-a.confirmed:
+	default:
+		close(a.confirmed)
+	}
+	return true
+}
+
+// confirmedCandidates returns the candidates confirmed for an attempt
+func (t *punchTable) confirmedCandidates(a *punchAttempt) []Candidate {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var candidates []Candidate
+	r, ok := t.peers[a.peerID]
+	for _, c := range a.addrs {
+		if ok {
+			c = r.typed(c)
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates
+}
+
+// status returns a copy of the candidate statuses of a peer
+func (t *punchTable) status(peerID string) []CandidateStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var statuses []CandidateStatus
+	if r, ok := t.peers[peerID]; ok {
+		for _, c := range r.candidates {
+			statuses = append(statuses, *c)
+		}
+	}
+	return statuses
+}
+
+// stats returns the punch statistics of a peer
+func (t *punchTable) stats(peerID string) PunchStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if r, ok := t.peers[peerID]; ok {
+		return r.stats
+	}
+	return PunchStats{}
+}
+
+// PunchState returns the hole-punching state of every known candidate of a remote peer,
+// including peer-reflexive addresses that punches were received from
+func (p *Peer) PunchState(remotePeerID string) []CandidateStatus {
+	return p.punches.status(remotePeerID)
+}
+
+// PunchStats returns the punch traffic statistics of a remote peer, including
+// the number of punches refused by the reflection safeguards
+func (p *Peer) PunchStats(remotePeerID string) PunchStats {
+	return p.punches.stats(remotePeerID)
+}
+
+// sendPunch sends a punch request of an attempt to a remote candidate,
+// authenticated with the key of the attempt. Without a key, the packet still
+// opens the local NAT mapping, but the remote peer cannot verify or answer it.
+func (p *Peer) sendPunch(a *punchAttempt, addr *net.UDPAddr) error {
+	pp := &punchPacket{typ: punchRequest, sender: p.config.PeerID, target: a.peerID}
+	if _, err := rand.Read(pp.nonce[:]); err != nil {
+		return err
+	}
+
+	key := a.key
+	if key == nil {
+		key = make([]byte, punchKeySize)
+	}
+
+	if err := p.punches.send(a, addr, pp.nonce); err != nil {
+		return err
+	}
+	if err := p.writeTo(pp.marshal(key), addr); err != nil {
+		return err
+	}
+	p.emit(Event{Type: EventPunchSent, PeerID: a.peerID, Candidate: p.punches.remoteCandidate(a.peerID, addr)})
+	return nil
+}
+
+// readLoop reads the non-QUIC packets (punches and STUN responses) of the shared UDP socket until the transport is closed
+func (p *Peer) readLoop(tr *quic.Transport) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := tr.ReadNonQUICPacket(p.ctx, buf)
+		if err != nil {
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		switch {
+		case isPunchPacket(buf[:n]):
+			p.handlePunch(buf[:n], udpAddr)
+		case isSTUNPacket(buf[:n]):
+			p.handleSTUN(buf[:n])
+		}
+	}
+}
+
+// handlePunch verifies an incoming punch packet against the keys of the
+// connection attempts with its sender, answers requests and confirms
+// candidates of the attempt on replies
+func (p *Peer) handlePunch(b []byte, addr *net.UDPAddr) {
+	pp, key, err := unmarshalPunch(b, func(pp *punchPacket) [][]byte {
+		if pp.typ != punchRequest && pp.typ != punchReply {
+			return nil
+		}
+		return p.punches.keys(pp.sender)
+	})
+	if err != nil {
+		p.log.Debug("Dropped punch packet", "addr", addr.String(), "err", err)
+		return
+	}
+	if !p.punches.validSource(addr) {
+		p.log.Debug("Dropped punch packet from non-unicast address", "addr", addr.String())
+		return
+	}
+	if pp.target != p.config.PeerID {
+		p.log.Debug("Dropped punch packet for another peer", "addr", addr.String(), "target", pp.target)
+		return
+	}
+	a := p.punches.attempt(pp.sender, key)
+	if a == nil {
+		p.log.Debug("Dropped punch packet of a finished attempt", "addr", addr.String(), "peer_id", pp.sender)
+		return
+	}
+
+	p.emit(Event{Type: EventPunchReceived, PeerID: pp.sender, Candidate: p.punches.remoteCandidate(pp.sender, addr)})
+
+	switch pp.typ {
+	case punchRequest:
+		punchBack := p.punches.received(pp.sender, addr)
+
+		if p.punches.allowReply(pp.sender, addr) {
+			reply := &punchPacket{typ: punchReply, nonce: pp.nonce, sender: p.config.PeerID, target: pp.sender}
+			if err := p.writeTo(reply.marshal(key), addr); err != nil {
+				p.log.Debug("Failed to answer punch", "peer_id", pp.sender, "candidate", addr.String(), "err", err)
+			}
+		}
+
+		// Punch back, so the path gets confirmed in our direction too. This
+		// also covers peer-reflexive addresses that were never registered.
+		if punchBack {
+			p.sendPunch(a, addr)
+		}
+	case punchReply:
+		if p.punches.confirm(a, addr, pp.nonce) {
+			p.log.Info("Confirmed candidate", "peer_id", pp.sender, "candidate", addr.String())
+		}
+	}
+}
+
+// punchUntilConfirmed punches all candidates of a remote peer in rounds until
+// one of them is confirmed for the attempt, the timeout expires or ctx is
+// done, and returns the confirmed candidates
+func (p *Peer) punchUntilConfirmed(ctx context.Context, a *punchAttempt, candidates []Candidate, timeout time.Duration) []Candidate {
+	p.punchRounds(ctx, a, candidates, timeout, a.confirmed)
+	return p.punches.confirmedCandidates(a)
+}
+
+// punchRounds punches all candidates of the remote peer of an attempt every
+// punchInterval until done is closed, ctx is done or the timeout expires
+func (p *Peer) punchRounds(ctx context.Context, a *punchAttempt, candidates []Candidate, timeout time.Duration, done <-chan struct{}) {
+	remotePeerID := a.peerID
+	var addrs []*net.UDPAddr
+	for _, candidate := range candidates {
+		addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(candidate.IP, strconv.Itoa(candidate.Port)))
+		if err != nil {
+			p.log.Warn("Failed to resolve candidate", "peer_id", remotePeerID, "candidate", net.JoinHostPort(candidate.IP, strconv.Itoa(candidate.Port)), "err", err)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(punchInterval)
+	defer ticker.Stop()
+
+	for round := 1; ; round++ {
+		for _, addr := range addrs {
+			if err := p.sendPunch(a, addr); err != nil && !errors.Is(err, errPunchRefused) {
+				p.log.Debug("Failed to send punch packet", "peer_id", remotePeerID, "candidate", addr.String(), "err", err)
+			}
+		}
+		if round == 1 {
+			p.log.Debug("Sent punch packets", "peer_id", remotePeerID, "candidates", len(addrs))
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		case <-deadline.C:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// burst is a bounded series of punch rounds toward a peer that requested a connection
+type burst struct {
+	cancel context.CancelFunc
+}
+
+// startBurst punches toward a peer that requested a connection. The burst
+// ends after punchTimeout, when the connection from the peer is accepted or
+// when ctx is done or the peer is closed. A new request from the same peer
+// restarts the burst. The burst is a connection attempt of its own, keyed
+// with the connect key of the request, so it does not disturb a dial of ours
+// to the same peer.
+func (p *Peer) startBurst(ctx context.Context, remote PeerInfo) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(p.ctx, cancel)
+	b := &burst{cancel: cancel}
+
+	p.burstMu.Lock()
+	if old, ok := p.bursts[remote.ID]; ok {
+		old.cancel()
+	}
+	p.bursts[remote.ID] = b
+	p.burstMu.Unlock()
+
+	a := p.punches.begin(&remote, pairKey(p.punchKey, remote.ConnectKey))
+
+	go func() {
+		defer cancel()
+		defer stop()
+		defer p.punches.end(a)
+		p.punchRounds(ctx, a, remote.Candidates, punchTimeout, nil)
+
+		// Clean up, unless a newer burst for the same peer replaced this one
+		p.burstMu.Lock()
+		if p.bursts[remote.ID] == b {
+			delete(p.bursts, remote.ID)
+		}
+		p.burstMu.Unlock()
+	}()
+}
+
+// stopBurst ends the punch burst toward a peer whose connection was accepted
+func (p *Peer) stopBurst(remotePeerID string) {
+	p.burstMu.Lock()
+	defer p.burstMu.Unlock()
+
+	if b, ok := p.bursts[remotePeerID]; ok {
+		b.cancel()
+		delete(p.bursts, remotePeerID)
+		p.log.Debug("Stopped punching: connection established", "peer_id", remotePeerID)
+	}
+}
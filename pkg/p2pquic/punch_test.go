@@ -0,0 +1,206 @@
+package p2pquic
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"testing"
+)
+
+func TestUnmarshalPunch(t *testing.T) {
+	key := newPunchKey()
+	pp := &punchPacket{typ: punchRequest, nonce: [punchNonceSize]byte{1, 2, 3}, sender: "alice", target: "bob"}
+	packet := pp.marshal(key)
+	keyFor := func(*punchPacket) [][]byte { return [][]byte{key} }
+
+	got, gotKey, err := unmarshalPunch(packet, keyFor)
+	if err != nil {
+		t.Fatalf("unmarshalPunch() error = %v", err)
+	}
+	if *got != *pp {
+		t.Fatalf("unmarshalPunch() = %+v, want %+v", got, pp)
+	}
+	if !bytes.Equal(gotKey, key) {
+		t.Fatal("unmarshalPunch() did not return the key of the packet")
+	}
+
+	// With the keys of several attempts, the key that verifies is returned
+	_, gotKey, err = unmarshalPunch(packet, func(*punchPacket) [][]byte { return [][]byte{newPunchKey(), key} })
+	if err != nil || !bytes.Equal(gotKey, key) {
+		t.Fatalf("unmarshalPunch() with several keys error = %v, key matches = %v", err, bytes.Equal(gotKey, key))
+	}
+
+	flipped := func(i int) []byte {
+		b := bytes.Clone(packet)
+		b[i] ^= 0x01
+		return b
+	}
+	tests := []struct {
+		name   string
+		packet []byte
+		keyFor func(*punchPacket) [][]byte
+	}{
+		{"empty", nil, keyFor},
+		{"magic only", packet[:len(punchMagic)], keyFor},
+		{"no MAC", packet[:len(packet)-punchMACSize], keyFor},
+		{"truncated MAC", packet[:len(packet)-1], keyFor},
+		{"trailing byte", append(bytes.Clone(packet), 0), keyFor},
+		{"bad magic", flipped(1), keyFor},
+		{"modified nonce", flipped(len(punchMagic) + 1), keyFor},
+		{"modified sender", flipped(len(punchMagic) + 1 + punchNonceSize + 1), keyFor},
+		{"sender length beyond packet", flipped(len(punchMagic) + 1 + punchNonceSize), keyFor},
+		{"modified MAC", flipped(len(packet) - 1), keyFor},
+		{"other key", packet, func(*punchPacket) [][]byte { return [][]byte{newPunchKey()} }},
+		{"unknown sender", packet, func(*punchPacket) [][]byte { return nil }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := unmarshalPunch(tt.packet, tt.keyFor); !errors.Is(err, errInvalidPunch) {
+				t.Fatalf("unmarshalPunch() error = %v, want errInvalidPunch", err)
+			}
+		})
+	}
+}
+
+func TestPairKey(t *testing.T) {
+	punchKey, connectKey := newPunchKey(), newPunchKey()
+
+	key := pairKey(punchKey, connectKey)
+	if len(key) != punchKeySize {
+		t.Fatalf("pairKey() length = %d, want %d", len(key), punchKeySize)
+	}
+	if !bytes.Equal(key, pairKey(punchKey, connectKey)) {
+		t.Error("pairKey() is not deterministic")
+	}
+	if bytes.Equal(key, pairKey(punchKey, newPunchKey())) {
+		t.Error("pairKey() does not depend on the connect key")
+	}
+	if bytes.Equal(key, pairKey(newPunchKey(), connectKey)) {
+		t.Error("pairKey() does not depend on the punch key")
+	}
+	if bytes.Equal(key, punchKey) || bytes.Equal(key, connectKey) {
+		t.Error("pairKey() returns one of its inputs")
+	}
+	if pairKey(nil, connectKey) != nil || pairKey(punchKey, nil) != nil {
+		t.Error("pairKey() with a missing key is not nil")
+	}
+
+	// A punch authenticated with the punch key alone, which anyone who looks
+	// the peer up knows, must not verify with the key of the pair
+	pp := &punchPacket{typ: punchRequest, sender: "alice", target: "bob"}
+	if _, _, err := unmarshalPunch(pp.marshal(punchKey), func(*punchPacket) [][]byte { return [][]byte{key} }); !errors.Is(err, errInvalidPunch) {
+		t.Errorf("unmarshalPunch() with the punch key error = %v, want errInvalidPunch", err)
+	}
+}
+
+func TestPunchTableNonces(t *testing.T) {
+	table := newPunchTable(Config{Logger: slog.New(slog.DiscardHandler)})
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4242}
+	nonce := [punchNonceSize]byte{1}
+
+	a := table.begin(&PeerInfo{ID: "bob"}, newPunchKey())
+	if table.confirm(a, addr, nonce) {
+		t.Fatal("confirm() without a punch = true")
+	}
+	if err := table.send(a, addr, nonce); err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+	if table.confirm(a, addr, [punchNonceSize]byte{2}) {
+		t.Fatal("confirm() with a nonce that was never sent = true")
+	}
+	if !table.confirm(a, addr, nonce) {
+		t.Fatal("confirm() with the nonce of a punch = false")
+	}
+	if table.confirm(a, addr, nonce) {
+		t.Fatal("confirm() with a replayed nonce = true")
+	}
+
+	// A replayed reply must not confirm a candidate of a later attempt either
+	table.end(a)
+	b := table.begin(&PeerInfo{ID: "bob"}, newPunchKey())
+	if table.confirm(b, addr, nonce) {
+		t.Fatal("confirm() with a replayed nonce of an earlier attempt = true")
+	}
+	if got := table.stats("bob").Replies; got != 1 {
+		t.Errorf("Replies = %d, want 1", got)
+	}
+}
+
+func TestPunchTableNonceLimit(t *testing.T) {
+	table := newPunchTable(Config{Logger: slog.New(slog.DiscardHandler), PunchRatePerDestination: 1000, PunchRate: 1000})
+	a := table.begin(&PeerInfo{ID: "bob"}, newPunchKey())
+
+	// Spread the punches over addresses, so the unanswered limit does not apply
+	nonce := func(i int) [punchNonceSize]byte { return [punchNonceSize]byte{byte(i), byte(i >> 8)} }
+	addr := func(i int) *net.UDPAddr { return &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i%8+1)), Port: 4242} }
+	for i := range maxOutstandingNonces + 1 {
+		if err := table.send(a, addr(i), nonce(i)); err != nil {
+			t.Fatalf("send() %d error = %v", i, err)
+		}
+	}
+
+	if table.confirm(a, addr(0), nonce(0)) {
+		t.Error("confirm() with the oldest nonce beyond the limit = true")
+	}
+	if !table.confirm(a, addr(maxOutstandingNonces), nonce(maxOutstandingNonces)) {
+		t.Error("confirm() with the newest nonce = false")
+	}
+}
+
+func TestPunchTableAttempts(t *testing.T) {
+	table := newPunchTable(Config{Logger: slog.New(slog.DiscardHandler)})
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4242}
+	info := &PeerInfo{ID: "bob", Candidates: []Candidate{{IP: "192.0.2.1", Port: 4242, Type: HostCandidate}}}
+
+	// A dial of ours and a burst for a connection request of the peer, as in
+	// a simultaneous open
+	dialKey, burstKey := newPunchKey(), newPunchKey()
+	dial := table.begin(info, dialKey)
+	burst := table.begin(info, burstKey)
+	if got := table.keys("bob"); len(got) != 2 {
+		t.Fatalf("keys() = %d keys, want 2", len(got))
+	}
+	if table.attempt("bob", dialKey) != dial || table.attempt("bob", burstKey) != burst {
+		t.Fatal("attempt() does not return the attempt of the key")
+	}
+
+	dialNonce, burstNonce := [punchNonceSize]byte{1}, [punchNonceSize]byte{2}
+	if err := table.send(dial, addr, dialNonce); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.send(burst, addr, burstNonce); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reply only confirms the attempt that sent its nonce
+	if table.confirm(burst, addr, dialNonce) {
+		t.Fatal("confirm() with the nonce of another attempt = true")
+	}
+	if !table.confirm(dial, addr, dialNonce) {
+		t.Fatal("confirm() of the dial = false")
+	}
+	select {
+	case <-burst.confirmed:
+		t.Fatal("confirming the dial confirmed the burst")
+	default:
+	}
+
+	// Starting another attempt keeps the candidates of the dial in progress
+	table.end(burst)
+	table.begin(info, newPunchKey())
+	got := table.confirmedCandidates(dial)
+	if len(got) != 1 || got[0].Type != HostCandidate {
+		t.Fatalf("confirmedCandidates() = %v, want the registered candidate", got)
+	}
+	if states := table.status("bob"); len(states) != 1 || states[0].State != CandidateConfirmed {
+		t.Errorf("status() = %v, want the confirmed candidate", states)
+	}
+
+	// A finished attempt is no longer verified
+	table.end(dial)
+	if table.attempt("bob", dialKey) != nil {
+		t.Error("attempt() of a finished attempt != nil")
+	}
+}
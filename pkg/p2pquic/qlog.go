@@ -0,0 +1,114 @@
+package p2pquic
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/qlog"
+	"github.com/quic-go/quic-go/qlogwriter"
+)
+
+// unverifiedQlogPeer names the remote peer in the qlog file of an incoming
+// connection until its peer ID is verified
+const unverifiedQlogPeer = "unverified"
+
+// qlogFileKey is the context key of the qlog file of an incoming connection
+type qlogFileKey struct{}
+
+// qlogFile is the qlog file of an incoming connection, renamed once the
+// remote peer ID is known
+type qlogFile struct {
+	mu     sync.Mutex
+	path   string
+	connID quic.ConnectionID
+}
+
+// bufferedFile buffers the writes of a qlog trace and flushes them on close
+type bufferedFile struct {
+	*bufio.Writer
+	f *os.File
+}
+
+// Close flushes the buffer and closes the file
+func (b bufferedFile) Close() error {
+	err := b.Flush()
+	if cerr := b.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// qlogName returns the qlog file name of a connection, with peer IDs made
+// safe for use in a file name
+func qlogName(localPeerID, remotePeerID string, connID quic.ConnectionID) string {
+	safe := func(id string) string {
+		return strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+				return r
+			}
+			return '_'
+		}, id)
+	}
+	return fmt.Sprintf("%s_%s_%s.sqlog", safe(localPeerID), safe(remotePeerID), connID)
+}
+
+// qlogTracer returns a quic.Config tracer that writes a qlog file per
+// connection to Config.QlogDir, or nil if it is not set. Incoming connections
+// (remotePeerID empty) are renamed by renameQlog once verified.
+func (p *Peer) qlogTracer(remotePeerID string) func(context.Context, bool, quic.ConnectionID) qlogwriter.Trace {
+	dir := p.config.QlogDir
+	if dir == "" {
+		return nil
+	}
+	return func(ctx context.Context, isClient bool, connID quic.ConnectionID) qlogwriter.Trace {
+		peerID := remotePeerID
+		if peerID == "" {
+			peerID = unverifiedQlogPeer
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			p.log.Warn("Failed to create qlog directory", "dir", dir, "err", err)
+			return nil
+		}
+		path := filepath.Join(dir, qlogName(p.config.PeerID, peerID, connID))
+		f, err := os.Create(path)
+		if err != nil {
+			p.log.Warn("Failed to create qlog file", "path", path, "err", err)
+			return nil
+		}
+		if file, ok := ctx.Value(qlogFileKey{}).(*qlogFile); ok {
+			file.mu.Lock()
+			file.path, file.connID = path, connID
+			file.mu.Unlock()
+		}
+
+		trace := qlogwriter.NewConnectionFileSeq(bufferedFile{bufio.NewWriter(f), f}, isClient, connID, []string{qlog.EventSchema})
+		go trace.Run()
+		return trace
+	}
+}
+
+// renameQlog names the qlog file of a verified incoming connection after its remote peer
+func (p *Peer) renameQlog(qconn *quic.Conn, remotePeerID string) {
+	file, ok := qconn.Context().Value(qlogFileKey{}).(*qlogFile)
+	if !ok {
+		return
+	}
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	if file.path == "" {
+		return
+	}
+	path := filepath.Join(filepath.Dir(file.path), qlogName(p.config.PeerID, remotePeerID, file.connID))
+	if err := os.Rename(file.path, path); err != nil {
+		p.log.Warn("Failed to rename qlog file", "path", file.path, "err", err)
+		return
+	}
+	file.path = path
+}
@@ -2,45 +2,126 @@ package p2pquic
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"time"
 )
 
+// NamespaceHeader is the HTTP header that carries the signaling namespace
+const NamespaceHeader = "X-P2PQuic-Namespace"
+
 // SignalingClient handles communication with the signaling server
 type SignalingClient struct {
-	serverURL string
+	serverURL   string
+	namespace   string
+	bearerToken string
+	httpClient  *http.Client
+}
+
+// SignalingOption is a functional option for configuring a SignalingClient
+type SignalingOption func(*SignalingClient)
+
+// WithNamespace scopes registration, lookup and listing to a namespace
+func WithNamespace(namespace string) SignalingOption {
+	return func(s *SignalingClient) {
+		s.namespace = namespace
+	}
+}
+
+// WithBearerToken authenticates requests with a static token or a signed JWT
+func WithBearerToken(token string) SignalingOption {
+	return func(s *SignalingClient) {
+		s.bearerToken = token
+	}
+}
+
+// WithTLSConfig sets the TLS configuration for HTTPS signaling servers,
+// for example to present a client certificate (mTLS) or to trust a private CA
+func WithTLSConfig(tlsConfig *tls.Config) SignalingOption {
+	return func(s *SignalingClient) {
+		s.httpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		}
+	}
 }
 
 // NewSignalingClient creates a new signaling client
-func NewSignalingClient(serverURL string) *SignalingClient {
-	return &SignalingClient{
-		serverURL: serverURL,
+func NewSignalingClient(serverURL string, opts ...SignalingOption) *SignalingClient {
+	s := &SignalingClient{
+		serverURL:  serverURL,
+		httpClient: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// newRequest creates a request to the signaling server
+func (s *SignalingClient) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, s.serverURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.namespace != "" {
+		req.Header.Set(NamespaceHeader, s.namespace)
+	}
+	if s.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.bearerToken)
 	}
+	return req, nil
+}
+
+// maxErrorBody limits how much of an error response is kept in a SignalingError
+const maxErrorBody = 1024
+
+// statusError reads the error response of a failed request
+func statusError(op string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return &SignalingError{Op: op, StatusCode: resp.StatusCode, Message: string(bytes.TrimSpace(body))}
+}
+
+// unavailable wraps an error of a request that did not reach the signaling server
+func unavailable(err error) error {
+	return fmt.Errorf("%w: %w", ErrSignalingUnavailable, err)
 }
 
 // Register registers this peer with the signaling server
 func (s *SignalingClient) Register(peerID string, candidates []Candidate) error {
-	peer := PeerInfo{
-		ID:         peerID,
-		Candidates: candidates,
-	}
+	return s.RegisterPeer(&PeerInfo{ID: peerID, Candidates: candidates})
+}
 
+// RegisterPeer registers this peer with its candidates and punch key
+func (s *SignalingClient) RegisterPeer(peer *PeerInfo) error {
 	data, err := json.Marshal(peer)
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.Post(s.serverURL+"/register", "application/json", bytes.NewReader(data))
+	req, err := s.newRequest(http.MethodPost, "/register", bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return unavailable(err)
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("registration failed: %s", body)
+		return statusError("registration", resp)
 	}
 
 	return nil
@@ -48,14 +129,27 @@ func (s *SignalingClient) Register(peerID string, candidates []Candidate) error
 
 // GetPeer retrieves peer information from signaling server
 func (s *SignalingClient) GetPeer(peerID string) (*PeerInfo, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/peer?id=%s", s.serverURL, peerID))
+	return s.getPeer(context.Background(), peerID)
+}
+
+// getPeer retrieves peer information until ctx is done
+func (s *SignalingClient) getPeer(ctx context.Context, peerID string) (*PeerInfo, error) {
+	req, err := s.newRequest(http.MethodGet, "/peer?id="+url.QueryEscape(peerID), nil)
 	if err != nil {
 		return nil, err
 	}
+
+	resp, err := s.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, unavailable(err)
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("peer not found")
+		return nil, statusError("lookup", resp)
 	}
 
 	var peer PeerInfo
@@ -68,14 +162,89 @@ func (s *SignalingClient) GetPeer(peerID string) (*PeerInfo, error) {
 
 // GetAllPeers retrieves all registered peers from signaling server
 func (s *SignalingClient) GetAllPeers() ([]PeerInfo, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/peers", s.serverURL))
+	req, err := s.newRequest(http.MethodGet, "/peers", nil)
 	if err != nil {
 		return nil, err
 	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError("listing peers", resp)
+	}
+
+	var peers []PeerInfo
+	if err := json.NewDecoder(resp.Body).Decode(&peers); err != nil {
+		return nil, err
+	}
+
+	return peers, nil
+}
+
+// RequestConnect asks the signaling server to notify peer to that peer from
+// wants to connect, so it starts punching toward from's candidates. The
+// connect key is delivered to to only, and authenticates the punches of
+// this connection attempt together with to's punch key.
+func (s *SignalingClient) RequestConnect(from, to string, connectKey []byte) error {
+	return s.requestConnect(context.Background(), from, to, connectKey)
+}
+
+// requestConnect sends a connection request until ctx is done
+func (s *SignalingClient) requestConnect(ctx context.Context, from, to string, connectKey []byte) error {
+	data, err := json.Marshal(struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+		Key  []byte `json:"key,omitempty"`
+	}{from, to, connectKey})
+	if err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(http.MethodPost, "/connect", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return unavailable(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError("connection request", resp)
+	}
+
+	return nil
+}
+
+// WaitConnectRequests waits up to wait for peers that requested a connection
+// to peerID. It returns an empty list when none arrived in time.
+func (s *SignalingClient) WaitConnectRequests(ctx context.Context, peerID string, wait time.Duration) ([]PeerInfo, error) {
+	path := fmt.Sprintf("/connect-requests?id=%s&wait=%d", url.QueryEscape(peerID), int(wait.Seconds()))
+	req, err := s.newRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, unavailable(err)
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get peers")
+		return nil, statusError("waiting for connection requests", resp)
 	}
 
 	var peers []PeerInfo
@@ -0,0 +1,143 @@
+package p2pquic
+
+import "time"
+
+// ConnectTimes splits the time it took to establish a connection
+type ConnectTimes struct {
+	// Signaling is the lookup of the remote peer and the connection request,
+	// zero for accepted connections and connections dialed with WithCandidates
+	Signaling time.Duration
+
+	// Punching is the hole punching until a candidate answered, zero for
+	// accepted connections
+	Punching time.Duration
+
+	// Handshake is the QUIC handshake, for accepted connections measured
+	// from the first packet of the remote peer
+	Handshake time.Duration
+}
+
+// Total returns the time from the start of Connect to the established connection
+func (t ConnectTimes) Total() time.Duration {
+	return t.Signaling + t.Punching + t.Handshake
+}
+
+// ConnStats is a snapshot of the state and traffic of a connection
+type ConnStats struct {
+	RemotePeerID string
+
+	// CandidatePair is the local and remote candidate in use, with their types
+	CandidatePair CandidatePair
+
+	SmoothedRTT time.Duration
+	MinRTT      time.Duration
+	LatestRTT   time.Duration
+
+	BytesSent       uint64
+	BytesReceived   uint64
+	PacketsSent     uint64
+	PacketsReceived uint64
+	BytesLost       uint64
+	PacketsLost     uint64
+
+	ConnectTimes ConnectTimes
+
+	// Migrations is the number of times the connection moved to a new path
+	// after a network change
+	Migrations int
+
+	// Reconnects is the number of times a PeerConn re-established its
+	// connection, zero for the stats of a Conn
+	Reconnects int
+}
+
+// LossRate returns the fraction of sent packets that were lost
+func (s ConnStats) LossRate() float64 {
+	if s.PacketsSent == 0 {
+		return 0
+	}
+	return float64(s.PacketsLost) / float64(s.PacketsSent)
+}
+
+// Stats returns a snapshot of the state and traffic of the connection
+func (c *Conn) Stats() ConnStats {
+	qs := c.ConnectionStats()
+
+	c.mu.Lock()
+	pair, migrations := c.pair, c.migrations
+	c.mu.Unlock()
+
+	return ConnStats{
+		RemotePeerID:    c.remotePeerID,
+		CandidatePair:   pair,
+		SmoothedRTT:     qs.SmoothedRTT,
+		MinRTT:          qs.MinRTT,
+		LatestRTT:       qs.LatestRTT,
+		BytesSent:       qs.BytesSent,
+		BytesReceived:   qs.BytesReceived,
+		PacketsSent:     qs.PacketsSent,
+		PacketsReceived: qs.PacketsReceived,
+		BytesLost:       qs.BytesLost,
+		PacketsLost:     qs.PacketsLost,
+		ConnectTimes:    c.times,
+		Migrations:      migrations,
+	}
+}
+
+// Stats returns the stats of the current connection with the number of
+// reconnects. Only RemotePeerID and Reconnects are set while reconnecting.
+func (pc *PeerConn) Stats() ConnStats {
+	pc.mu.Lock()
+	conn, reconnects := pc.conn, pc.reconnects
+	pc.mu.Unlock()
+
+	stats := ConnStats{RemotePeerID: pc.remotePeerID}
+	if conn != nil {
+		stats = conn.Stats()
+	}
+	stats.Reconnects = reconnects
+	return stats
+}
+
+// PeerStats aggregates the stats of the live connections of a peer
+type PeerStats struct {
+	Connections int
+
+	BytesSent       uint64
+	BytesReceived   uint64
+	PacketsSent     uint64
+	PacketsReceived uint64
+	BytesLost       uint64
+	PacketsLost     uint64
+	Migrations      int
+
+	// Conns holds the stats of every live connection
+	Conns []ConnStats
+}
+
+// LossRate returns the fraction of packets sent on all connections that were lost
+func (s PeerStats) LossRate() float64 {
+	if s.PacketsSent == 0 {
+		return 0
+	}
+	return float64(s.PacketsLost) / float64(s.PacketsSent)
+}
+
+// Stats returns the aggregated stats of the live connections of the peer.
+// Connections that were closed are not included.
+func (p *Peer) Stats() PeerStats {
+	var stats PeerStats
+	for _, conn := range p.Conns() {
+		cs := conn.Stats()
+		stats.Connections++
+		stats.BytesSent += cs.BytesSent
+		stats.BytesReceived += cs.BytesReceived
+		stats.PacketsSent += cs.PacketsSent
+		stats.PacketsReceived += cs.PacketsReceived
+		stats.BytesLost += cs.BytesLost
+		stats.PacketsLost += cs.PacketsLost
+		stats.Migrations += cs.Migrations
+		stats.Conns = append(stats.Conns, cs)
+	}
+	return stats
+}
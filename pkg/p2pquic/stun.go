@@ -0,0 +1,239 @@
+package p2pquic
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/internal/stun"
+)
+
+const (
+	// DefaultSTUNServer is used when Config.STUNServer is empty
+	DefaultSTUNServer = "stun.l.google.com:19302"
+
+	// DefaultKeepAlivePeriod is used when Config.KeepAlivePeriod is zero
+	DefaultKeepAlivePeriod = 25 * time.Second
+
+	// DefaultRegisterInterval is used when Config.RegisterInterval is zero,
+	// a third of the default registration TTL of the signaling server
+	DefaultRegisterInterval = 10 * time.Second
+
+	// stunRetransmit is the time between retransmissions of a binding request
+	stunRetransmit = 500 * time.Millisecond
+
+	// stunAttempts is the number of binding requests sent before giving up
+	stunAttempts = 6
+)
+
+var errSTUNTimeout = errors.New("no STUN response")
+
+// stunTxID is the transaction ID of a STUN message
+type stunTxID [12]byte
+
+// newSTUNBindingRequest creates a binding request with a random transaction ID
+func newSTUNBindingRequest() ([]byte, stunTxID) {
+	var txID stunTxID
+	if _, err := rand.Read(txID[:]); err != nil {
+		panic(err)
+	}
+
+	req := make([]byte, stun.HeaderSize)
+	binary.BigEndian.PutUint16(req[0:], stun.BindingRequest)
+	binary.BigEndian.PutUint16(req[2:], 0) // no attributes
+	binary.BigEndian.PutUint32(req[4:], stun.MagicCookie)
+	copy(req[8:], txID[:])
+	return req, txID
+}
+
+// isSTUNPacket reports whether b looks like a STUN message
+func isSTUNPacket(b []byte) bool {
+	return len(b) >= stun.HeaderSize && b[0]&0xc0 == 0 && binary.BigEndian.Uint32(b[4:]) == stun.MagicCookie
+}
+
+// parseSTUNBindingSuccess returns the transaction ID and the mapped address
+// of a binding success response
+func parseSTUNBindingSuccess(b []byte) (stunTxID, *net.UDPAddr, error) {
+	var txID stunTxID
+	if !isSTUNPacket(b) || binary.BigEndian.Uint16(b[0:]) != stun.BindingSuccess {
+		return txID, nil, fmt.Errorf("not a STUN binding success response")
+	}
+	copy(txID[:], b[8:20])
+
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if stun.HeaderSize+length > len(b) {
+		return txID, nil, fmt.Errorf("truncated STUN response")
+	}
+
+	var mapped *net.UDPAddr
+	attrs := b[stun.HeaderSize : stun.HeaderSize+length]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		size := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+size > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+size]
+
+		// Only IPv4 addresses (family 0x01) are used, the socket is udp4
+		if size >= 8 && value[1] == 0x01 {
+			port := int(binary.BigEndian.Uint16(value[2:]))
+			ip := net.IPv4(value[4], value[5], value[6], value[7])
+			switch typ {
+			case stun.AttrXORMappedAddress:
+				port ^= stun.MagicCookie >> 16
+				for i := range 4 {
+					ip[12+i] ^= b[4+i]
+				}
+				return txID, &net.UDPAddr{IP: ip, Port: port}, nil
+			case stun.AttrMappedAddress:
+				mapped = &net.UDPAddr{IP: ip, Port: port}
+			}
+		}
+
+		// Attributes are padded to a multiple of 4 bytes
+		next := 4 + (size+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+
+	if mapped == nil {
+		return txID, nil, fmt.Errorf("no mapped address in STUN response")
+	}
+	return txID, mapped, nil
+}
+
+// stunServer returns the configured STUN server address
+func (p *Peer) stunServer() string {
+	if p.config.STUNServer != "" {
+		return p.config.STUNServer
+	}
+	return DefaultSTUNServer
+}
+
+// stunBind sends a STUN binding request on the shared socket and returns the
+// public address that the NAT maps the socket to
+func (p *Peer) stunBind(server string) (*net.UDPAddr, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, err
+	}
+
+	req, txID := newSTUNBindingRequest()
+	response := make(chan *net.UDPAddr, 1)
+
+	p.stunMu.Lock()
+	p.stunPending[txID] = response
+	p.stunMu.Unlock()
+	defer func() {
+		p.stunMu.Lock()
+		delete(p.stunPending, txID)
+		p.stunMu.Unlock()
+	}()
+
+	start := time.Now()
+	for range stunAttempts {
+		if err := p.writeTo(req, serverAddr); err != nil {
+			p.emit(Event{Type: EventSTUNResult, Duration: time.Since(start), Err: err})
+			return nil, err
+		}
+		select {
+		case addr := <-response:
+			mapped := candidateOf(addr)
+			mapped.Type = ServerReflexiveCandidate
+			p.emit(Event{Type: EventSTUNResult, Candidate: mapped, Duration: time.Since(start)})
+			return addr, nil
+		case <-p.done:
+			return nil, ErrPeerClosed
+		case <-time.After(stunRetransmit):
+		}
+	}
+
+	err = fmt.Errorf("%w from %s", errSTUNTimeout, server)
+	p.emit(Event{Type: EventSTUNResult, Duration: time.Since(start), Err: err})
+	return nil, err
+}
+
+// handleSTUN delivers a STUN response to the binding request waiting for it
+func (p *Peer) handleSTUN(b []byte) {
+	txID, addr, err := parseSTUNBindingSuccess(b)
+	if err != nil {
+		return
+	}
+
+	p.stunMu.Lock()
+	response, ok := p.stunPending[txID]
+	p.stunMu.Unlock()
+
+	if ok {
+		select {
+		case response <- addr:
+		default:
+		}
+	}
+}
+
+// keepAliveLoop periodically re-binds against STUN on the shared socket,
+// which keeps the NAT mapping of the server-reflexive candidate alive, and
+// re-registers as soon as the mapping changes
+func (p *Peer) keepAliveLoop(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		addr, err := p.stunBind(p.stunServer())
+		if err != nil {
+			if !errors.Is(err, ErrPeerClosed) {
+				p.log.Warn("Keepalive STUN binding failed", "err", err)
+			}
+			continue
+		}
+
+		current := Candidate{IP: addr.IP.String(), Port: addr.Port, Type: ServerReflexiveCandidate}
+		previous, changed := p.updateReflexive(current)
+		if !changed {
+			continue
+		}
+		p.emitCandidates([]Candidate{current})
+
+		p.log.Info("NAT mapping changed, re-registering", "old", net.JoinHostPort(previous.IP, strconv.Itoa(previous.Port)), "new", net.JoinHostPort(current.IP, strconv.Itoa(current.Port)))
+		if err := p.Register(); err != nil {
+			p.log.Warn("Failed to re-register after NAT mapping change", "err", err)
+		}
+		if p.config.OnMappingChange != nil {
+			p.config.OnMappingChange(previous, current)
+		}
+	}
+}
+
+// updateReflexive replaces the server-reflexive candidate and reports the
+// previous one and whether it changed
+func (p *Peer) updateReflexive(current Candidate) (Candidate, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, c := range p.candidates {
+		if c.Type == ServerReflexiveCandidate {
+			if c == current {
+				return c, false
+			}
+			p.candidates[i] = current
+			return c, true
+		}
+	}
+
+	p.candidates = append([]Candidate{current}, p.candidates...)
+	return Candidate{}, true
+}
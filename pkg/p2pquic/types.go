@@ -1,13 +1,29 @@
 package p2pquic
 
 import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
 	"time"
 )
 
+// CandidateType tells how a candidate address was discovered
+type CandidateType string
+
+const (
+	// HostCandidate is an address of a local network interface
+	HostCandidate CandidateType = "host"
+
+	// ServerReflexiveCandidate is the public address of the NAT mapping, discovered with STUN
+	ServerReflexiveCandidate CandidateType = "srflx"
+)
+
 // Candidate represents a NAT traversal candidate (IP:Port pair)
 type Candidate struct {
-	IP   string `json:"ip"`
-	Port int    `json:"port"`
+	IP   string        `json:"ip"`
+	Port int           `json:"port"`
+	Type CandidateType `json:"type,omitempty"`
 }
 
 // PeerInfo stores information about a peer
@@ -15,6 +31,19 @@ type PeerInfo struct {
 	ID         string      `json:"id"`
 	Candidates []Candidate `json:"candidates"`
 	Timestamp  time.Time   `json:"timestamp"`
+
+	// PunchKey authenticates hole-punching packets, together with the
+	// ConnectKey of the peer that connects to this peer
+	PunchKey []byte `json:"punch_key,omitempty"`
+
+	// ConnectKey is the random key of one connection attempt. It is only set
+	// on connection requests, which deliver it to the target, and never on
+	// registrations.
+	ConnectKey []byte `json:"connect_key,omitempty"`
+
+	// Fingerprint is the SHA-256 hash of the peer's TLS certificate, which
+	// proves the peer ID of QUIC connections in both directions
+	Fingerprint []byte `json:"fingerprint,omitempty"`
 }
 
 // Config holds configuration for a Peer
@@ -30,11 +59,119 @@ type Config struct {
 
 	// EnableSTUN enables STUN-based public IP discovery
 	EnableSTUN bool
+
+	// STUNServer is the host:port of the STUN server (empty means stun.l.google.com:19302)
+	STUNServer string
+
+	// KeepAlivePeriod is how often the NAT mapping is refreshed with a STUN
+	// binding after Register when EnableSTUN is set (zero means 25 seconds,
+	// negative disables the keepalive)
+	KeepAlivePeriod time.Duration
+
+	// RegisterInterval is how often the registration is refreshed after
+	// Register, so it does not expire on the signaling server; keep it below
+	// half the registration TTL of the server (zero means 10 seconds,
+	// negative disables the refresh)
+	RegisterInterval time.Duration
+
+	// OnMappingChange is called after the keepalive detected a new public
+	// address and re-registered it
+	OnMappingChange func(old, new Candidate)
+
+	// NetworkPollInterval is how often the local interface addresses are
+	// checked for changes, which migrate outgoing connections to a new path
+	// (zero means 2 seconds, negative disables the watcher)
+	NetworkPollInterval time.Duration
+
+	// OnReconnect is called with the new connection when an outgoing
+	// connection could not migrate after a network change and was replaced
+	OnReconnect func(remotePeerID string, conn *Conn)
+
+	// MaxConnections limits the live connections to remote peers, Connect
+	// returns ErrTooManyConnections and incoming connections are refused
+	// beyond it (zero means unlimited)
+	MaxConnections int
+
+	// IdleConnTimeout closes connections that were not returned by Connect
+	// or Accept and carried nothing but keepalives for this long (zero
+	// disables idle eviction)
+	IdleConnTimeout time.Duration
+
+	// Namespace scopes registration and lookups on the signaling server,
+	// peers only see other peers in the same namespace
+	Namespace string
+
+	// SignalingToken is a static bearer token or signed JWT for the signaling server
+	SignalingToken string
+
+	// SignalingTLSConfig is used for HTTPS signaling servers, set Certificates
+	// to authenticate with a client certificate
+	SignalingTLSConfig *tls.Config
+
+	// OnEvent is called for every step of NAT traversal and of the lifecycle
+	// of connections, such as punches, dials and migrations. It is called
+	// synchronously from the goroutine of the step and must not block.
+	OnEvent func(Event)
+
+	// Logger receives the log output of the peer with structured fields
+	// such as peer_id, candidate, attempt and duration (nil discards it)
+	Logger *slog.Logger
+
+	// QlogDir is a directory that receives a qlog trace of every connection,
+	// named <local peer ID>_<remote peer ID>_<connection ID>.sqlog, for
+	// inspection with qvis (empty disables qlog)
+	QlogDir string
+
+	// KeyLogWriter receives the TLS secrets of every connection in NSS key
+	// log format, so Wireshark can decrypt captured traffic. It breaks the
+	// security of the connections and is meant for debugging only.
+	KeyLogWriter io.Writer
+
+	// PunchRate limits the punch packets sent per second in total (zero means 200)
+	PunchRate int
+
+	// PunchRatePerDestination limits the punch packets sent per second to a
+	// single address (zero means 10)
+	PunchRatePerDestination int
+}
+
+// signalingOptions returns the signaling client options derived from the config
+func (c Config) signalingOptions() []SignalingOption {
+	var opts []SignalingOption
+	if c.Namespace != "" {
+		opts = append(opts, WithNamespace(c.Namespace))
+	}
+	if c.SignalingToken != "" {
+		opts = append(opts, WithBearerToken(c.SignalingToken))
+	}
+	if c.SignalingTLSConfig != nil {
+		opts = append(opts, WithTLSConfig(c.SignalingTLSConfig))
+	}
+	return opts
 }
 
-// connectConfig holds internal configuration for Connect calls
+// connectConfig holds internal configuration for Connect and Dial calls
 type connectConfig struct {
-	candidates []Candidate
+	candidates  []Candidate
+	fingerprint []byte
+
+	// Reconnection settings of Dial
+	maxAttempts   int
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	onStateChange func(state ConnState, err error)
+	bufferStreams bool
+
+	// managed marks connections that a PeerConn re-establishes itself
+	managed bool
+
+	// alpn is the protocol of a connection outside of the connection
+	// manager, such as HTTP/3 (empty means a connection of Connect)
+	alpn string
+
+	// ctx bounds the lookup, punching and dialing of a connection (nil
+	// means until the peer is closed)
+	ctx context.Context
 }
 
 // ConnectOption is a functional option for configuring Connect calls
@@ -46,3 +183,51 @@ func WithCandidates(candidates ...Candidate) ConnectOption {
 		c.candidates = append(c.candidates, candidates...)
 	}
 }
+
+// WithFingerprint sets the certificate fingerprint that the remote peer must
+// present when its candidates are given with WithCandidates
+func WithFingerprint(fingerprint []byte) ConnectOption {
+	return func(c *connectConfig) {
+		c.fingerprint = fingerprint
+	}
+}
+
+// WithMaxReconnectAttempts limits the connect attempts of Dial, for the
+// first connection and after every loss (zero means 10, negative is unlimited)
+func WithMaxReconnectAttempts(n int) ConnectOption {
+	return func(c *connectConfig) {
+		c.maxAttempts = n
+	}
+}
+
+// WithReconnectBackoff sets the delay before the first retry of Dial, which
+// doubles after every failed attempt up to max (default 500ms up to 30s)
+func WithReconnectBackoff(initial, max time.Duration) ConnectOption {
+	return func(c *connectConfig) {
+		c.minBackoff = initial
+		c.maxBackoff = max
+	}
+}
+
+// WithStateHandler sets a function that Dial calls on every state change of
+// the PeerConn, with the error that caused reconnecting or failed
+func WithStateHandler(fn func(state ConnState, err error)) ConnectOption {
+	return func(c *connectConfig) {
+		c.onStateChange = fn
+	}
+}
+
+// WithBufferedStreams makes PeerConn.OpenStream wait for the connection to
+// recover instead of returning ErrReconnecting
+func WithBufferedStreams() ConnectOption {
+	return func(c *connectConfig) {
+		c.bufferStreams = true
+	}
+}
+
+// managedConnect marks a connection as owned by a PeerConn
+func managedConnect() ConnectOption {
+	return func(c *connectConfig) {
+		c.managed = true
+	}
+}
@@ -0,0 +1,254 @@
+package signaling
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrUnauthenticated is returned when credentials are missing or invalid
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Credentials are the credentials presented with a signaling request
+type Credentials struct {
+	// BearerToken is a static token or a signed JWT
+	BearerToken string
+
+	// PeerCertificates is the verified client certificate chain (mTLS)
+	PeerCertificates []*x509.Certificate
+}
+
+// Claims describe what the holder of a credential may do.
+// Every list holds patterns in path.Match syntax, so "*" matches every ID
+// and "sensor-*" matches all IDs with that prefix. An empty list permits nothing.
+type Claims struct {
+	// Subject identifies the holder of the credential
+	Subject string `json:"sub,omitempty"`
+
+	// Peers are the peer IDs that may be registered
+	Peers []string `json:"peers,omitempty"`
+
+	// Lookup are the peer IDs that may be looked up and listed
+	Lookup []string `json:"lookup,omitempty"`
+
+	// Namespaces are the namespaces that may be used (use "" for the default namespace)
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// ExpiresAt is the expiry time as a Unix timestamp (JWT "exp", zero means never)
+	ExpiresAt int64 `json:"exp,omitempty"`
+
+	// NotBefore is the start of validity as a Unix timestamp (JWT "nbf")
+	NotBefore int64 `json:"nbf,omitempty"`
+}
+
+// CanRegister reports whether the claims permit registering peerID in namespace
+func (c *Claims) CanRegister(namespace, peerID string) bool {
+	return matchAny(c.Namespaces, namespace) && matchAny(c.Peers, peerID)
+}
+
+// CanLookup reports whether the claims permit looking up peerID in namespace
+func (c *Claims) CanLookup(namespace, peerID string) bool {
+	return matchAny(c.Namespaces, namespace) && matchAny(c.Lookup, peerID)
+}
+
+// CanUseNamespace reports whether the claims permit any access to namespace
+func (c *Claims) CanUseNamespace(namespace string) bool {
+	return matchAny(c.Namespaces, namespace)
+}
+
+// valid checks the validity period of the claims
+func (c *Claims) valid(now time.Time) error {
+	if c.ExpiresAt != 0 && now.Unix() >= c.ExpiresAt {
+		return fmt.Errorf("%w: credential expired", ErrUnauthenticated)
+	}
+	if c.NotBefore != 0 && now.Unix() < c.NotBefore {
+		return fmt.Errorf("%w: credential not yet valid", ErrUnauthenticated)
+	}
+	return nil
+}
+
+// matchAny reports whether value matches one of the patterns
+func matchAny(patterns []string, value string) bool {
+	for _, p := range patterns {
+		if p == value {
+			return true
+		}
+		if ok, err := path.Match(p, value); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator turns request credentials into claims.
+// It returns an error wrapping ErrUnauthenticated when the credentials are
+// missing or invalid for this authenticator.
+type Authenticator interface {
+	Authenticate(creds Credentials) (*Claims, error)
+}
+
+// StaticTokens authenticates bearer tokens against a fixed token table
+type StaticTokens map[string]*Claims
+
+// Authenticate implements Authenticator
+func (t StaticTokens) Authenticate(creds Credentials) (*Claims, error) {
+	if creds.BearerToken == "" {
+		return nil, fmt.Errorf("%w: missing bearer token", ErrUnauthenticated)
+	}
+	for token, claims := range t {
+		if hmac.Equal([]byte(token), []byte(creds.BearerToken)) {
+			if err := claims.valid(time.Now()); err != nil {
+				return nil, err
+			}
+			return claims, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown bearer token", ErrUnauthenticated)
+}
+
+// JWTAuthenticator authenticates bearer tokens that are JWTs signed with
+// HMAC (HS256, HS384 or HS512) using a shared secret
+type JWTAuthenticator struct {
+	Secret []byte
+}
+
+// Authenticate implements Authenticator
+func (j *JWTAuthenticator) Authenticate(creds Credentials) (*Claims, error) {
+	if creds.BearerToken == "" {
+		return nil, fmt.Errorf("%w: missing bearer token", ErrUnauthenticated)
+	}
+
+	parts := strings.Split(creds.BearerToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed JWT", ErrUnauthenticated)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed JWT header", ErrUnauthenticated)
+	}
+	newHash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported JWT algorithm %q", ErrUnauthenticated, header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed JWT signature", ErrUnauthenticated)
+	}
+	mac := hmac.New(newHash, j.Secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("%w: invalid JWT signature", ErrUnauthenticated)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed JWT claims", ErrUnauthenticated)
+	}
+	if err := claims.valid(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
+
+// jwtAlgorithms maps supported JWT algorithms to their hash functions
+var jwtAlgorithms = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a JWT
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// SignJWT creates an HS256 JWT carrying the claims
+func SignJWT(claims *Claims, secret []byte) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// CertificateAuthenticator authenticates verified mTLS client certificates.
+// The certificate's common name is the only peer ID it may register, and its
+// organizational units are the namespaces it may use.
+type CertificateAuthenticator struct {
+	// Lookup are the peer IDs certificate holders may look up (nil means all)
+	Lookup []string
+
+	// Namespaces are used for certificates without organizational units
+	// (nil means the default namespace)
+	Namespaces []string
+}
+
+// Authenticate implements Authenticator
+func (a *CertificateAuthenticator) Authenticate(creds Credentials) (*Claims, error) {
+	if len(creds.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("%w: missing client certificate", ErrUnauthenticated)
+	}
+
+	cert := creds.PeerCertificates[0]
+	if cert.Subject.CommonName == "" {
+		return nil, fmt.Errorf("%w: client certificate has no common name", ErrUnauthenticated)
+	}
+
+	claims := &Claims{
+		Subject:    cert.Subject.CommonName,
+		Peers:      []string{cert.Subject.CommonName},
+		Lookup:     a.Lookup,
+		Namespaces: cert.Subject.OrganizationalUnit,
+	}
+	if claims.Lookup == nil {
+		claims.Lookup = []string{"*"}
+	}
+	if len(claims.Namespaces) == 0 {
+		claims.Namespaces = a.Namespaces
+	}
+	if claims.Namespaces == nil {
+		claims.Namespaces = []string{DefaultNamespace}
+	}
+
+	return claims, nil
+}
+
+// Authenticators tries each authenticator in order and returns the claims of
+// the first one that accepts the credentials
+type Authenticators []Authenticator
+
+// Authenticate implements Authenticator
+func (a Authenticators) Authenticate(creds Credentials) (*Claims, error) {
+	err := fmt.Errorf("%w: no authenticator configured", ErrUnauthenticated)
+	for _, auth := range a {
+		var claims *Claims
+		if claims, err = auth.Authenticate(creds); err == nil {
+			return claims, nil
+		}
+	}
+	return nil, err
+}
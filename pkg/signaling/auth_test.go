@@ -0,0 +1,130 @@
+package signaling
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signToken creates a JWT with the given header and claims, signed with an
+// HMAC of newHash over secret
+func signToken(t *testing.T, header string, claims *Claims, newHash func() hash.Hash, secret []byte) string {
+	t.Helper()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(newHash, secret)
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	secret := []byte("secret")
+	auth := &JWTAuthenticator{Secret: secret}
+	claims := &Claims{Peers: []string{"alice"}, Lookup: []string{"*"}, Namespaces: []string{""}}
+	now := time.Now().Unix()
+	period := func(notBefore, expiresAt int64) *Claims {
+		c := *claims
+		c.NotBefore, c.ExpiresAt = notBefore, expiresAt
+		return &c
+	}
+
+	valid, err := SignJWT(claims, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := signToken(t, `{"alg":"HS256"}`, &Claims{Peers: []string{"*"}}, sha256.New, []byte("other"))
+	parts, forgedParts := strings.Split(valid, "."), strings.Split(forged, ".")
+	tampered := parts[0] + "." + forgedParts[1] + "." + parts[2]
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid HS256", valid, true},
+		{"valid HS384", signToken(t, `{"alg":"HS384"}`, claims, sha512.New384, secret), true},
+		{"valid HS512", signToken(t, `{"alg":"HS512"}`, claims, sha512.New, secret), true},
+		{"missing token", "", false},
+		{"malformed", "a.b", false},
+		{"wrong secret", signToken(t, `{"alg":"HS256"}`, claims, sha256.New, []byte("other")), false},
+		{"claims of other token", tampered, false},
+		{"signature of other algorithm", signToken(t, `{"alg":"HS512"}`, claims, sha256.New, secret), false},
+		{"alg none", signToken(t, `{"alg":"none"}`, claims, sha256.New, secret), false},
+		{"alg RS256", signToken(t, `{"alg":"RS256"}`, claims, sha256.New, secret), false},
+		{"missing alg", signToken(t, `{"typ":"JWT"}`, claims, sha256.New, secret), false},
+		{"expired", signToken(t, `{"alg":"HS256"}`, period(0, now-1), sha256.New, secret), false},
+		{"not yet valid", signToken(t, `{"alg":"HS256"}`, period(now+60, 0), sha256.New, secret), false},
+		{"valid period", signToken(t, `{"alg":"HS256"}`, period(now-60, now+60), sha256.New, secret), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := auth.Authenticate(Credentials{BearerToken: tt.token})
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("Authenticate() error = %v, want nil", err)
+				}
+				if !got.CanRegister(DefaultNamespace, "alice") {
+					t.Errorf("Authenticate() claims = %+v, want alice in the default namespace", got)
+				}
+				return
+			}
+			if !errors.Is(err, ErrUnauthenticated) {
+				t.Fatalf("Authenticate() error = %v, want ErrUnauthenticated", err)
+			}
+		})
+	}
+}
+
+func TestClaimsNamespaces(t *testing.T) {
+	claims := &Claims{
+		Peers:      []string{"sensor-*"},
+		Lookup:     []string{"gateway"},
+		Namespaces: []string{"factory"},
+	}
+
+	tests := []struct {
+		name      string
+		namespace string
+		peerID    string
+		register  bool
+		lookup    bool
+	}{
+		{"own namespace", "factory", "sensor-1", true, false},
+		{"lookup in own namespace", "factory", "gateway", false, true},
+		{"default namespace", DefaultNamespace, "sensor-1", false, false},
+		{"other namespace", "office", "sensor-1", false, false},
+		{"namespace prefix", "factory-2", "gateway", false, false},
+		{"other peer", "factory", "camera-1", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := claims.CanRegister(tt.namespace, tt.peerID); got != tt.register {
+				t.Errorf("CanRegister(%q, %q) = %v, want %v", tt.namespace, tt.peerID, got, tt.register)
+			}
+			if got := claims.CanLookup(tt.namespace, tt.peerID); got != tt.lookup {
+				t.Errorf("CanLookup(%q, %q) = %v, want %v", tt.namespace, tt.peerID, got, tt.lookup)
+			}
+		})
+	}
+
+	if claims.CanUseNamespace("office") {
+		t.Error("CanUseNamespace(office) = true, want false")
+	}
+	if !(&Claims{Namespaces: []string{"*"}}).CanUseNamespace("office") {
+		t.Error("CanUseNamespace(office) with wildcard = false, want true")
+	}
+}
@@ -0,0 +1,180 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
+)
+
+const (
+	// connectRequestTTL is how long an undelivered connection request is kept
+	connectRequestTTL = 30 * time.Second
+
+	// maxPendingRequests is the maximum number of undelivered connection
+	// requests per peer, the oldest request is dropped beyond it
+	maxPendingRequests = 32
+)
+
+// ErrUnknownPeer is returned when a connection request names a peer that is not registered
+var ErrUnknownPeer = errors.New("peer not registered")
+
+// connectRequest is a request of a peer to connect to another peer
+type connectRequest struct {
+	from    *p2pquic.PeerInfo
+	created time.Time
+}
+
+// inbox holds the undelivered connection requests of a peer
+type inbox struct {
+	requests []connectRequest
+	notify   chan struct{} // closed and replaced when a request arrives
+	waiting  int           // number of WaitConnectRequests calls using the inbox
+}
+
+// inbox returns the inbox of a peer, creating it if needed (caller holds the lock)
+func (s *Server) inbox(namespace, peerID string) *inbox {
+	inboxes := s.inboxes[namespace]
+	if inboxes == nil {
+		inboxes = make(map[string]*inbox)
+		s.inboxes[namespace] = inboxes
+	}
+	box := inboxes[peerID]
+	if box == nil {
+		box = &inbox{notify: make(chan struct{})}
+		inboxes[peerID] = box
+	}
+	return box
+}
+
+// RequestConnect asks peer to to punch toward peer from. Both peers must be
+// registered in the namespace; the registration of from (candidates and punch
+// key) is delivered to to by WaitConnectRequests, together with the connect
+// key of this connection attempt.
+func (n *Namespace) RequestConnect(from, to string, connectKey []byte) error {
+	info, err := n.ConnectRequest(from, connectKey)
+	if err != nil {
+		return err
+	}
+	if _, exists := n.GetPeer(to); !exists {
+		return ErrUnknownPeer
+	}
+
+	n.DeliverConnect(to, info)
+	return nil
+}
+
+// ConnectRequest returns the connection request of a registered peer: a
+// copy of its registration with the connect key of one connection attempt,
+// which is only delivered to the target and never stored
+func (n *Namespace) ConnectRequest(from string, connectKey []byte) (*p2pquic.PeerInfo, error) {
+	info, exists := n.GetPeer(from)
+	if !exists {
+		return nil, ErrUnknownPeer
+	}
+	if len(connectKey) > maxPunchKeyLength {
+		return nil, fmt.Errorf("%w: %d bytes exceeds limit of %d", ErrInvalidPunchKey, len(connectKey), maxPunchKeyLength)
+	}
+
+	req := *info
+	req.ConnectKey = connectKey
+	return &req, nil
+}
+
+// DeliverConnect queues a connection request from a peer that may be
+// registered on another instance in a cluster. A newer request from the same
+// peer replaces the queued one.
+func (n *Namespace) DeliverConnect(to string, from *p2pquic.PeerInfo) {
+	s := n.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	box := s.inbox(n.name, to)
+	requests := box.requests[:0]
+	for _, req := range box.requests {
+		if req.from.ID != from.ID {
+			requests = append(requests, req)
+		}
+	}
+	requests = append(requests, connectRequest{from: from, created: time.Now()})
+	if len(requests) > maxPendingRequests {
+		requests = requests[len(requests)-maxPendingRequests:]
+	}
+	box.requests = requests
+	s.connectRequests.Add(1)
+
+	close(box.notify)
+	box.notify = make(chan struct{})
+}
+
+// WaitConnectRequests returns the pending connection requests of a peer,
+// waiting until one arrives or ctx is done. Every request is returned once.
+func (n *Namespace) WaitConnectRequests(ctx context.Context, peerID string) []*p2pquic.PeerInfo {
+	s := n.server
+	s.waiters.Add(1)
+	defer s.waiters.Add(-1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	box := s.inbox(n.name, peerID)
+	box.waiting++
+	defer func() { box.waiting-- }()
+
+	for {
+		var peers []*p2pquic.PeerInfo
+		for _, req := range box.requests {
+			if time.Since(req.created) <= connectRequestTTL {
+				peers = append(peers, req.from)
+			}
+		}
+		box.requests = nil
+		if len(peers) > 0 {
+			return peers
+		}
+
+		notify := box.notify
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			return nil
+		case <-notify:
+		}
+		s.mu.Lock()
+	}
+}
+
+// Waiters returns the number of peers currently waiting for connection requests
+func (s *Server) Waiters() int {
+	return int(s.waiters.Load())
+}
+
+// ConnectRequests returns the number of connection requests that were queued
+func (s *Server) ConnectRequests() uint64 {
+	return s.connectRequests.Load()
+}
+
+// cleanupRequests removes expired connection requests and inboxes that
+// nobody waits on (caller holds the lock)
+func (s *Server) cleanupRequests(now time.Time) {
+	for name, inboxes := range s.inboxes {
+		for id, box := range inboxes {
+			requests := box.requests[:0]
+			for _, req := range box.requests {
+				if now.Sub(req.created) <= connectRequestTTL {
+					requests = append(requests, req)
+				}
+			}
+			box.requests = requests
+			if len(requests) == 0 && box.waiting == 0 {
+				delete(inboxes, id)
+			}
+		}
+		if len(inboxes) == 0 {
+			delete(s.inboxes, name)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package signaling
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/mevdschee/p2pquic-go/internal/ratelimit"
+	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
+)
+
+const (
+	// maxPeerIDLength is the maximum length of a peer ID
+	maxPeerIDLength = 128
+
+	// maxPunchKeyLength is the maximum length of a peer's punch key
+	maxPunchKeyLength = 64
+
+	// maxFingerprintLength is the maximum length of a peer's certificate fingerprint
+	maxFingerprintLength = 64
+)
+
+var (
+	// ErrTooManyPeers is returned when the server has reached its total peer limit
+	ErrTooManyPeers = errors.New("server peer limit reached")
+
+	// ErrTooManyCandidates is returned when a registration has too many candidates
+	ErrTooManyCandidates = errors.New("too many candidates")
+
+	// ErrInvalidPeerID is returned for empty or overlong peer IDs
+	ErrInvalidPeerID = errors.New("invalid peer ID")
+
+	// ErrInvalidCandidate is returned for candidates that peers must never punch
+	ErrInvalidCandidate = errors.New("invalid candidate")
+
+	// ErrInvalidPunchKey is returned for overlong punch keys
+	ErrInvalidPunchKey = errors.New("invalid punch key")
+
+	// ErrInvalidFingerprint is returned for overlong certificate fingerprints
+	ErrInvalidFingerprint = errors.New("invalid certificate fingerprint")
+)
+
+// WithMaxPeers limits the number of registered peers across all namespaces (zero means unlimited)
+func WithMaxPeers(n int) Option {
+	return func(s *Server) {
+		s.maxPeers = n
+	}
+}
+
+// WithMaxCandidates limits the number of candidates per registration (zero means unlimited)
+func WithMaxCandidates(n int) Option {
+	return func(s *Server) {
+		s.maxCandidates = n
+	}
+}
+
+// ValidateCandidate checks that a candidate is a unicast IP address with a valid port.
+// Unspecified, multicast and broadcast addresses are rejected, because peers
+// would send punch packets to them.
+func ValidateCandidate(c p2pquic.Candidate) error {
+	ip := net.ParseIP(c.IP)
+	if ip == nil {
+		return fmt.Errorf("%w: %q is not an IP address", ErrInvalidCandidate, c.IP)
+	}
+	if ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+		return fmt.Errorf("%w: %s is not a unicast address", ErrInvalidCandidate, c.IP)
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("%w: port %d out of range", ErrInvalidCandidate, c.Port)
+	}
+	return nil
+}
+
+// validateRegistration checks a peer ID, its candidates, its punch key and
+// its certificate fingerprint (caller holds the lock)
+func (s *Server) validateRegistration(peer *p2pquic.PeerInfo) error {
+	if peer.ID == "" || len(peer.ID) > maxPeerIDLength {
+		return ErrInvalidPeerID
+	}
+	if len(peer.PunchKey) > maxPunchKeyLength {
+		return fmt.Errorf("%w: %d bytes exceeds limit of %d", ErrInvalidPunchKey, len(peer.PunchKey), maxPunchKeyLength)
+	}
+	if len(peer.Fingerprint) > maxFingerprintLength {
+		return fmt.Errorf("%w: %d bytes exceeds limit of %d", ErrInvalidFingerprint, len(peer.Fingerprint), maxFingerprintLength)
+	}
+	if s.maxCandidates > 0 && len(peer.Candidates) > s.maxCandidates {
+		return fmt.Errorf("%w: %d exceeds limit of %d", ErrTooManyCandidates, len(peer.Candidates), s.maxCandidates)
+	}
+	for _, c := range peer.Candidates {
+		if err := ValidateCandidate(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RateLimiter is a token bucket rate limiter keyed by an arbitrary string,
+// such as a source IP address or a credential subject
+type RateLimiter = ratelimit.Limiter
+
+// NewRateLimiter creates a limiter that allows rate events per second per key,
+// with bursts of up to burst events
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return ratelimit.New(rate, burst)
+}
@@ -0,0 +1,284 @@
+package signaling
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
+)
+
+// DefaultNamespace is the namespace used when none is specified
+const DefaultNamespace = ""
+
+// maxNamespaceLength is the maximum length of a namespace name
+const maxNamespaceLength = 64
+
+// ErrNamespaceFull is returned when a namespace has reached its peer limit
+var ErrNamespaceFull = errors.New("namespace peer limit reached")
+
+// NamespaceConfig holds the limits of a namespace
+type NamespaceConfig struct {
+	// TTL is the time-to-live for registrations (zero means 30 seconds)
+	TTL time.Duration
+
+	// MaxPeers is the maximum number of registered peers (zero means unlimited)
+	MaxPeers int
+}
+
+// WithNamespaceConfig sets the limits of a single namespace
+func WithNamespaceConfig(name string, cfg NamespaceConfig) Option {
+	return func(s *Server) {
+		if cfg.TTL <= 0 {
+			cfg.TTL = peerTTL
+		}
+		s.configs[name] = cfg
+	}
+}
+
+// WithDefaultNamespaceConfig sets the limits of namespaces without their own configuration
+func WithDefaultNamespaceConfig(cfg NamespaceConfig) Option {
+	return func(s *Server) {
+		if cfg.TTL <= 0 {
+			cfg.TTL = peerTTL
+		}
+		s.defaults = cfg
+	}
+}
+
+// ValidNamespace reports whether name may be used as a namespace.
+// Names consist of at most 64 letters, digits, dots, dashes and underscores.
+func ValidNamespace(name string) bool {
+	if len(name) > maxNamespaceLength {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Namespace is a view of the registry that is scoped to one namespace.
+// Peer IDs only need to be unique within their namespace.
+type Namespace struct {
+	server *Server
+	name   string
+}
+
+// Name returns the name of the namespace
+func (n *Namespace) Name() string {
+	return n.name
+}
+
+// Config returns the limits of the namespace
+func (n *Namespace) Config() NamespaceConfig {
+	n.server.mu.RLock()
+	defer n.server.mu.RUnlock()
+
+	return n.server.config(n.name)
+}
+
+// Register registers a peer with its candidates
+func (n *Namespace) Register(peerID string, candidates []p2pquic.Candidate) error {
+	return n.RegisterPeer(&p2pquic.PeerInfo{ID: peerID, Candidates: candidates})
+}
+
+// RegisterPeer registers a peer with its candidates, punch key and certificate fingerprint.
+// The timestamp of the registration is set to the current time.
+func (n *Namespace) RegisterPeer(info *p2pquic.PeerInfo) error {
+	peer := &p2pquic.PeerInfo{
+		ID:          info.ID,
+		Candidates:  info.Candidates,
+		PunchKey:    info.PunchKey,
+		Fingerprint: info.Fingerprint,
+		Timestamp:   time.Now(),
+	}
+	peerID := peer.ID
+
+	s := n.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.validateRegistration(peer); err != nil {
+		return err
+	}
+
+	peers := s.namespaces[n.name]
+	if err := n.admit(peers, peerID); err != nil {
+		return err
+	}
+
+	s.store(n.name, peerID, &entry{info: peer})
+
+	return nil
+}
+
+// admit applies the peer limits of the namespace and the server to a peer
+// that is not registered yet. Expired registrations count until the next
+// cleanup, so the check does not scan the registrations. (caller holds the lock)
+func (n *Namespace) admit(peers map[string]*entry, peerID string) error {
+	s := n.server
+	if _, exists := peers[peerID]; exists {
+		return nil
+	}
+
+	cfg := s.config(n.name)
+	if cfg.MaxPeers > 0 && len(peers) >= cfg.MaxPeers {
+		s.log.Warn("Rejected registration: namespace full", "namespace", n.name, "peer_id", peerID, "max_peers", cfg.MaxPeers)
+		return ErrNamespaceFull
+	}
+	if s.maxPeers > 0 && s.stored >= s.maxPeers {
+		s.log.Warn("Rejected registration: too many peers", "namespace", n.name, "peer_id", peerID, "max_peers", s.maxPeers)
+		return ErrTooManyPeers
+	}
+	return nil
+}
+
+// maxReplicaSkew is how far in the future the timestamp of a replica may be;
+// later timestamps are clamped, so a replica cannot outlive its TTL or block
+// newer replicas of the same peer
+const maxReplicaSkew = 5 * time.Second
+
+// RegisterReplica stores a registration owned by another instance in a cluster.
+// The peer's timestamp is kept, so instance clocks should be synchronized.
+// A replica never replaces a more recent registration of the same peer. The
+// same peer limits apply as to registrations.
+func (n *Namespace) RegisterReplica(origin string, peer *p2pquic.PeerInfo) error {
+	if origin == "" {
+		return fmt.Errorf("replica origin is required")
+	}
+
+	replica := &p2pquic.PeerInfo{
+		ID:          peer.ID,
+		Candidates:  peer.Candidates,
+		PunchKey:    peer.PunchKey,
+		Fingerprint: peer.Fingerprint,
+		Timestamp:   peer.Timestamp,
+	}
+	if latest := time.Now().Add(maxReplicaSkew); replica.Timestamp.After(latest) {
+		replica.Timestamp = latest
+	}
+
+	s := n.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.validateRegistration(replica); err != nil {
+		return err
+	}
+
+	peers := s.namespaces[n.name]
+	if e, exists := peers[peer.ID]; exists && !e.info.Timestamp.Before(replica.Timestamp) {
+		return nil
+	}
+	if err := n.admit(peers, peer.ID); err != nil {
+		return err
+	}
+	s.store(n.name, peer.ID, &entry{info: replica, origin: origin})
+
+	return nil
+}
+
+// Origin returns the instance that owns a peer's registration.
+// The origin is empty for peers registered on this instance.
+func (n *Namespace) Origin(peerID string) (string, bool) {
+	s := n.server
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, exists := s.namespaces[n.name][peerID]
+	if !exists || time.Since(e.info.Timestamp) > s.config(n.name).TTL {
+		return "", false
+	}
+
+	return e.origin, true
+}
+
+// GetPeer retrieves peer information by ID (returns nil if expired)
+func (n *Namespace) GetPeer(peerID string) (*p2pquic.PeerInfo, bool) {
+	return n.get(peerID, false)
+}
+
+// GetLocalPeer retrieves peer information by ID if the peer is registered on
+// this instance (returns nil if expired or replicated)
+func (n *Namespace) GetLocalPeer(peerID string) (*p2pquic.PeerInfo, bool) {
+	return n.get(peerID, true)
+}
+
+// get returns a non-expired peer, optionally only a local one
+func (n *Namespace) get(peerID string, localOnly bool) (*p2pquic.PeerInfo, bool) {
+	s := n.server
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, exists := s.namespaces[n.name][peerID]
+	if !exists || (localOnly && e.origin != "") {
+		return nil, false
+	}
+
+	// Check if peer has expired (inline check for race conditions)
+	if time.Since(e.info.Timestamp) > s.config(n.name).TTL {
+		return nil, false
+	}
+
+	return e.info, true
+}
+
+// GetAllPeers retrieves all registered peers (excludes expired)
+func (n *Namespace) GetAllPeers() []*p2pquic.PeerInfo {
+	return n.list(false)
+}
+
+// GetLocalPeers retrieves the peers registered on this instance (excludes
+// expired and replicated registrations)
+func (n *Namespace) GetLocalPeers() []*p2pquic.PeerInfo {
+	return n.list(true)
+}
+
+// list returns the non-expired peers, optionally only the local ones
+func (n *Namespace) list(localOnly bool) []*p2pquic.PeerInfo {
+	s := n.server
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	ttl := s.config(n.name).TTL
+	peers := s.namespaces[n.name]
+	peerList := make([]*p2pquic.PeerInfo, 0, len(peers))
+	for _, e := range peers {
+		if localOnly && e.origin != "" {
+			continue
+		}
+		if now.Sub(e.info.Timestamp) <= ttl {
+			peerList = append(peerList, e.info)
+		}
+	}
+
+	return peerList
+}
+
+// RemovePeer removes a peer from the namespace
+func (n *Namespace) RemovePeer(peerID string) {
+	s := n.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.namespaces[n.name][peerID]; exists {
+		delete(s.namespaces[n.name], peerID)
+		s.stored--
+	}
+}
+
+// PeerCount returns the number of registered (non-expired) peers
+func (n *Namespace) PeerCount() int {
+	s := n.server
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return liveCount(s.namespaces[n.name], s.config(n.name).TTL)
+}
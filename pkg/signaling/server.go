@@ -1,34 +1,74 @@
 package signaling
 
 import (
+	"context"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
 )
 
 const (
-	// peerTTL is the time-to-live for peer registrations
+	// peerTTL is the default time-to-live for peer registrations
 	peerTTL = 30 * time.Second
 
 	// cleanupInterval is how often we check for expired peers
 	cleanupInterval = 5 * time.Second
 )
 
+// entry is a registration together with the instance that owns it
+type entry struct {
+	info   *p2pquic.PeerInfo
+	origin string // empty for peers registered on this instance
+}
+
 // Server manages peer registration and discovery
 type Server struct {
-	peers       map[string]*p2pquic.PeerInfo
-	mu          sync.RWMutex
-	stopCleanup chan struct{}
-	cleanupOnce sync.Once
+	namespaces    map[string]map[string]*entry
+	stored        int // registrations in all namespaces, including expired ones until cleanup
+	configs       map[string]NamespaceConfig
+	defaults      NamespaceConfig
+	maxPeers      int
+	maxCandidates int
+	log           *slog.Logger
+	mu            sync.RWMutex
+	expirations   atomic.Uint64
+	stopCleanup   chan struct{}
+	cleanupOnce   sync.Once
+
+	inboxes         map[string]map[string]*inbox // connection requests by namespace and peer
+	waiters         atomic.Int64
+	connectRequests atomic.Uint64
+}
+
+// Option is a functional option for configuring a Server
+type Option func(*Server)
+
+// WithLogger sets the logger for expirations and rejected registrations
+// (the default discards the log output)
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.log = logger
+	}
 }
 
 // NewServer creates a new signaling server with TTL-based cleanup
-func NewServer() *Server {
+func NewServer(opts ...Option) *Server {
 	s := &Server{
-		peers:       make(map[string]*p2pquic.PeerInfo),
+		namespaces:  make(map[string]map[string]*entry),
+		configs:     make(map[string]NamespaceConfig),
+		inboxes:     make(map[string]map[string]*inbox),
+		defaults:    NamespaceConfig{TTL: peerTTL},
 		stopCleanup: make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.log == nil {
+		s.log = slog.New(slog.DiscardHandler)
+	}
 
 	// Start background cleanup goroutine
 	go s.cleanupLoop()
@@ -57,11 +97,30 @@ func (s *Server) cleanupExpired() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for id, peer := range s.peers {
-		if now.Sub(peer.Timestamp) > peerTTL {
-			delete(s.peers, id)
+	for name, peers := range s.namespaces {
+		ttl := s.config(name).TTL
+		for id, e := range peers {
+			if now.Sub(e.info.Timestamp) > ttl {
+				delete(peers, id)
+				s.stored--
+				s.expirations.Add(1)
+				s.log.Debug("Registration expired", "namespace", name, "peer_id", id, "ttl", ttl)
+			}
+		}
+		if len(peers) == 0 {
+			delete(s.namespaces, name)
 		}
 	}
+
+	s.cleanupRequests(now)
+}
+
+// config returns the configuration of a namespace (caller holds the lock)
+func (s *Server) config(name string) NamespaceConfig {
+	if cfg, ok := s.configs[name]; ok {
+		return cfg
+	}
+	return s.defaults
 }
 
 // Close stops the cleanup goroutine
@@ -71,72 +130,119 @@ func (s *Server) Close() {
 	})
 }
 
-// Register registers a peer with its candidates
-func (s *Server) Register(peerID string, candidates []p2pquic.Candidate) error {
-	peer := &p2pquic.PeerInfo{
-		ID:         peerID,
-		Candidates: candidates,
-		Timestamp:  time.Now(),
-	}
-
-	s.mu.Lock()
-	s.peers[peerID] = peer
-	s.mu.Unlock()
-
-	return nil
+// Namespace returns a view of the registry that is scoped to one namespace
+func (s *Server) Namespace(name string) *Namespace {
+	return &Namespace{server: s, name: name}
 }
 
-// GetPeer retrieves peer information by ID (returns nil if expired)
-func (s *Server) GetPeer(peerID string) (*p2pquic.PeerInfo, bool) {
+// Namespaces returns the names of all namespaces that have registrations
+func (s *Server) Namespaces() []string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	peer, exists := s.peers[peerID]
-	if !exists {
-		return nil, false
+	names := make([]string, 0, len(s.namespaces))
+	for name := range s.namespaces {
+		names = append(names, name)
 	}
 
-	// Check if peer has expired (inline check for race conditions)
-	if time.Since(peer.Timestamp) > peerTTL {
-		return nil, false
-	}
+	return names
+}
+
+// Register registers a peer with its candidates in the default namespace
+func (s *Server) Register(peerID string, candidates []p2pquic.Candidate) error {
+	return s.Namespace(DefaultNamespace).Register(peerID, candidates)
+}
+
+// RegisterPeer registers a peer with its candidates and punch key in the default namespace
+func (s *Server) RegisterPeer(peer *p2pquic.PeerInfo) error {
+	return s.Namespace(DefaultNamespace).RegisterPeer(peer)
+}
+
+// RegisterReplica stores a registration owned by another instance in a cluster
+// in the default namespace
+func (s *Server) RegisterReplica(origin string, peer *p2pquic.PeerInfo) error {
+	return s.Namespace(DefaultNamespace).RegisterReplica(origin, peer)
+}
 
-	return peer, true
+// Origin returns the instance that owns a peer's registration in the default namespace
+func (s *Server) Origin(peerID string) (string, bool) {
+	return s.Namespace(DefaultNamespace).Origin(peerID)
 }
 
-// GetAllPeers retrieves all registered peers (excludes expired)
+// GetPeer retrieves peer information by ID from the default namespace (returns nil if expired)
+func (s *Server) GetPeer(peerID string) (*p2pquic.PeerInfo, bool) {
+	return s.Namespace(DefaultNamespace).GetPeer(peerID)
+}
+
+// GetAllPeers retrieves all registered peers in the default namespace (excludes expired)
 func (s *Server) GetAllPeers() []*p2pquic.PeerInfo {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	return s.Namespace(DefaultNamespace).GetAllPeers()
+}
 
-	now := time.Now()
-	peerList := make([]*p2pquic.PeerInfo, 0, len(s.peers))
-	for _, peer := range s.peers {
-		if now.Sub(peer.Timestamp) <= peerTTL {
-			peerList = append(peerList, peer)
-		}
-	}
+// GetLocalPeer retrieves a peer registered on this instance by ID from the
+// default namespace (returns nil if expired or replicated)
+func (s *Server) GetLocalPeer(peerID string) (*p2pquic.PeerInfo, bool) {
+	return s.Namespace(DefaultNamespace).GetLocalPeer(peerID)
+}
+
+// GetLocalPeers retrieves the peers registered on this instance in the default
+// namespace (excludes expired and replicated registrations)
+func (s *Server) GetLocalPeers() []*p2pquic.PeerInfo {
+	return s.Namespace(DefaultNamespace).GetLocalPeers()
+}
+
+// RequestConnect asks peer to to punch toward peer from in the default namespace
+func (s *Server) RequestConnect(from, to string, connectKey []byte) error {
+	return s.Namespace(DefaultNamespace).RequestConnect(from, to, connectKey)
+}
 
-	return peerList
+// WaitConnectRequests waits for connection requests to a peer in the default namespace
+func (s *Server) WaitConnectRequests(ctx context.Context, peerID string) []*p2pquic.PeerInfo {
+	return s.Namespace(DefaultNamespace).WaitConnectRequests(ctx, peerID)
 }
 
-// RemovePeer removes a peer from the registry
+// RemovePeer removes a peer from the default namespace
 func (s *Server) RemovePeer(peerID string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.Namespace(DefaultNamespace).RemovePeer(peerID)
+}
 
-	delete(s.peers, peerID)
+// store adds or replaces the registration of a peer (caller holds the lock)
+func (s *Server) store(name, peerID string, e *entry) {
+	peers := s.namespaces[name]
+	if peers == nil {
+		peers = make(map[string]*entry)
+		s.namespaces[name] = peers
+	}
+	if _, exists := peers[peerID]; !exists {
+		s.stored++
+	}
+	peers[peerID] = e
 }
 
-// PeerCount returns the number of registered (non-expired) peers
+// PeerCount returns the number of registered (non-expired) peers across all namespaces
 func (s *Server) PeerCount() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	count := 0
+	for name, peers := range s.namespaces {
+		count += liveCount(peers, s.config(name).TTL)
+	}
+
+	return count
+}
+
+// Expirations returns the number of registrations removed because their TTL expired
+func (s *Server) Expirations() uint64 {
+	return s.expirations.Load()
+}
+
+// liveCount returns the number of non-expired peers (caller holds the lock)
+func liveCount(peers map[string]*entry, ttl time.Duration) int {
 	now := time.Now()
 	count := 0
-	for _, peer := range s.peers {
-		if now.Sub(peer.Timestamp) <= peerTTL {
+	for _, e := range peers {
+		if now.Sub(e.info.Timestamp) <= ttl {
 			count++
 		}
 	}
@@ -0,0 +1,541 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headerTimeout bounds the time a remote peer takes to start a stream
+// with its header and first message
+const headerTimeout = 30 * time.Second
+
+// Receiver receives the files that remote peers send into a directory
+type Receiver struct {
+	// Dir is the target directory, which is created when missing. Paths
+	// that would escape it, also through symbolic links, are refused.
+	Dir string
+
+	// Overwrite allows replacing existing files that differ from the
+	// files sent; otherwise such a transfer is rejected
+	Overwrite bool
+
+	// Allow reports whether a remote peer may send the files of a
+	// manifest (nil accepts all)
+	Allow func(peerID string, m *Manifest) bool
+
+	// MaxSize limits the total size of the files of a transfer, and
+	// MaxFiles the number of files and directories (zero means unlimited)
+	MaxSize  int64
+	MaxFiles int
+
+	// OnProgress is called after every chunk that was received and
+	// verified, one call at a time per transfer
+	OnProgress func(Progress)
+
+	// Logger receives a line for every transfer (nil discards them)
+	Logger *slog.Logger
+
+	root      *os.Root
+	mu        sync.Mutex
+	transfers map[string]*incoming // by transfer ID
+}
+
+// incoming is a transfer that is being received
+type incoming struct {
+	m      *Manifest
+	peerID string
+
+	mu        sync.Mutex
+	skip      []bool         // files that exist with the same content, by file index
+	missing   []map[int]bool // chunks to receive, by file index
+	remaining int
+	progress  Progress
+}
+
+// log returns the logger of the receiver
+func (r *Receiver) log() *slog.Logger {
+	if r.Logger == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+	return r.Logger
+}
+
+// Serve receives the transfers of the streams of a listener, such as the
+// one returned by Peer.StreamListener, until it fails
+func (r *Receiver) Serve(l net.Listener) error {
+	if err := os.MkdirAll(r.Dir, 0o755); err != nil {
+		return err
+	}
+	root, err := os.OpenRoot(r.Dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	r.mu.Lock()
+	r.root = root
+	r.transfers = make(map[string]*incoming)
+	r.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go r.handle(conn)
+	}
+}
+
+// handle reads the header of a stream and serves it
+func (r *Receiver) handle(conn net.Conn) {
+	defer conn.Close()
+	peerID := conn.RemoteAddr().String()
+
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	k, err := readHeader(conn)
+	if err != nil {
+		r.log().Warn("Failed to read transfer stream", "peer_id", peerID, "err", err)
+		return
+	}
+
+	switch k {
+	case kindOffer:
+		r.offer(conn, peerID)
+	case kindChunks:
+		r.chunks(conn, peerID)
+	default:
+		r.log().Warn("Unsupported transfer stream", "peer_id", peerID, "kind", k)
+	}
+}
+
+// offer answers a manifest with the missing chunks, waits until the sender
+// is done and verifies the files
+func (r *Receiver) offer(conn net.Conn, peerID string) {
+	var m Manifest
+	err := readMessage(conn, &m)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		r.log().Warn("Failed to read manifest", "peer_id", peerID, "err", err)
+		return
+	}
+
+	log := r.log().With("peer_id", peerID, "id", m.ID)
+	reject := func(err error) {
+		log.Warn("Rejected transfer", "err", err)
+		writeMessage(conn, plan{Error: err.Error()})
+	}
+	if m.ID == "" {
+		reject(errors.New("missing transfer ID"))
+		return
+	}
+	if err := validate(&m); err != nil {
+		reject(err)
+		return
+	}
+	if r.Allow != nil && !r.Allow(peerID, &m) {
+		reject(fmt.Errorf("peer %s may not send these files", peerID))
+		return
+	}
+	if err := r.checkLimits(&m); err != nil {
+		reject(err)
+		return
+	}
+
+	t, err := r.prepare(&m, peerID)
+	if err != nil {
+		reject(err)
+		return
+	}
+	if err := r.add(t); err != nil {
+		reject(err)
+		return
+	}
+	defer r.remove(t)
+
+	need := make([][]int, len(m.Files))
+	for i, chunks := range t.missing {
+		need[i] = slices.Sorted(maps.Keys(chunks))
+	}
+	if err := writeMessage(conn, plan{Need: need}); err != nil {
+		return
+	}
+	log.Info("Receiving transfer", "files", len(m.Files), "bytes", t.progress.Total, "resumed", t.progress.Resumed)
+	r.report(t)
+
+	var b [1]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil || b[0] != done {
+		log.Warn("Transfer aborted, partial files are kept", "err", err)
+		return
+	}
+	if err := r.finish(t); err != nil {
+		log.Warn("Transfer failed", "err", err)
+		writeMessage(conn, result{Error: err.Error()})
+		return
+	}
+	log.Info("Transfer completed", "files", len(m.Files), "bytes", t.progress.Total)
+	writeMessage(conn, result{})
+}
+
+// checkLimits checks the size and the number of files of a manifest
+// against the limits of the receiver
+func (r *Receiver) checkLimits(m *Manifest) error {
+	if r.MaxFiles > 0 && len(m.Files) > r.MaxFiles {
+		return fmt.Errorf("%w: %d files exceed limit of %d", ErrTooLarge, len(m.Files), r.MaxFiles)
+	}
+	if size := m.Size(); r.MaxSize > 0 && size > r.MaxSize {
+		return fmt.Errorf("%w: %d bytes exceed limit of %d", ErrTooLarge, size, r.MaxSize)
+	}
+	return nil
+}
+
+// prepare finds the chunks that are missing: files that exist with the
+// same content are skipped, and chunks of partial files that match their
+// SHA-256 are kept. It then creates the directories and the partial files.
+func (r *Receiver) prepare(m *Manifest, peerID string) (*incoming, error) {
+	t := &incoming{
+		m:        m,
+		peerID:   peerID,
+		skip:     make([]bool, len(m.Files)),
+		missing:  make([]map[int]bool, len(m.Files)),
+		progress: Progress{ID: m.ID, PeerID: peerID, Total: m.Size()},
+	}
+
+	for i := range m.Files {
+		f := &m.Files[i]
+		if f.Dir {
+			continue
+		}
+		same, err := r.exists(f)
+		if err != nil {
+			return nil, err
+		}
+		if same {
+			t.skip[i] = true
+			t.progress.Resumed += f.Size
+			continue
+		}
+		if t.missing[i], err = r.missingChunks(m, f); err != nil {
+			return nil, err
+		}
+		t.remaining += len(t.missing[i])
+		t.progress.Resumed += f.Size
+		for c := range t.missing[i] {
+			t.progress.Resumed -= m.chunkLen(f, c)
+		}
+	}
+	t.progress.Done = t.progress.Resumed
+
+	for i, f := range m.Files {
+		if f.Dir {
+			if err := r.mkdirAll(f.Path, f.Mode); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if t.skip[i] {
+			continue
+		}
+		if err := r.mkdirAll(path.Dir(f.Path), 0o755); err != nil {
+			return nil, err
+		}
+		part, err := r.root.OpenFile(filepath.FromSlash(f.Path+partSuffix), os.O_WRONLY|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		err = part.Truncate(f.Size)
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// exists reports whether a file exists with the same content, and fails
+// when it exists with other content and may not be overwritten
+func (r *Receiver) exists(f *File) (bool, error) {
+	name := filepath.FromSlash(f.Path)
+	info, err := r.root.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.Mode().IsRegular() && info.Size() == f.Size {
+		file, err := r.root.Open(name)
+		if err != nil {
+			return false, err
+		}
+		defer file.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, file); err != nil {
+			return false, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) == f.SHA256 {
+			return true, nil
+		}
+	}
+	if !r.Overwrite {
+		return false, fmt.Errorf("%s exists", f.Path)
+	}
+	return false, nil
+}
+
+// missingChunks returns the chunks of a file that its partial file does not
+// have yet
+func (r *Receiver) missingChunks(m *Manifest, f *File) (map[int]bool, error) {
+	missing := make(map[int]bool)
+	for c := range f.Chunks {
+		missing[c] = true
+	}
+
+	part, err := r.root.Open(filepath.FromSlash(f.Path + partSuffix))
+	if errors.Is(err, fs.ErrNotExist) {
+		return missing, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer part.Close()
+
+	buf := make([]byte, m.ChunkSize)
+	for c, want := range f.Chunks {
+		n := m.chunkLen(f, c)
+		if _, err := part.ReadAt(buf[:n], int64(c)*m.ChunkSize); err != nil {
+			// The partial file ends before this chunk
+			break
+		}
+		sum := sha256.Sum256(buf[:n])
+		if hex.EncodeToString(sum[:]) == want {
+			delete(missing, c)
+		}
+	}
+	return missing, nil
+}
+
+// mkdirAll creates a directory and its parents inside the target directory
+func (r *Receiver) mkdirAll(dir string, mode fs.FileMode) error {
+	if dir == "." {
+		return nil
+	}
+	parts := strings.Split(dir, "/")
+	for i := range parts {
+		perm := fs.FileMode(0o755)
+		if i == len(parts)-1 {
+			// Keep the directory writable for the files in it
+			perm = mode.Perm() | 0o700
+		}
+		err := r.root.Mkdir(filepath.FromSlash(path.Join(parts[:i+1]...)), perm)
+		if err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// add registers a transfer for its chunks streams
+func (r *Receiver) add(t *incoming) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.transfers[t.m.ID]; ok {
+		return fmt.Errorf("transfer %s is in progress", t.m.ID)
+	}
+	r.transfers[t.m.ID] = t
+	return nil
+}
+
+// remove unregisters a transfer
+func (r *Receiver) remove(t *incoming) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.transfers, t.m.ID)
+}
+
+// chunks writes the chunks of a stream to the partial files of its
+// transfer and answers once the sender closed the stream
+func (r *Receiver) chunks(conn net.Conn, peerID string) {
+	var h hello
+	err := readMessage(conn, &h)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		r.log().Warn("Failed to read chunks stream", "peer_id", peerID, "err", err)
+		return
+	}
+
+	log := r.log().With("peer_id", peerID, "id", h.ID)
+	fail := func(err error) {
+		log.Warn("Failed to receive chunks", "err", err)
+		writeMessage(conn, result{Error: err.Error()})
+	}
+
+	r.mu.Lock()
+	t := r.transfers[h.ID]
+	r.mu.Unlock()
+	if t == nil || t.peerID != peerID {
+		fail(fmt.Errorf("unknown transfer %s", h.ID))
+		return
+	}
+
+	m := t.m
+	var hdr [chunkHeaderSize]byte
+	buf := make([]byte, m.ChunkSize)
+	for {
+		if _, err := io.ReadFull(conn, hdr[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			log.Warn("Failed to receive chunks", "err", err)
+			return
+		}
+
+		file, chunk, length := parseChunkHeader(hdr[:])
+		if file >= len(m.Files) || chunk >= len(m.Files[file].Chunks) || length != m.chunkLen(&m.Files[file], chunk) {
+			fail(fmt.Errorf("invalid chunk %d of file %d", chunk, file))
+			return
+		}
+		f := &m.Files[file]
+		if _, err := io.ReadFull(conn, buf[:length]); err != nil {
+			log.Warn("Failed to receive chunks", "err", err)
+			return
+		}
+		sum := sha256.Sum256(buf[:length])
+		if hex.EncodeToString(sum[:]) != f.Chunks[chunk] {
+			fail(fmt.Errorf("%w: chunk %d of %s", ErrIntegrity, chunk, f.Path))
+			return
+		}
+		if err := r.writeChunk(m, f, chunk, buf[:length]); err != nil {
+			fail(err)
+			return
+		}
+		r.received(t, file, chunk, length)
+	}
+	writeMessage(conn, result{})
+}
+
+// writeChunk writes a verified chunk to the partial file
+func (r *Receiver) writeChunk(m *Manifest, f *File, chunk int, data []byte) error {
+	part, err := r.root.OpenFile(filepath.FromSlash(f.Path+partSuffix), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = part.WriteAt(data, int64(chunk)*m.ChunkSize)
+	if cerr := part.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// received marks a chunk as written and reports the progress
+func (r *Receiver) received(t *incoming, file, chunk int, length int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.missing[file][chunk] {
+		return
+	}
+	delete(t.missing[file], chunk)
+	t.remaining--
+	t.progress.Done += length
+	if r.OnProgress != nil {
+		r.OnProgress(t.progress)
+	}
+}
+
+// report reports the progress of a transfer
+func (r *Receiver) report(t *incoming) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if r.OnProgress != nil {
+		r.OnProgress(t.progress)
+	}
+}
+
+// finish verifies the SHA-256 of every received file and moves it from its
+// partial file into place. Partial files that fail stay for a resume.
+func (r *Receiver) finish(t *incoming) error {
+	t.mu.Lock()
+	remaining := t.remaining
+	t.mu.Unlock()
+	if remaining > 0 {
+		return fmt.Errorf("%d chunks are missing", remaining)
+	}
+
+	for i := range t.m.Files {
+		f := &t.m.Files[i]
+		if f.Dir || t.skip[i] {
+			continue
+		}
+		name := filepath.FromSlash(f.Path)
+		part, err := r.root.OpenFile(name+partSuffix, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, part)
+		if err == nil && hex.EncodeToString(h.Sum(nil)) != f.SHA256 {
+			err = fmt.Errorf("%w: %s", ErrIntegrity, f.Path)
+		}
+		if err == nil {
+			err = part.Chmod(f.Mode.Perm())
+		}
+		if err == nil {
+			err = r.rename(part, name+partSuffix, name)
+		}
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rename moves the open partial file part from oldname to newname in the
+// same directory. os.Root cannot rename before Go 1.25, so the names are
+// renamed by path, but only after checking that the path still leads to
+// the directory and the file that were opened through the root, which
+// refuses symbolic links that lead out of the target directory.
+func (r *Receiver) rename(part *os.File, oldname, newname string) error {
+	dir := filepath.Dir(newname)
+	inside, err := r.root.Stat(dir)
+	if err != nil {
+		return err
+	}
+	outside, err := os.Stat(filepath.Join(r.Dir, dir))
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(inside, outside) {
+		return fmt.Errorf("%w: %s leads out of the target directory", ErrInvalidPath, filepath.ToSlash(dir))
+	}
+
+	opened, err := part.Stat()
+	if err != nil {
+		return err
+	}
+	named, err := os.Lstat(filepath.Join(r.Dir, oldname))
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(opened, named) {
+		return fmt.Errorf("%w: %s was replaced", ErrInvalidPath, filepath.ToSlash(oldname))
+	}
+
+	return os.Rename(filepath.Join(r.Dir, oldname), filepath.Join(r.Dir, newname))
+}
@@ -0,0 +1,220 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestReceiver returns a receiver for a temporary directory, opened like Serve does
+func newTestReceiver(t *testing.T) *Receiver {
+	t.Helper()
+
+	r := &Receiver{Dir: t.TempDir()}
+	root, err := os.OpenRoot(r.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { root.Close() })
+	r.root = root
+	r.transfers = make(map[string]*incoming)
+	return r
+}
+
+// testManifest writes a file of the given size to a temporary directory and
+// returns its content and its manifest with the smallest chunk size
+func testManifest(t *testing.T, size int) ([]byte, *Manifest) {
+	t.Helper()
+
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	local := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(local, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest([]string{local}, MinChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content, m
+}
+
+func TestResume(t *testing.T) {
+	const chunk = MinChunkSize
+	content, m := testManifest(t, 3*chunk+100)
+	r := newTestReceiver(t)
+
+	// A partial file with a valid first chunk, a corrupted second chunk and
+	// a valid third chunk, that ends before the last chunk
+	partial := bytes.Clone(content[:3*chunk])
+	partial[chunk+1] ^= 0xff
+	if err := os.WriteFile(filepath.Join(r.Dir, "data.bin"+partSuffix), partial, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := r.prepare(m, "alice")
+	if err != nil {
+		t.Fatalf("prepare() error = %v", err)
+	}
+	if want := map[int]bool{1: true, 3: true}; len(tr.missing[0]) != len(want) || !tr.missing[0][1] || !tr.missing[0][3] {
+		t.Fatalf("missing chunks = %v, want %v", tr.missing[0], want)
+	}
+	if tr.progress.Resumed != 2*chunk {
+		t.Errorf("Resumed = %d, want %d", tr.progress.Resumed, 2*chunk)
+	}
+	if err := r.finish(tr); err == nil {
+		t.Fatal("finish() with missing chunks error = nil")
+	}
+
+	f := &m.Files[0]
+	for c := range tr.missing[0] {
+		data := content[int64(c)*chunk : int64(c)*chunk+m.chunkLen(f, c)]
+		if err := r.writeChunk(m, f, c, data); err != nil {
+			t.Fatalf("writeChunk() error = %v", err)
+		}
+		r.received(tr, 0, c, int64(len(data)))
+	}
+	if err := r.finish(tr); err != nil {
+		t.Fatalf("finish() error = %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(r.Dir, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("received file differs from the sent file")
+	}
+	if _, err := os.Stat(filepath.Join(r.Dir, "data.bin"+partSuffix)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial file remains: %v", err)
+	}
+
+	// Offering the same file again skips it
+	tr, err = r.prepare(m, "alice")
+	if err != nil {
+		t.Fatalf("prepare() of a received file error = %v", err)
+	}
+	if !tr.skip[0] || tr.remaining != 0 {
+		t.Errorf("prepare() of a received file: skip = %v, remaining = %d", tr.skip[0], tr.remaining)
+	}
+}
+
+func TestResumeIntegrity(t *testing.T) {
+	content, m := testManifest(t, MinChunkSize+100)
+	r := newTestReceiver(t)
+
+	tr, err := r.prepare(m, "alice")
+	if err != nil {
+		t.Fatalf("prepare() error = %v", err)
+	}
+
+	// Chunks are verified when they arrive, so a corrupted chunk that was
+	// written anyway can only be caught by the SHA-256 of the whole file
+	f := &m.Files[0]
+	corrupted := bytes.Clone(content)
+	corrupted[0] ^= 0xff
+	for c := range tr.missing[0] {
+		data := corrupted[int64(c)*m.ChunkSize : int64(c)*m.ChunkSize+m.chunkLen(f, c)]
+		if err := r.writeChunk(m, f, c, data); err != nil {
+			t.Fatal(err)
+		}
+		r.received(tr, 0, c, int64(len(data)))
+	}
+	if err := r.finish(tr); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("finish() error = %v, want ErrIntegrity", err)
+	}
+
+	// The partial file stays, and a new offer only asks for the bad chunk
+	tr, err = r.prepare(m, "alice")
+	if err != nil {
+		t.Fatalf("prepare() error = %v", err)
+	}
+	if len(tr.missing[0]) != 1 || !tr.missing[0][0] {
+		t.Errorf("missing chunks = %v, want [0]", tr.missing[0])
+	}
+}
+
+func TestExistingFile(t *testing.T) {
+	_, m := testManifest(t, 100)
+	r := newTestReceiver(t)
+	if err := os.WriteFile(filepath.Join(r.Dir, "data.bin"), []byte("other"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.prepare(m, "alice"); err == nil {
+		t.Fatal("prepare() over a different file error = nil")
+	}
+	r.Overwrite = true
+	tr, err := r.prepare(m, "alice")
+	if err != nil {
+		t.Fatalf("prepare() with Overwrite error = %v", err)
+	}
+	if tr.skip[0] || len(tr.missing[0]) != 1 {
+		t.Errorf("prepare() with Overwrite: skip = %v, missing = %v", tr.skip[0], tr.missing[0])
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	m := &Manifest{Files: []File{{Path: "a", Dir: true}, {Path: "a/b", Size: 600}, {Path: "a/c", Size: 400}}}
+
+	tests := []struct {
+		name     string
+		maxSize  int64
+		maxFiles int
+		ok       bool
+	}{
+		{"unlimited", 0, 0, true},
+		{"within limits", 1000, 3, true},
+		{"too large", 999, 0, false},
+		{"too many files", 0, 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Receiver{MaxSize: tt.maxSize, MaxFiles: tt.maxFiles}
+			err := r.checkLimits(m)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("checkLimits() error = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrTooLarge) {
+				t.Fatalf("checkLimits() error = %v, want ErrTooLarge", err)
+			}
+		})
+	}
+}
+
+func TestFinishMode(t *testing.T) {
+	content, m := testManifest(t, 100)
+	r := newTestReceiver(t)
+
+	// validate refuses such a manifest, finish applies only the permission
+	// bits anyway
+	m.Files[0].Mode = fs.ModeSetuid | fs.ModeSetgid | 0o750
+	tr, err := r.prepare(m, "alice")
+	if err != nil {
+		t.Fatalf("prepare() error = %v", err)
+	}
+	if err := r.writeChunk(m, &m.Files[0], 0, content); err != nil {
+		t.Fatal(err)
+	}
+	r.received(tr, 0, 0, int64(len(content)))
+	if err := r.finish(tr); err != nil {
+		t.Fatalf("finish() error = %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(r.Dir, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != 0o750 {
+		t.Errorf("mode = %s, want %s", info.Mode(), fs.FileMode(0o750))
+	}
+}
@@ -0,0 +1,240 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/mevdschee/p2pquic-go/pkg/p2pquic"
+)
+
+// Sender sends files to remote peers
+type Sender struct {
+	Peer *p2pquic.Peer
+
+	// Streams is the number of streams chunks are sent over in parallel
+	// (zero means DefaultStreams)
+	Streams int
+
+	// OnProgress is called after every chunk that was sent, one call at a time
+	OnProgress func(Progress)
+
+	// Logger receives a line for every transfer (nil discards them)
+	Logger *slog.Logger
+}
+
+// chunkRef is a chunk of a file of a manifest
+type chunkRef struct {
+	file  int
+	chunk int
+}
+
+// log returns the logger of the sender
+func (s *Sender) log() *slog.Logger {
+	if s.Logger == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+	return s.Logger
+}
+
+// Send offers the files of a manifest to a remote peer, sends the chunks it
+// does not have yet and returns once it verified all files. Send the same
+// manifest again to resume a transfer that failed.
+func (s *Sender) Send(ctx context.Context, remotePeerID string, m *Manifest) error {
+	offer := *m
+	offer.ID = newID()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn, err := s.Peer.DialStream(ctx, remotePeerID)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	if err := writeHeader(conn, kindOffer); err != nil {
+		return canceled(ctx, err)
+	}
+	if err := writeMessage(conn, &offer); err != nil {
+		return canceled(ctx, err)
+	}
+	var p plan
+	if err := readMessage(conn, &p); err != nil {
+		return canceled(ctx, err)
+	}
+	if p.Error != "" {
+		return fmt.Errorf("%w: %s", ErrRejected, p.Error)
+	}
+
+	var work []chunkRef
+	var missing int64
+	if len(p.Need) != len(offer.Files) {
+		return errors.New("invalid answer to offer")
+	}
+	for i, need := range p.Need {
+		f := &offer.Files[i]
+		for _, c := range need {
+			if c < 0 || c >= len(f.Chunks) {
+				return errors.New("invalid answer to offer")
+			}
+			work = append(work, chunkRef{file: i, chunk: c})
+			missing += offer.chunkLen(f, c)
+		}
+	}
+
+	total := offer.Size()
+	progress := Progress{ID: offer.ID, PeerID: remotePeerID, Total: total, Done: total - missing, Resumed: total - missing}
+	log := s.log().With("peer_id", remotePeerID, "id", offer.ID)
+	log.Info("Sending transfer", "files", len(offer.Files), "bytes", total, "resumed", progress.Resumed)
+
+	var mu sync.Mutex
+	report := func(n int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		progress.Done += n
+		if s.OnProgress != nil {
+			s.OnProgress(progress)
+		}
+	}
+	report(0)
+
+	if err := s.sendChunks(ctx, remotePeerID, &offer, work, report); err != nil {
+		return canceled(ctx, err)
+	}
+
+	if _, err := conn.Write([]byte{done}); err != nil {
+		return canceled(ctx, err)
+	}
+	var r result
+	if err := readMessage(conn, &r); err != nil {
+		return canceled(ctx, err)
+	}
+	if r.Error != "" {
+		return fmt.Errorf("receiver failed: %s", r.Error)
+	}
+	log.Info("Transfer completed", "files", len(offer.Files), "bytes", total)
+	return nil
+}
+
+// sendChunks sends chunks over several streams in parallel
+func (s *Sender) sendChunks(ctx context.Context, remotePeerID string, m *Manifest, work []chunkRef, report func(int64)) error {
+	if len(work) == 0 {
+		return nil
+	}
+	streams := s.Streams
+	if streams <= 0 {
+		streams = DefaultStreams
+	}
+	streams = min(streams, len(work))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan chunkRef)
+	go func() {
+		defer close(queue)
+		for _, ref := range work {
+			select {
+			case queue <- ref:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	errs := make(chan error, streams)
+	for range streams {
+		go func() {
+			errs <- s.sendStream(ctx, remotePeerID, m, queue, report)
+		}()
+	}
+
+	var first error
+	for range streams {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+			cancel()
+		}
+	}
+	if first == nil {
+		// The queue stops early when ctx is done
+		first = ctx.Err()
+	}
+	return first
+}
+
+// sendStream sends the chunks of the queue over a stream of its own and
+// waits until the receiver wrote them
+func (s *Sender) sendStream(ctx context.Context, remotePeerID string, m *Manifest, queue <-chan chunkRef, report func(int64)) error {
+	conn, err := s.Peer.DialStream(ctx, remotePeerID)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	if err := writeHeader(conn, kindChunks); err != nil {
+		return err
+	}
+	if err := writeMessage(conn, hello{ID: m.ID}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, chunkHeaderSize+m.ChunkSize)
+	for ref := range queue {
+		f := &m.Files[ref.file]
+		n := m.chunkLen(f, ref.chunk)
+		if err := readChunk(f.local, int64(ref.chunk)*m.ChunkSize, buf[chunkHeaderSize:chunkHeaderSize+n]); err != nil {
+			return fmt.Errorf("reading %s: %w", f.local, err)
+		}
+		putChunkHeader(buf, ref.file, ref.chunk, n)
+		if _, err := conn.Write(buf[:chunkHeaderSize+n]); err != nil {
+			return err
+		}
+		report(n)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		return err
+	}
+
+	var r result
+	if err := readMessage(conn, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return fmt.Errorf("receiver failed: %s", r.Error)
+	}
+	return nil
+}
+
+// readChunk reads a chunk of a local file
+func readChunk(name string, offset int64, buf []byte) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.ReadAt(buf, offset)
+	return err
+}
+
+// canceled returns the error of ctx once it is done, which closes the
+// streams, or err otherwise
+func canceled(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,370 @@
+// Package transfer sends files and directory trees between peers. The
+// sender offers a manifest with the size and SHA-256 of every file and of
+// every chunk of it, the receiver answers with the chunks it does not have
+// yet, and the sender sends them over several streams in parallel. Partial
+// files are kept, so a transfer that is offered again after a reconnect
+// resumes where it stopped.
+package transfer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const (
+	// DefaultChunkSize is the size of the chunks files are hashed and sent in
+	DefaultChunkSize = 4 << 20
+
+	// MinChunkSize and MaxChunkSize bound the chunk size of a manifest
+	MinChunkSize = 64 << 10
+	MaxChunkSize = 64 << 20
+
+	// DefaultStreams is the number of streams chunks are sent over in parallel
+	DefaultStreams = 4
+
+	// partSuffix is appended to the name of a file while it is received
+	partSuffix = ".p2pquic-part"
+)
+
+// version is the version of the stream header
+const version = 1
+
+// kind is the purpose of a stream, sent after the version
+type kind byte
+
+const (
+	// kindOffer carries the manifest, the answer with the missing chunks,
+	// and the final verification of a transfer
+	kindOffer kind = 1
+
+	// kindChunks carries chunks of a transfer that was offered
+	kindChunks kind = 2
+)
+
+// maxMessage is the maximum size of a JSON message, which bounds the manifest
+const maxMessage = 64 << 20
+
+// done is sent by the sender on the offer stream once all chunks were acknowledged
+const done = 1
+
+var (
+	// ErrRejected is returned when the receiver refused a transfer
+	ErrRejected = errors.New("transfer rejected")
+
+	// ErrInvalidPath is returned for a manifest path that is not a local,
+	// clean, slash-separated path, for example one that escapes the target
+	// directory with ".."
+	ErrInvalidPath = errors.New("invalid path")
+
+	// ErrIntegrity is returned when a chunk or a file does not match its SHA-256
+	ErrIntegrity = errors.New("integrity check failed")
+
+	// ErrTooLarge is returned for a transfer beyond the size or file limits
+	// of the receiver
+	ErrTooLarge = errors.New("transfer too large")
+
+	errVersion = errors.New("unsupported transfer protocol version")
+)
+
+// File is a file or directory of a manifest
+type File struct {
+	// Path is slash-separated and relative to the target directory
+	Path string `json:"path"`
+
+	// Dir marks a directory, which has no content
+	Dir bool `json:"dir,omitempty"`
+
+	// Mode holds the permission bits, other bits are refused
+	Mode fs.FileMode `json:"mode"`
+
+	Size int64 `json:"size"`
+
+	// SHA256 is the hex SHA-256 of the content
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Chunks are the hex SHA-256 of every chunk of the content
+	Chunks []string `json:"chunks,omitempty"`
+
+	// local is the path of the file on the sending side
+	local string
+}
+
+// Manifest describes the files of a transfer
+type Manifest struct {
+	// ID identifies the transfer, a new one is assigned for every offer
+	ID string `json:"id"`
+
+	ChunkSize int64  `json:"chunk_size"`
+	Files     []File `json:"files"`
+}
+
+// Size returns the total size of the files
+func (m *Manifest) Size() int64 {
+	var size int64
+	for _, f := range m.Files {
+		size += f.Size
+	}
+	return size
+}
+
+// chunkLen returns the length of a chunk of a file
+func (m *Manifest) chunkLen(f *File, chunk int) int64 {
+	return min(m.ChunkSize, f.Size-int64(chunk)*m.ChunkSize)
+}
+
+// BuildManifest hashes local files and directories into a manifest.
+// Directories are sent with their contents under their own name, like
+// "cp -r"; symbolic links and special files are skipped.
+func BuildManifest(paths []string, chunkSize int64) (*Manifest, error) {
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	m := &Manifest{ChunkSize: chunkSize}
+	seen := make(map[string]bool)
+
+	add := func(local, name string, d fs.DirEntry) error {
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if seen[name] {
+			return fmt.Errorf("%s is given twice", name)
+		}
+		seen[name] = true
+
+		switch {
+		case info.IsDir():
+			m.Files = append(m.Files, File{Path: name, Dir: true, Mode: info.Mode().Perm()})
+		case info.Mode().IsRegular():
+			f := File{Path: name, Mode: info.Mode().Perm(), local: local}
+			if err := hashFile(&f, chunkSize); err != nil {
+				return err
+			}
+			m.Files = append(m.Files, f)
+		}
+		return nil
+	}
+
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		base := filepath.Base(abs)
+		if !filepath.IsLocal(base) {
+			return nil, fmt.Errorf("cannot send %s", p)
+		}
+
+		err = filepath.WalkDir(abs, func(local string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(abs, local)
+			if err != nil {
+				return err
+			}
+			return add(local, path.Join(base, filepath.ToSlash(rel)), d)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, validate(m)
+}
+
+// hashFile sets the size and the hashes of a file
+func hashFile(f *File, chunkSize int64) error {
+	file, err := os.Open(f.local)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	whole := sha256.New()
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			whole.Write(buf[:n])
+			sum := sha256.Sum256(buf[:n])
+			f.Chunks = append(f.Chunks, hex.EncodeToString(sum[:]))
+			f.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	f.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	return nil
+}
+
+// validate checks a manifest before anything is written: the chunk size,
+// that every path stays inside the target directory, that modes only hold
+// permission bits (no setuid, setgid or sticky bit), and that the hashes
+// match the sizes
+func validate(m *Manifest) error {
+	if m.ChunkSize < MinChunkSize || m.ChunkSize > MaxChunkSize {
+		return fmt.Errorf("chunk size %d out of range", m.ChunkSize)
+	}
+	seen := make(map[string]bool)
+	for _, f := range m.Files {
+		if f.Path == "" || path.Clean(f.Path) != f.Path || !filepath.IsLocal(filepath.FromSlash(f.Path)) {
+			return fmt.Errorf("%w: %q", ErrInvalidPath, f.Path)
+		}
+		if seen[f.Path] {
+			return fmt.Errorf("%w: %q is listed twice", ErrInvalidPath, f.Path)
+		}
+		seen[f.Path] = true
+
+		if f.Mode&^fs.ModePerm != 0 {
+			return fmt.Errorf("%s has mode %s, only permission bits are allowed", f.Path, f.Mode)
+		}
+
+		if f.Dir {
+			if f.Size != 0 || len(f.Chunks) != 0 {
+				return fmt.Errorf("directory %s has content", f.Path)
+			}
+			continue
+		}
+		if f.Size < 0 || int64(len(f.Chunks)) != (f.Size+m.ChunkSize-1)/m.ChunkSize {
+			return fmt.Errorf("%s has %d chunks for %d bytes", f.Path, len(f.Chunks), f.Size)
+		}
+		if !isHash(f.SHA256) {
+			return fmt.Errorf("%s has an invalid SHA-256", f.Path)
+		}
+		for _, h := range f.Chunks {
+			if !isHash(h) {
+				return fmt.Errorf("%s has an invalid chunk SHA-256", f.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// isHash reports whether s is a hex SHA-256
+func isHash(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// newID returns a random transfer ID
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Progress is the state of a transfer, as delivered to OnProgress
+type Progress struct {
+	// ID and PeerID identify the transfer and the remote peer
+	ID     string
+	PeerID string
+
+	// Total is the size of all files, and Done the part that was sent or
+	// received and verified so far, including Resumed, the part the
+	// receiver already had when the transfer was offered
+	Total   int64
+	Done    int64
+	Resumed int64
+}
+
+// Percent returns the part of the transfer that is done
+func (p Progress) Percent() float64 {
+	if p.Total == 0 {
+		return 100
+	}
+	return float64(p.Done) * 100 / float64(p.Total)
+}
+
+// plan is the answer of the receiver to an offer
+type plan struct {
+	Error string `json:"error,omitempty"`
+
+	// Need lists the missing chunks of every file, by file index
+	Need [][]int `json:"need,omitempty"`
+}
+
+// result is the answer of the receiver to done, or to a chunks stream
+type result struct {
+	Error string `json:"error,omitempty"`
+}
+
+// writeHeader starts a stream
+func writeHeader(w io.Writer, k kind) error {
+	_, err := w.Write([]byte{version, byte(k)})
+	return err
+}
+
+// readHeader reads the start of a stream
+func readHeader(r io.Reader) (kind, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	if hdr[0] != version {
+		return 0, errVersion
+	}
+	return kind(hdr[1]), nil
+}
+
+// writeMessage writes a JSON message with a 32-bit length
+func writeMessage(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	_, err = w.Write(append(buf, data...))
+	return err
+}
+
+// readMessage reads a JSON message with a 32-bit length
+func readMessage(r io.Reader, v any) error {
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(n[:])
+	if length > maxMessage {
+		return errors.New("message too long")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// hello starts a chunks stream with the transfer the chunks belong to
+type hello struct {
+	ID string `json:"id"`
+}
+
+// chunkHeaderSize is the size of the header that precedes the data of a
+// chunk on a chunks stream: the file index, the chunk index and the length
+const chunkHeaderSize = 12
+
+// putChunkHeader encodes the header of a chunk
+func putChunkHeader(b []byte, file, chunk int, length int64) {
+	binary.BigEndian.PutUint32(b[0:], uint32(file))
+	binary.BigEndian.PutUint32(b[4:], uint32(chunk))
+	binary.BigEndian.PutUint32(b[8:], uint32(length))
+}
+
+// parseChunkHeader decodes the header of a chunk
+func parseChunkHeader(b []byte) (file, chunk int, length int64) {
+	return int(binary.BigEndian.Uint32(b[0:])), int(binary.BigEndian.Uint32(b[4:])), int64(binary.BigEndian.Uint32(b[8:]))
+}
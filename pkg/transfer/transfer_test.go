@@ -0,0 +1,86 @@
+package transfer
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	file := func(p string) File {
+		return File{Path: p, Mode: 0o644, Size: 1, SHA256: hash, Chunks: []string{hash}}
+	}
+	dir := func(p string) File {
+		return File{Path: p, Dir: true, Mode: 0o755}
+	}
+
+	tests := []struct {
+		name  string
+		files []File
+		want  error // nil for a valid manifest, or the error it must wrap
+	}{
+		{"file", []File{file("a.txt")}, nil},
+		{"tree", []File{dir("a"), dir("a/b"), file("a/b/c.txt")}, nil},
+		{"dots in name", []File{file("a/..b"), file("...")}, nil},
+		{"empty path", []File{file("")}, ErrInvalidPath},
+		{"parent", []File{file("..")}, ErrInvalidPath},
+		{"parent prefix", []File{file("../a.txt")}, ErrInvalidPath},
+		{"parent inside", []File{file("a/../../b.txt")}, ErrInvalidPath},
+		{"parent of directory", []File{dir("a/..")}, ErrInvalidPath},
+		{"absolute", []File{file("/etc/passwd")}, ErrInvalidPath},
+		{"unclean", []File{file("a//b.txt")}, ErrInvalidPath},
+		{"current directory", []File{file("./a.txt")}, ErrInvalidPath},
+		{"trailing slash", []File{dir("a/")}, ErrInvalidPath},
+		{"duplicate file", []File{file("a.txt"), file("a.txt")}, ErrInvalidPath},
+		{"duplicate directory", []File{dir("a"), dir("a")}, ErrInvalidPath},
+		{"file and directory", []File{dir("a"), file("a")}, ErrInvalidPath},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate(&Manifest{ChunkSize: MinChunkSize, Files: tt.files})
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("validate() error = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("validate() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateContent(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name      string
+		chunkSize int64
+		file      File
+	}{
+		{"chunk size too small", MinChunkSize - 1, File{Path: "a", SHA256: hash}},
+		{"chunk size too large", MaxChunkSize + 1, File{Path: "a", SHA256: hash}},
+		{"missing chunk", MinChunkSize, File{Path: "a", Size: MinChunkSize + 1, SHA256: hash, Chunks: []string{hash}}},
+		{"extra chunk", MinChunkSize, File{Path: "a", Size: 1, SHA256: hash, Chunks: []string{hash, hash}}},
+		{"negative size", MinChunkSize, File{Path: "a", Size: -1, SHA256: hash}},
+		{"invalid hash", MinChunkSize, File{Path: "a", Size: 1, SHA256: "ab", Chunks: []string{hash}}},
+		{"invalid chunk hash", MinChunkSize, File{Path: "a", Size: 1, SHA256: hash, Chunks: []string{"zz"}}},
+		{"directory with content", MinChunkSize, File{Path: "a", Dir: true, Size: 1}},
+		{"setuid", MinChunkSize, File{Path: "a", Mode: fs.ModeSetuid | 0o755, Size: 1, SHA256: hash, Chunks: []string{hash}}},
+		{"setgid", MinChunkSize, File{Path: "a", Mode: fs.ModeSetgid | 0o755, Size: 1, SHA256: hash, Chunks: []string{hash}}},
+		{"sticky directory", MinChunkSize, File{Path: "a", Dir: true, Mode: fs.ModeSticky | 0o777}},
+		{"symbolic link", MinChunkSize, File{Path: "a", Mode: fs.ModeSymlink | 0o777, Size: 1, SHA256: hash, Chunks: []string{hash}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validate(&Manifest{ChunkSize: tt.chunkSize, Files: []File{tt.file}}); err == nil {
+				t.Fatal("validate() error = nil")
+			}
+		})
+	}
+}